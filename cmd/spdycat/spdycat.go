@@ -0,0 +1,345 @@
+// cmd/spdycat/spdycat.go
+
+// Command spdycat fetches URLs over SPDY and prints the responses.  It is
+// meant for debugging servers without a browser:
+//
+//	spdycat [flags] url...
+//
+// The URLs are fetched concurrently, and those with the same origin share
+// one SPDY session.  The -mode flag chooses how to connect:
+//
+//	auto  plain TCP for http URLs and npn for https URLs (the default)
+//	tcp   plain SPDY over TCP, as spdy.Server speaks it
+//	tls   TLS, assuming the server speaks SPDY without negotiating it
+//	npn   TLS, requiring the server to negotiate spdy/2.  Go's crypto/tls
+//	      implements ALPN, NPN's successor, rather than NPN itself.
+//
+// Each response is printed as its status line, headers and body, in the
+// order of the arguments.  Streams the server pushes are accepted and
+// printed after the responses.  With -v, every frame sent and received is
+// printed to standard error.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cs490/spdy"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// headerFlag collects repeated -H flags.
+type headerFlag []string
+
+func (h *headerFlag) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerFlag) Set(s string) error {
+	if name, _, ok := strings.Cut(s, ":"); !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("header %q is not of the form Name: value", s)
+	}
+	*h = append(*h, s)
+	return nil
+}
+
+// run runs spdycat with args and returns its exit status.
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("spdycat", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	mode := fs.String("mode", "auto", "how to connect: auto, tcp, tls or npn")
+	insecure := fs.Bool("k", false, "don't verify TLS certificates")
+	connect := fs.String("connect", "", "dial `host:port` instead of the URLs' hosts")
+	verbose := fs.Bool("v", false, "print every frame to standard error")
+	timeout := fs.Duration("timeout", 30*time.Second, "give up after `duration`")
+	var headers headerFlag
+	fs.Var(&headers, "H", "add a request header, as `Name: value`; may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: spdycat [flags] url...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	httpMode, httpsMode := *mode, *mode
+	switch *mode {
+	case "auto":
+		httpMode, httpsMode = "tcp", "npn"
+	case "tcp", "tls", "npn":
+	default:
+		fmt.Fprintf(stderr, "spdycat: unknown mode %q\n", *mode)
+		return 2
+	}
+
+	c := &cat{
+		connect:   *connect,
+		tlsConfig: &tls.Config{InsecureSkipVerify: *insecure},
+		pushes:    make(map[string]string),
+	}
+	if *verbose {
+		c.frames = &lineWriter{w: stderr}
+	}
+	tr := &spdy.Transport{
+		DialContext:    c.dialer(httpMode),
+		DialTLSContext: c.dialer(httpsMode),
+		AcceptPush:     c.acceptPush,
+	}
+	defer c.closeDumps()
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr, Timeout: *timeout}
+
+	outputs := make([]bytes.Buffer, fs.NArg())
+	ok := make([]bool, fs.NArg())
+	var wg sync.WaitGroup
+	for i, rawURL := range fs.Args() {
+		wg.Add(1)
+		go func(i int, rawURL string) {
+			defer wg.Done()
+			fmt.Fprintf(&outputs[i], "==> GET %s\n", rawURL)
+			ok[i] = fetch(&outputs[i], client, rawURL, headers)
+		}(i, rawURL)
+	}
+	wg.Wait()
+	status := 0
+	for i := range outputs {
+		stdout.Write(outputs[i].Bytes())
+		if !ok[i] {
+			status = 1
+		}
+	}
+	// Pushed responses wait in the Transport's push cache, so asking for
+	// them does not reach the server.
+	for _, pushed := range c.pushed() {
+		var out bytes.Buffer
+		fmt.Fprintf(&out, "==> pushed %s (with %s)\n", pushed[0], pushed[1])
+		if !fetch(&out, client, pushed[0], headers) {
+			status = 1
+		}
+		stdout.Write(out.Bytes())
+	}
+	return status
+}
+
+// fetch GETs rawURL and writes the response to w.  It reports whether
+// the response was received in full.
+func fetch(w io.Writer, client *http.Client, rawURL string, headers []string) bool {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		fmt.Fprintf(w, "error: %v\n\n", err)
+		return false
+	}
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(w, "error: %v\n\n", err)
+		return false
+	}
+	defer resp.Body.Close()
+	fmt.Fprintf(w, "%s %s\n", resp.Proto, resp.Status)
+	names := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range resp.Header[name] {
+			fmt.Fprintf(w, "%s: %s\n", name, v)
+		}
+	}
+	fmt.Fprintln(w)
+	_, err = io.Copy(w, resp.Body)
+	fmt.Fprintln(w)
+	if err != nil {
+		fmt.Fprintf(w, "error: reading body: %v\n\n", err)
+		return false
+	}
+	return true
+}
+
+// A cat holds the connection settings and the pushes seen.
+type cat struct {
+	connect   string
+	tlsConfig *tls.Config
+	frames    *lineWriter // nil unless frames are printed
+
+	mu     sync.Mutex
+	pushes map[string]string // pushed URL to the URL it was pushed with
+	order  []string
+	dumps  []*dumpConn
+}
+
+// closeDumps closes the connections whose frames are printed and waits
+// until the last of their frames has been.
+func (c *cat) closeDumps() {
+	c.mu.Lock()
+	dumps := c.dumps
+	c.mu.Unlock()
+	for _, dc := range dumps {
+		dc.Close()
+	}
+	if c.frames != nil {
+		c.frames.wg.Wait()
+	}
+}
+
+// dialer returns a dial function that connects in mode.
+func (c *cat) dialer(mode string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		target := addr
+		if c.connect != "" {
+			target = c.connect
+		}
+		conn, err := new(net.Dialer).DialContext(ctx, network, target)
+		if err != nil {
+			return nil, err
+		}
+		if mode != "tcp" {
+			if conn, err = c.handshake(ctx, conn, addr, mode == "npn"); err != nil {
+				return nil, err
+			}
+		}
+		if c.frames != nil {
+			dc := newDumpConn(conn, c.frames)
+			c.mu.Lock()
+			c.dumps = append(c.dumps, dc)
+			c.mu.Unlock()
+			conn = dc
+		}
+		return conn, nil
+	}
+}
+
+// handshake runs a TLS handshake on conn for addr.  If negotiate is set,
+// spdy/2 is offered and the server must select it.
+func (c *cat) handshake(ctx context.Context, conn net.Conn, addr string, negotiate bool) (net.Conn, error) {
+	config := c.tlsConfig.Clone()
+	config.ServerName, _, _ = net.SplitHostPort(addr)
+	if negotiate {
+		config.NextProtos = []string{spdy.NextProtoSPDY2}
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if negotiate && tc.ConnectionState().NegotiatedProtocol != spdy.NextProtoSPDY2 {
+		tc.Close()
+		return nil, spdy.ErrNoSPDY
+	}
+	return tc, nil
+}
+
+// acceptPush accepts every push and remembers it.
+func (c *cat) acceptPush(u *url.URL, req *http.Request) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pushes[u.String()]; !ok {
+		c.order = append(c.order, u.String())
+	}
+	c.pushes[u.String()] = req.URL.String()
+	return true
+}
+
+// pushed returns the pushed URLs, each with the URL it was pushed with, in
+// the order they arrived.
+func (c *cat) pushed() [][2]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var pushed [][2]string
+	for _, u := range c.order {
+		pushed = append(pushed, [2]string{u, c.pushes[u]})
+	}
+	return pushed
+}
+
+// A lineWriter writes whole blocks of lines, each with a prefix, so that
+// frames from several connections do not interleave.
+type lineWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+	wg sync.WaitGroup // frame decoders running
+}
+
+func (lw *lineWriter) print(prefix string, block []byte) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(string(block), "\n"), "\n") {
+		io.WriteString(lw.w, prefix+strings.TrimSuffix(line, "\n")+"\n")
+	}
+}
+
+// A dumpConn prints the frames read from and written to a connection.
+type dumpConn struct {
+	net.Conn
+	in, out *io.PipeWriter
+}
+
+func newDumpConn(conn net.Conn, lw *lineWriter) *dumpConn {
+	return &dumpConn{Conn: conn, in: dumpFrames(lw, "< "), out: dumpFrames(lw, "> ")}
+}
+
+func (c *dumpConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Write(p[:n])
+	return n, err
+}
+
+func (c *dumpConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Write(p[:n])
+	return n, err
+}
+
+func (c *dumpConn) Close() error {
+	c.in.Close()
+	c.out.Close()
+	return c.Conn.Close()
+}
+
+// dumpFrames returns a pipe that decodes the bytes written to it as frames
+// and prints them.  Once the bytes cannot be decoded, writes fail and the
+// stream is ignored.
+func dumpFrames(lw *lineWriter, prefix string) *io.PipeWriter {
+	pr, pw := io.Pipe()
+	lw.wg.Add(1)
+	go func() {
+		defer lw.wg.Done()
+		hr := spdy.NewHeaderReader()
+		for {
+			f, err := spdy.ReadFrame(pr)
+			if err != nil {
+				pr.CloseWithError(err)
+				return
+			}
+			var buf bytes.Buffer
+			err = spdy.DumpFrame(&buf, f, hr)
+			lw.print(prefix, buf.Bytes())
+			if err != nil {
+				lw.print(prefix, []byte("(giving up on this direction: "+err.Error()+")"))
+				pr.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pw
+}
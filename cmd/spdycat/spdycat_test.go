@@ -0,0 +1,104 @@
+// cmd/spdycat/spdycat_test.go
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cs490/spdy"
+)
+
+// serve starts srv on a local listener, wrapped by wrap if it is not nil,
+// and returns its address.
+func serve(t *testing.T, srv *spdy.Server, wrap func(net.Listener) net.Listener) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	if wrap != nil {
+		l = wrap(l)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return addr
+}
+
+var pathHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-Path", req.URL.Path)
+	io.WriteString(w, "path "+req.URL.Path)
+})
+
+func TestSpdycat(t *testing.T) {
+	base := "http://" + serve(t, &spdy.Server{Handler: pathHandler}, nil)
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-v", base + "/a", base + "/b"}, &stdout, &stderr); status != 0 {
+		t.Fatalf("exit status %d; stderr:\n%s", status, &stderr)
+	}
+	want := "==> GET " + base + "/a\nHTTP/1.1 200 OK\n"
+	if out := stdout.String(); !strings.HasPrefix(out, want) || !strings.Contains(out, "X-Path: /a\n") ||
+		!strings.Contains(out, "\n\npath /a\n") || !strings.Contains(out, "==> GET "+base+"/b\n") || !strings.Contains(out, "\n\npath /b\n") {
+		t.Errorf("output:\n%s\nwant both responses, starting with:\n%s", out, want)
+	}
+	// Both requests share the session that the server's one SETTINGS
+	// frame opened.
+	frames := stderr.String()
+	for _, want := range []string{"> SYN_STREAM", ">   stream=3 ", "< SYN_REPLY", "<   x-path: /b"} {
+		if !strings.Contains(frames, want) {
+			t.Errorf("frames do not contain %q:\n%s", want, frames)
+		}
+	}
+	if n := strings.Count(frames, "< SETTINGS"); n != 1 {
+		t.Errorf("%d SETTINGS frames received, want 1:\n%s", n, frames)
+	}
+}
+
+func TestSpdycatTLS(t *testing.T) {
+	// Borrow httptest's certificate.
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+	config := &tls.Config{Certificates: ts.TLS.Certificates, NextProtos: []string{spdy.NextProtoSPDY2}}
+	addr := serve(t, &spdy.Server{Handler: pathHandler}, func(l net.Listener) net.Listener { return tls.NewListener(l, config) })
+	for _, mode := range []string{"auto", "npn", "tls"} {
+		var stdout, stderr bytes.Buffer
+		if status := run([]string{"-k", "-mode", mode, "https://" + addr + "/secure"}, &stdout, &stderr); status != 0 {
+			t.Errorf("-mode %s: exit status %d; stderr:\n%s\nstdout:\n%s", mode, status, &stderr, &stdout)
+		} else if !strings.Contains(stdout.String(), "\n\npath /secure\n") {
+			t.Errorf("-mode %s: output:\n%s", mode, &stdout)
+		}
+	}
+	// In tcp mode the TLS server cannot be reached.
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-mode", "tcp", "-timeout", "1s", "https://" + addr + "/"}, &stdout, &stderr); status != 1 || !strings.Contains(stdout.String(), "error: ") {
+		t.Errorf("-mode tcp against TLS: exit status %d; output:\n%s", status, &stdout)
+	}
+}
+
+func TestSpdycatConnect(t *testing.T) {
+	addr := serve(t, &spdy.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.Host+" "+req.Header.Get("X-Test"))
+	})}, nil)
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-connect", addr, "-H", "X-Test: yes", "http://example.com/"}, &stdout, &stderr); status != 0 {
+		t.Fatalf("exit status %d; stderr:\n%s", status, &stderr)
+	}
+	if !strings.Contains(stdout.String(), "\n\nexample.com yes\n") {
+		t.Errorf("output:\n%s\nwant the request for example.com with X-Test", &stdout)
+	}
+}
+
+func TestSpdycatUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"-mode", "udp", "http://example.com/"}, {"-H", "bad", "http://example.com/"}} {
+		var stdout, stderr bytes.Buffer
+		if status := run(args, &stdout, &stderr); status != 2 || stderr.Len() == 0 {
+			t.Errorf("run(%q) = %d with stderr %q, want 2 and a message", args, status, &stderr)
+		}
+	}
+}
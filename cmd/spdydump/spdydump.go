@@ -0,0 +1,395 @@
+// cmd/spdydump/spdydump.go
+
+// Command spdydump decodes a byte dump of one direction of a SPDY
+// connection into readable frames with decompressed headers:
+//
+//	spdydump [-format auto|binary|hex|decimal] [file...]
+//
+// With no files, or with "-", it reads standard input.  Each file is
+// decoded separately, as its own direction of a connection.  Dumps may be
+// raw bytes, hex ("16 03 01", "0x16,0x03", "160301") or decimal
+// ("22 3 1"); by default the format is guessed.
+//
+// Captures that are not SPDY are identified instead of decoded as garbage:
+// a TLS handshake, whose ClientHello is summarized, means the client
+// expected SPDY over TLS; an HTTP/1.x request or response means the peer
+// was not speaking SPDY at all.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"cs490/spdy"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs spdydump with args and returns its exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("spdydump", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	format := fs.String("format", "auto", "input format: auto, binary, hex or decimal")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: spdydump [-format auto|binary|hex|decimal] [file...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	switch *format {
+	case "auto", "binary", "hex", "decimal":
+	default:
+		fmt.Fprintf(stderr, "spdydump: unknown format %q\n", *format)
+		return 2
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	status := 0
+	for i, name := range files {
+		var in []byte
+		var err error
+		if name == "-" {
+			in, err = io.ReadAll(stdin)
+		} else {
+			in, err = os.ReadFile(name)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "spdydump: %v\n", err)
+			status = 1
+			continue
+		}
+		if len(files) > 1 {
+			if i > 0 {
+				fmt.Fprintln(stdout)
+			}
+			fmt.Fprintf(stdout, "==> %s\n", name)
+		}
+		data, used, err := decodeInput(in, *format)
+		if err != nil {
+			fmt.Fprintf(stderr, "spdydump: %s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "%d bytes (%s)\n", len(data), used)
+		if err := describe(stdout, data); err != nil {
+			fmt.Fprintf(stderr, "spdydump: %s: %v\n", name, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// decodeInput returns the bytes of a dump in format, guessing the format
+// if it is "auto", and the format used.
+func decodeInput(in []byte, format string) ([]byte, string, error) {
+	if format == "auto" {
+		format = guessFormat(in)
+	}
+	var data []byte
+	var err error
+	switch format {
+	case "binary":
+		data = in
+	case "hex":
+		data, err = parseHex(in)
+	case "decimal":
+		data, err = parseDecimal(in)
+	}
+	return data, format, err
+}
+
+// dumpFields splits a text dump into its numbers.
+func dumpFields(in []byte) []string {
+	return strings.FieldsFunc(string(in), func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == ','
+	})
+}
+
+// guessFormat decides whether in is a text dump, and of which kind.  Hex
+// dumps have letters, 0x prefixes or a fixed two digits per byte; decimal
+// dumps have numbers of varying width, as in "22 3 1 0 187".
+func guessFormat(in []byte) string {
+	fields := dumpFields(in)
+	if len(fields) == 0 {
+		return "binary"
+	}
+	hexDigits, allDecimal, allTwoWide := false, true, true
+	for _, f := range fields {
+		digits := strings.TrimPrefix(strings.TrimPrefix(f, "0x"), "0X")
+		if digits != f {
+			hexDigits = true
+		}
+		if digits == "" {
+			return "binary"
+		}
+		for _, r := range digits {
+			switch {
+			case r >= '0' && r <= '9':
+			case r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F':
+				hexDigits = true
+			default:
+				return "binary"
+			}
+		}
+		if n, err := strconv.Atoi(digits); err != nil || n > 255 || len(digits) > 3 {
+			allDecimal = false
+		}
+		if len(digits) != 2 {
+			allTwoWide = false
+		}
+	}
+	if hexDigits || allTwoWide || !allDecimal {
+		return "hex"
+	}
+	return "decimal"
+}
+
+func parseHex(in []byte) ([]byte, error) {
+	var digits strings.Builder
+	for _, f := range dumpFields(in) {
+		f = strings.TrimPrefix(strings.TrimPrefix(f, "0x"), "0X")
+		if len(f)%2 == 1 {
+			// A lone digit, as in "0x1", is a whole byte.
+			f = "0" + f
+		}
+		digits.WriteString(f)
+	}
+	data, err := hex.DecodeString(digits.String())
+	if err != nil {
+		return nil, fmt.Errorf("bad hex dump: %v", err)
+	}
+	return data, nil
+}
+
+func parseDecimal(in []byte) ([]byte, error) {
+	fields := dumpFields(in)
+	data := make([]byte, len(fields))
+	for i, f := range fields {
+		n, err := strconv.ParseUint(f, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad decimal dump: byte %d is %q", i, f)
+		}
+		data[i] = byte(n)
+	}
+	return data, nil
+}
+
+// describe identifies the protocol of data and decodes it.
+func describe(w io.Writer, data []byte) error {
+	switch {
+	case len(data) == 0:
+		fmt.Fprintln(w, "empty capture")
+	case isTLS(data):
+		describeTLS(w, data)
+	case isHTTP(data):
+		describeHTTP(w, data)
+	case isSPDY(data):
+		return dumpSPDY(w, data)
+	default:
+		fmt.Fprintln(w, "not SPDY, TLS or HTTP/1.x; the capture begins:")
+		fmt.Fprint(w, hex.Dump(data[:min(len(data), 64)]))
+	}
+	return nil
+}
+
+// isSPDY reports whether data begins with a SPDY control frame, as both
+// directions of a connection do.
+func isSPDY(data []byte) bool {
+	return len(data) >= 8 && data[0]&0x80 != 0 && data[0]&0x7f == 0 && data[1] >= 1 && data[1] <= 3
+}
+
+// dumpSPDY decodes data as SPDY frames.
+func dumpSPDY(w io.Writer, data []byte) error {
+	if version := data[1]; version != spdy.Version {
+		fmt.Fprintf(w, "SPDY/%d, but only SPDY/%d header blocks can be decompressed\n", version, spdy.Version)
+	}
+	r := bytes.NewReader(data)
+	hr := spdy.NewHeaderReader()
+	for r.Len() > 0 {
+		left := r.Len()
+		f, err := spdy.ReadFrame(r)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			fmt.Fprintf(w, "truncated frame: the capture ends %d bytes into it\n", left)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := spdy.DumpFrame(w, f, hr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isHTTP reports whether data begins with an HTTP/1.x request or status
+// line.
+func isHTTP(data []byte) bool {
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if bytes.HasPrefix(line, []byte("HTTP/1.")) {
+		return true
+	}
+	method, rest, ok := bytes.Cut(line, []byte(" "))
+	if !ok || len(method) == 0 {
+		return false
+	}
+	for _, c := range method {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return bytes.HasSuffix(rest, []byte(" HTTP/1.0")) || bytes.HasSuffix(rest, []byte(" HTTP/1.1"))
+}
+
+func describeHTTP(w io.Writer, data []byte) {
+	head, _, _ := bytes.Cut(data, []byte("\r\n\r\n"))
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	kind := "request"
+	if strings.HasPrefix(lines[0], "HTTP/") {
+		kind = "response"
+	}
+	fmt.Fprintf(w, "not SPDY: this is an HTTP/1.x %s\n", kind)
+	for _, line := range lines {
+		fmt.Fprintf(w, "  %s\n", line)
+	}
+}
+
+// TLS record and handshake types.
+const (
+	tlsHandshake       = 22
+	tlsClientHello     = 1
+	tlsServerHello     = 2
+	extServerName      = 0
+	extALPN            = 16
+	extNextProtoNeg    = 13172
+	tlsRecordHeaderLen = 5
+)
+
+// isTLS reports whether data begins with a TLS record header.
+func isTLS(data []byte) bool {
+	return len(data) >= tlsRecordHeaderLen && data[0] >= 20 && data[0] <= 23 && data[1] == 3 && data[2] <= 4
+}
+
+func describeTLS(w io.Writer, data []byte) {
+	fmt.Fprintf(w, "not SPDY: this is TLS (record version 3.%d)\n", data[2])
+	if data[0] != tlsHandshake || len(data) < tlsRecordHeaderLen+4 {
+		fmt.Fprintf(w, "  record type %d\n", data[0])
+		return
+	}
+	body := data[tlsRecordHeaderLen:]
+	switch body[0] {
+	case tlsClientHello:
+		fmt.Fprintln(w, "  handshake: ClientHello")
+		hello, err := parseClientHello(body[4:])
+		if err != nil {
+			fmt.Fprintf(w, "  (%v)\n", err)
+		}
+		if hello.serverName != "" {
+			fmt.Fprintf(w, "  server name: %s\n", hello.serverName)
+		}
+		if hello.alpn != nil {
+			fmt.Fprintf(w, "  ALPN protocols: %s\n", strings.Join(hello.alpn, ", "))
+		}
+		if hello.npn {
+			fmt.Fprintln(w, "  NPN: offered")
+		}
+		fmt.Fprintln(w, "The client expected TLS, as after an npn-spdy/2 Alternate-Protocol; serve this port with TLS.")
+	case tlsServerHello:
+		fmt.Fprintln(w, "  handshake: ServerHello")
+	default:
+		fmt.Fprintf(w, "  handshake type %d\n", body[0])
+	}
+}
+
+// A clientHello holds the ClientHello extensions that bear on SPDY.
+type clientHello struct {
+	serverName string
+	alpn       []string
+	npn        bool
+}
+
+var errShortHello = errors.New("ClientHello is truncated")
+
+// parseClientHello parses the body of a ClientHello handshake message.
+func parseClientHello(b []byte) (hello clientHello, err error) {
+	// client_version, random
+	if len(b) < 2+32 {
+		return hello, errShortHello
+	}
+	b = b[2+32:]
+	var ok bool
+	if _, b, ok = cutVector(b, 1); !ok { // session_id
+		return hello, errShortHello
+	}
+	if _, b, ok = cutVector(b, 2); !ok { // cipher_suites
+		return hello, errShortHello
+	}
+	if _, b, ok = cutVector(b, 1); !ok { // compression_methods
+		return hello, errShortHello
+	}
+	if len(b) == 0 {
+		return hello, nil
+	}
+	exts, _, ok := cutVector(b, 2)
+	if !ok {
+		return hello, errShortHello
+	}
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		var ext []byte
+		if ext, exts, ok = cutVector(exts[2:], 2); !ok {
+			return hello, errShortHello
+		}
+		switch typ {
+		case extServerName:
+			// server_name_list of (name_type, host_name)
+			list, _, _ := cutVector(ext, 2)
+			if len(list) >= 3 && list[0] == 0 {
+				name, _, _ := cutVector(list[1:], 2)
+				hello.serverName = string(name)
+			}
+		case extALPN:
+			list, _, _ := cutVector(ext, 2)
+			hello.alpn = []string{}
+			for len(list) > 0 {
+				var proto []byte
+				if proto, list, ok = cutVector(list, 1); !ok {
+					break
+				}
+				hello.alpn = append(hello.alpn, string(proto))
+			}
+		case extNextProtoNeg:
+			hello.npn = true
+		}
+	}
+	return hello, nil
+}
+
+// cutVector splits a TLS vector with an n-byte length prefix off b.
+func cutVector(b []byte, n int) (vec, rest []byte, ok bool) {
+	if len(b) < n {
+		return nil, nil, false
+	}
+	length := 0
+	for _, c := range b[:n] {
+		length = length<<8 | int(c)
+	}
+	if len(b) < n+length {
+		return nil, nil, false
+	}
+	return b[n : n+length], b[n+length:], true
+}
@@ -0,0 +1,190 @@
+// cmd/spdydump/spdydump_test.go
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cs490/spdy"
+)
+
+// chromeHello is the capture in the project paper: Chrome's first bytes on
+// the plain SPDY port.
+const chromeHello = `22 3 1 0 187 1 0 0 183 3 1 79 158 55 41 236 251 239 175 54
+10 33 177 186 51 133 155 57 104 21 55 87 67 249 137 40 251
+7 21 162 250 197 248 0 0 72 192 10 192 20 0 136 0 135 0 57
+0 56 192 15 192 5 0 132 0 53 192 7 192 9 192 17 192 19 0
+69 0 68 0 102 0 51 0 50 192 12 192 14 192 2 192 4 0 150 0
+65 0 4 0 5 0 47 192 8 192 18 0 22 0 19 192 13 192 3 254
+255 0 10 2 1 0 0 69 0 0 0 25 0 23 0 0 20 118 101 108 108
+101 105 116 121 46 109 99 46 121 97 108 101 46 101 100
+117 255 1 0 1 0 0 10 0 8 0 6 0 23 0 24 0 25 0 11 0 2 1 0
+0 35 0 0 51 116 0 0 0 5 0 5 1 0 0 0 0
+`
+
+// dump runs spdydump on input and returns its output.
+func dump(t *testing.T, input string, args ...string) string {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	if status := run(args, strings.NewReader(input), &stdout, &stderr); status != 0 {
+		t.Fatalf("spdydump %q: exit status %d; stderr:\n%s", args, status, &stderr)
+	}
+	return stdout.String()
+}
+
+func expectLines(t *testing.T, out string, want ...string) {
+	t.Helper()
+	for _, line := range want {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("output lacks %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestChromeClientHello(t *testing.T) {
+	out := dump(t, chromeHello)
+	expectLines(t, out,
+		"192 bytes (decimal)",
+		"not SPDY: this is TLS (record version 3.1)",
+		"  handshake: ClientHello",
+		"  server name: velleity.mc.yale.edu",
+		"  NPN: offered",
+	)
+}
+
+// capture returns the bytes a client sends for a GET of url.
+func capture(url string) []byte {
+	hw := spdy.NewHeaderWriter(-1)
+	data := []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	data = append(data, hw.Encode(http.Header{"Method": {"GET"}, "Url": {url}, "Version": {"HTTP/1.1"}})...)
+	buf := new(bytes.Buffer)
+	spdy.SettingsFrame(0, spdy.Settings{{Id: spdy.SettingsInitialWindowSize, Value: 1 << 16}}).WriteTo(buf)
+	spdy.ControlFrame(spdy.TypeSynStream, spdy.FlagFin, data).WriteTo(buf)
+	return buf.Bytes()
+}
+
+func TestSPDYCapture(t *testing.T) {
+	raw := capture("/index.html")
+	var decimal []string
+	for _, b := range raw {
+		decimal = append(decimal, fmt.Sprint(b))
+	}
+	for format, input := range map[string]string{
+		"binary":  string(raw),
+		"hex":     spacedHex(raw),
+		"decimal": strings.Join(decimal, " "),
+	} {
+		out := dump(t, input)
+		expectLines(t, out,
+			fmt.Sprintf("%d bytes (%s)", len(raw), format),
+			"SETTINGS version=2 flags=0x0 length=12",
+			"  INITIAL_WINDOW_SIZE=65536",
+			"  stream=1 assoc=0 priority=0",
+			"  url: /index.html",
+		)
+	}
+	// A capture cut off mid-frame says so.
+	out := dump(t, string(raw[:len(raw)-3]))
+	expectLines(t, out, fmt.Sprintf("truncated frame: the capture ends %d bytes into it", len(raw)-3-20))
+}
+
+func TestCorruptHeaderBlock(t *testing.T) {
+	block := spdy.NewHeaderWriter(-1).Encode(http.Header{"Method": {"GET"}, "Url": {"/index.html"}, "Version": {"HTTP/1.1"}})
+	corrupt := append([]byte(nil), block...)
+	// Past the zlib header and dictionary ID.
+	for i := 6; i < len(corrupt); i++ {
+		corrupt[i] ^= 0x55
+	}
+	for desc, block := range map[string][]byte{
+		"truncated": block[:len(block)-8],
+		"corrupt":   corrupt,
+	} {
+		buf := new(bytes.Buffer)
+		data := append([]byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0}, block...)
+		spdy.ControlFrame(spdy.TypeSynStream, spdy.FlagFin, data).WriteTo(buf)
+		done := make(chan struct{})
+		var stdout, stderr bytes.Buffer
+		var status int
+		go func() {
+			status = run(nil, buf, &stdout, &stderr)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: spdydump hangs on the header block", desc)
+		}
+		if status != 1 {
+			t.Errorf("%s: exit status %d, want 1", desc, status)
+		}
+		expectLines(t, stdout.String(), "  stream=1 assoc=0 priority=0")
+		if !strings.Contains(stdout.String(), "(header block: spdy: malformed header block") || !strings.Contains(stderr.String(), "malformed header block") {
+			t.Errorf("%s: header block error not reported; stdout:\n%s\nstderr:\n%s", desc, &stdout, &stderr)
+		}
+	}
+}
+
+func spacedHex(b []byte) string {
+	var fields []string
+	for _, c := range b {
+		fields = append(fields, fmt.Sprintf("%02x", c))
+	}
+	return strings.Join(fields, " ")
+}
+
+func TestOtherProtocols(t *testing.T) {
+	expectLines(t, dump(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		"not SPDY: this is an HTTP/1.x request",
+		"  Host: example.com",
+	)
+	expectLines(t, dump(t, "HTTP/1.1 200 OK\r\n\r\nbody"), "not SPDY: this is an HTTP/1.x response")
+	expectLines(t, dump(t, "SSH-2.0-OpenSSH_9.0\r\n"), "not SPDY, TLS or HTTP/1.x; the capture begins:")
+}
+
+func TestFormats(t *testing.T) {
+	for _, tc := range []struct {
+		in, format string
+		want       []byte
+	}{
+		{"22 3 1 0 187", "decimal", []byte{22, 3, 1, 0, 187}},
+		{"16 03 01 00 bb", "hex", []byte{0x16, 3, 1, 0, 0xbb}},
+		{"0x16,0x3,0x1", "hex", []byte{0x16, 3, 1}},
+		{"160301", "hex", []byte{0x16, 3, 1}},
+		{"16 03 01", "hex", []byte{0x16, 3, 1}},
+		{"\x80\x02\x00\x04", "binary", []byte{0x80, 2, 0, 4}},
+	} {
+		got, format, err := decodeInput([]byte(tc.in), "auto")
+		if err != nil || format != tc.format || !bytes.Equal(got, tc.want) {
+			t.Errorf("decodeInput(%q) = %v, %s, %v; want %v, %s", tc.in, got, format, err, tc.want, tc.format)
+		}
+	}
+	// The format can be forced.
+	if got, _, _ := decodeInput([]byte("22 3 1"), "hex"); !bytes.Equal(got, []byte{0x22, 3, 1}) {
+		t.Errorf("decodeInput(\"22 3 1\", hex) = %v", got)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	client := filepath.Join(dir, "client")
+	os.WriteFile(client, capture("/a"), 0o666)
+	hello := filepath.Join(dir, "hello.txt")
+	os.WriteFile(hello, []byte(chromeHello), 0o666)
+	out := dump(t, "", client, hello)
+	expectLines(t, out, "==> "+client, "  url: /a", "==> "+hello, "  handshake: ClientHello")
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{filepath.Join(dir, "missing")}, nil, &stdout, &stderr); status != 1 {
+		t.Errorf("missing file: exit status %d, want 1", status)
+	}
+	if status := run([]string{"-format", "octal"}, nil, &stdout, &stderr); status != 2 {
+		t.Errorf("-format octal: exit status %d, want 2", status)
+	}
+}
@@ -4,6 +4,8 @@ import (
   "net/http" //package for http based web programs
   "fmt"
   "cs490/spdy"
+  "crypto/tls"
+  "flag"
   "html"
   "log"
 )
@@ -22,30 +24,37 @@ func main() {
 */
 
 
-type SpdyAlternate struct {
-  http.Handler
-  Addr string
-}
-
-func (alt SpdyAlternate) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-  w.Header().Set("Alternate-Protocol", alt.Addr)
-  alt.Handler.ServeHTTP(w, req)
-}
+var (
+  certFile = flag.String("cert", "", "TLS certificate `file` for the SPDY server")
+  keyFile  = flag.String("key", "", "TLS key `file` for the SPDY server")
+)
 
 func main() {
-  var _ = new(spdy.Server)
+  flag.Parse()
+  // Browsers only follow an npn-spdy/2 Alternate-Protocol, which the
+  // Advertiser sends only when the SPDY server can accept TLS, so give
+  // -cert and -key to try this from a browser.  Without them the server
+  // speaks plain SPDY and advertises spdy/2, which only spdy.AltTransport
+  // uses.
+  srv := &spdy.Server{Addr: "0.0.0.0:5555"}
+  if *certFile != "" || *keyFile != "" {
+    cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+    if err != nil {
+      log.Fatal(err)
+    }
+    srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+  }
   fmt.Println("hello")
   // add handlers...
-  go spdy.ListenAndServe("0.0.0.0:5555", nil)
+  go srv.ListenAndServe()
 
   http.HandleFunc("/bar", func(w http.ResponseWriter, r *http.Request) {
       fmt.Println("hello...")
       fmt.Fprintf(w, "Hello, %q", html.EscapeString(r.URL.Path))
     })
-    log.Fatal(http.ListenAndServe("0.0.0.0:8000", SpdyAlternate{http.DefaultServeMux, "5555:npn-spdy/2"}))
+    log.Fatal(http.ListenAndServe("0.0.0.0:8000", &spdy.Advertiser{Handler: http.DefaultServeMux, Server: srv}))
   // http.HandleFunc("/", handler) // redirect all urls to the handler function
   // http.ListenAndServe("0.0.0.0:8000", nil) // listen for connections at port 9999 on the local machine
   // spdy.ListenAndServe("0.0.0.0:8081", nil)
-  // http.ListenAndServe("0.0.0.0:8080", SpdyAlternate{http.DefaultServeMux, "8081:npn-spdy/2"} )
   fmt.Println("hello")
 }
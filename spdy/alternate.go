@@ -0,0 +1,98 @@
+// spdy/alternate.go
+
+package spdy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultAltSvcMaxAge is the Alt-Svc max-age used when Advertiser.MaxAge is
+// zero.
+const DefaultAltSvcMaxAge = 24 * time.Hour
+
+// An Advertiser wraps an HTTP/1.x handler and tells clients that Server
+// serves the same site over SPDY.  Each response gets an
+// Alternate-Protocol header naming the port Server listens on, and, if
+// AltSvc is set, an Alt-Svc header as well.  Requests that already arrived
+// over SPDY are passed through untouched, so one Advertiser can wrap the
+// handler of both servers.
+//
+// The header follows what Server can accept.  If Server.TLSConfig is set,
+// the alternate is npn-spdy/2, SPDY negotiated over TLS, which is what
+// browsers understand.  Otherwise it is spdy/2 over plain TCP, which only
+// this package's clients understand, and no Alt-Svc header is sent, since
+// Alt-Svc alternates always use TLS.
+type Advertiser struct {
+	Handler http.Handler
+	Server  *Server
+
+	// AltSvc adds an Alt-Svc header with a max-age of MaxAge, or of
+	// DefaultAltSvcMaxAge if MaxAge is zero.
+	AltSvc bool
+	MaxAge time.Duration
+}
+
+func (a *Advertiser) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !IsSPDY(req) {
+		if port := a.Server.port(); port != 0 {
+			secure := a.Server.TLSConfig != nil
+			w.Header().Set("Alternate-Protocol", alternateProtocol(port, secure))
+			if a.AltSvc && secure {
+				w.Header().Set("Alt-Svc", altSvc(port, a.maxAge()))
+			}
+		}
+	}
+	a.Handler.ServeHTTP(w, req)
+}
+
+func (a *Advertiser) maxAge() time.Duration {
+	if a.MaxAge > 0 {
+		return a.MaxAge
+	}
+	return DefaultAltSvcMaxAge
+}
+
+// alternateProtocol returns the Alternate-Protocol value for SPDY on port.
+func alternateProtocol(port int, secure bool) string {
+	if secure {
+		return fmt.Sprintf("%d:npn-%s", port, NextProtoSPDY2)
+	}
+	return fmt.Sprintf("%d:%s", port, NextProtoSPDY2)
+}
+
+// altSvc returns the Alt-Svc value for SPDY over TLS on port.  The
+// protocol ID is the percent-encoded ALPN name.
+func altSvc(port int, maxAge time.Duration) string {
+	return fmt.Sprintf(`spdy%%2F%d=":%d"; ma=%d`, Version, port, int64(maxAge/time.Second))
+}
+
+// port returns the port srv listens on: the lowest of its listeners', or,
+// before it listens, the port in Addr.  It returns 0 if neither is known.
+func (srv *Server) port() int {
+	srv.mu.Lock()
+	lowest := 0
+	for l := range srv.listeners {
+		if port := addrPort(l.Addr().String()); port != 0 && (lowest == 0 || port < lowest) {
+			lowest = port
+		}
+	}
+	srv.mu.Unlock()
+	if lowest == 0 {
+		lowest = addrPort(srv.Addr)
+	}
+	return lowest
+}
+
+// addrPort returns the numeric port of a host:port address, or 0.
+func addrPort(addr string) int {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	port, _ := strconv.Atoi(p)
+	return port
+}
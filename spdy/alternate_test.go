@@ -0,0 +1,75 @@
+// spdy/alternate_test.go
+
+package spdy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAdvertiser(t *testing.T) {
+	srv := new(Server)
+	hello := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	adv := &Advertiser{Handler: hello, Server: srv, AltSvc: true}
+
+	// Before the server listens or has an address there is nothing to
+	// advertise.
+	w := httptest.NewRecorder()
+	adv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if h := w.Header().Get("Alternate-Protocol"); h != "" {
+		t.Errorf("Alternate-Protocol before listening = %q, want none", h)
+	}
+
+	srv.Addr = ":5555"
+	w = httptest.NewRecorder()
+	adv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if h := w.Header().Get("Alternate-Protocol"); h != "5555:spdy/2" {
+		t.Errorf("Alternate-Protocol from Addr = %q, want %q", h, "5555:spdy/2")
+	}
+	if h := w.Header().Get("Alt-Svc"); h != "" {
+		t.Errorf("Alt-Svc without TLS = %q, want none", h)
+	}
+	if w.Body.String() != "hello" {
+		t.Errorf("body = %q, want %q", w.Body, "hello")
+	}
+
+	// The listening address wins over Addr.
+	srv.Handler = adv
+	srv.TLSConfig = new(tls.Config)
+	adv.MaxAge = time.Hour
+	addr := listen(t, srv, nil)
+	port, _ := strconv.Atoi(addr[len("127.0.0.1:"):])
+	waitFor(t, "the server to listen", func() bool { return srv.port() == port })
+	w = httptest.NewRecorder()
+	adv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if h, want := w.Header().Get("Alternate-Protocol"), fmt.Sprintf("%d:npn-spdy/2", port); h != want {
+		t.Errorf("Alternate-Protocol = %q, want %q", h, want)
+	}
+	if h, want := w.Header().Get("Alt-Svc"), fmt.Sprintf(`spdy%%2F2=":%d"; ma=3600`, port); h != want {
+		t.Errorf("Alt-Svc = %q, want %q", h, want)
+	}
+
+	// Requests over SPDY are not told about SPDY; those over HTTP/1.1 to
+	// the same listener are.
+	tr := new(Transport)
+	defer tr.CloseIdleConnections()
+	for _, rt := range []http.RoundTripper{tr, http.DefaultTransport} {
+		resp, err := (&http.Client{Transport: rt, Timeout: 5 * time.Second}).Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		h := resp.Header.Get("Alternate-Protocol")
+		if spdy := rt == tr; spdy != (h == "") {
+			t.Errorf("over SPDY %v: Alternate-Protocol = %q", spdy, h)
+		}
+	}
+}
@@ -3,84 +3,244 @@
 package spdy
 
 import (
-	"bytes"
+	"errors"
 	"io"
-        "syscall"
+	"os"
 	"sync"
+	"time"
 )
 
-// An asyncPipe is similar to *io.Pipe, but writes never block: they are sent to a buffer, where a reader will block until it has some data in the buffer.
-// The write side can close with an error, but the read side cannot.
+// errPipeFull is returned by writes that would take a non-blocking
+// asyncPipe past its capacity.
+var errPipeFull = errors.New("spdy: pipe buffer full")
+
+// An asyncPipe is similar to *io.Pipe, but writes go to a buffer, and a
+// reader blocks only until the buffer has some data.  Unlike io.Pipe a
+// write does not wait for a reader, so the session can hand DATA frames to a
+// handler without stalling its read loop.
+//
+// The buffer is a queue of the slices passed to write, which the pipe
+// adopts rather than copies: a DATA frame's payload goes to the handler
+// without being copied in between, and the buffer never has to grow and
+// move its contents.  Callers must not modify a slice after writing it.
+//
+// A pipe with a capacity holds at most that many unread bytes.  A write
+// that would exceed it fails with errPipeFull, or, if the pipe blocks,
+// waits until the reader has made room.  The session read loops write
+// without blocking, since one slow handler must not stall the others.
+//
+// Either side can close the pipe.  After wclose, reads drain the buffer and
+// then return the writer's error.  After rclose, the buffer is discarded,
+// reads return the writer's error or io.ErrClosedPipe, and writes fail with
+// io.ErrClosedPipe.
 type asyncPipe struct {
-	rl      sync.Mutex   // gates readers one at a time
-	wl      sync.Mutex   // gates writers one at a time
-	l       sync.Mutex   // protects remaining fields
-	data    bytes.Buffer // data remaining
-	rwait   sync.Cond    // waiting reader
-	rclosed bool         // if reader closed, break pipe
-	werr    error // if writer closed, error to give reads
+	capacity int  // if positive, the most bytes buffered
+	block    bool // writers wait for room rather than fail
+
+	mu       sync.Mutex
+	cond     sync.Cond // signalled on every change below
+	chunks   [][]byte  // unread data is chunks[head:]
+	head     int
+	size     int   // bytes in chunks[head:]
+	werr     error // set by wclose; returned to readers once data is drained
+	rclosed  bool
+	deadline time.Time   // zero for none
+	timer    *time.Timer // wakes readers at the deadline
+}
+
+// apipe returns an unbounded pipe.
+func apipe() *asyncPipe {
+	return newAsyncPipe(0, false)
 }
 
+// newAsyncPipe returns a pipe holding at most capacity unread bytes, or any
+// amount if capacity is zero.  If block is set, writers wait for room
+// instead of failing with errPipeFull.
+func newAsyncPipe(capacity int, block bool) *asyncPipe {
+	p := &asyncPipe{capacity: capacity, block: block}
+	p.cond.L = &p.mu
+	return p
+}
+
+// read reads buffered data, blocking until some is available, the writer
+// closes, the reader closes, or the read deadline passes.
 func (p *asyncPipe) read(b []byte) (n int, err error) {
-	// One reader at a time.
-	p.rl.Lock()
-	defer p.rl.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if err = p.wait(); err != nil {
+		return 0, err
+	}
+	for n < len(b) && p.size > 0 {
+		c := p.chunks[p.head]
+		k := copy(b[n:], c)
+		n += k
+		p.size -= k
+		if k < len(c) {
+			p.chunks[p.head] = c[k:]
+		} else {
+			p.pop()
+		}
+	}
+	p.cond.Broadcast()
+	return n, nil
+}
+
+// next is like read but returns the next written slice, or what is left of
+// it, without copying.
+func (p *asyncPipe) next() (b []byte, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err = p.wait(); err != nil {
+		return nil, err
+	}
+	b = p.chunks[p.head]
+	p.pop()
+	p.size -= len(b)
+	p.cond.Broadcast()
+	return b, nil
+}
 
-	p.l.Lock()
-	defer p.l.Unlock()
+// wait blocks until there is data to read or reading must fail.  p.mu must
+// be held.
+func (p *asyncPipe) wait() error {
 	for {
 		if p.rclosed {
-			return 0, syscall.EINVAL
+			// A writer's error, such as a stream reset, explains the
+			// closing better.
+			if p.werr != nil {
+				return p.werr
+			}
+			return io.ErrClosedPipe
 		}
-		if p.data.Len() > 0 {
-			break
+		if p.size > 0 {
+			return nil
 		}
 		if p.werr != nil {
-			return 0, p.werr
+			return p.werr
+		}
+		if !p.deadline.IsZero() && !time.Now().Before(p.deadline) {
+			return os.ErrDeadlineExceeded
 		}
-		p.rwait.Wait()
+		p.cond.Wait()
+	}
+}
+
+// pop drops the head chunk.  The queue is reset once it empties and
+// compacted once it is mostly consumed, so it stays small without being
+// reallocated.  p.mu must be held.
+func (p *asyncPipe) pop() {
+	p.chunks[p.head] = nil
+	p.head++
+	switch {
+	case p.head == len(p.chunks):
+		p.chunks = p.chunks[:0]
+		p.head = 0
+	case p.head >= 16 && 2*p.head >= len(p.chunks):
+		n := copy(p.chunks, p.chunks[p.head:])
+		clear(p.chunks[n:])
+		p.chunks = p.chunks[:n]
+		p.head = 0
 	}
-	return p.data.Read(b)
 }
 
+// write buffers b in full or not at all.  A blocking pipe waits until the
+// whole of b fits; b may not be larger than the capacity.  The pipe keeps
+// b itself, not a copy.
 func (p *asyncPipe) write(b []byte) (n int, err error) {
-	// One writer at a time.
-	p.wl.Lock()
-	defer p.wl.Unlock()
-
-	p.l.Lock()
-	defer p.l.Unlock()
-	p.data.Write(b)
-	p.rwait.Signal()
-	if p.rclosed {
-		err = syscall.EPIPE
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.rclosed || p.werr != nil {
+			return 0, io.ErrClosedPipe
+		}
+		if p.capacity <= 0 || p.size+len(b) <= p.capacity {
+			break
+		}
+		if !p.block || len(b) > p.capacity {
+			return 0, errPipeFull
+		}
+		p.cond.Wait()
 	}
-	if p.werr != nil {
-		err = syscall.EINVAL
+	if len(b) > 0 {
+		p.chunks = append(p.chunks, b)
+		p.size += len(b)
+		p.cond.Broadcast()
 	}
-	n = len(b)
-	return
+	return len(b), nil
 }
 
-func (p *asyncPipe) rclose() {
-	p.l.Lock()
-	defer p.l.Unlock()
-	p.rclosed = true
-	p.rwait.Signal()
+// writeAll writes all of b.  A blocking pipe takes data larger than its
+// capacity in pieces, waiting for the reader between them.
+func (p *asyncPipe) writeAll(b []byte) error {
+	for len(b) > 0 {
+		n := len(b)
+		if p.block && p.capacity > 0 {
+			n = min(n, p.capacity)
+		}
+		if _, err := p.write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
 }
 
+// wclose closes the writing side.  Readers get err, or io.EOF if err is
+// nil, once they have drained the buffer.  Only the first call has an
+// effect.
 func (p *asyncPipe) wclose(err error) {
 	if err == nil {
 		err = io.EOF
 	}
-	p.l.Lock()
-	defer p.l.Unlock()
-	p.werr = err
-	p.rwait.Signal()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.werr == nil {
+		p.werr = err
+	}
+	p.cond.Broadcast()
 }
 
-func apipe() *asyncPipe {
-	p := new(asyncPipe)
-	p.rwait.L = &p.l
-	return p
+// rclose closes the reading side and discards the buffer.  It reports
+// whether the writer had not finished, that is, whether data was still
+// expected.
+func (p *asyncPipe) rclose() (unfinished bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	unfinished = p.werr == nil
+	p.rclosed = true
+	clear(p.chunks)
+	p.chunks, p.head, p.size = nil, 0, 0
+	p.stopTimer()
+	p.cond.Broadcast()
+	return unfinished
+}
+
+// setReadDeadline makes pending and later reads fail with
+// os.ErrDeadlineExceeded once t has passed.  A zero t means no deadline.
+func (p *asyncPipe) setReadDeadline(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = t
+	p.stopTimer()
+	if !t.IsZero() {
+		if d := time.Until(t); d > 0 {
+			p.timer = time.AfterFunc(d, func() {
+				p.mu.Lock()
+				p.cond.Broadcast()
+				p.mu.Unlock()
+			})
+		}
+	}
+	p.cond.Broadcast()
+}
+
+// stopTimer stops the deadline timer.  p.mu must be held.
+func (p *asyncPipe) stopTimer() {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
 }
@@ -0,0 +1,407 @@
+// spdy/apipe_test.go
+
+package spdy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAsyncPipeCapacity(t *testing.T) {
+	p := newAsyncPipe(10, false)
+	if _, err := p.write(make([]byte, 8)); err != nil {
+		t.Fatalf("write within capacity: %v", err)
+	}
+	if _, err := p.write(make([]byte, 3)); err != errPipeFull {
+		t.Fatalf("write past capacity = %v, want %v", err, errPipeFull)
+	}
+	// A failed write buffers nothing.
+	b := make([]byte, 20)
+	if n, err := p.read(b); n != 8 || err != nil {
+		t.Fatalf("read = %d, %v; want 8, nil", n, err)
+	}
+	if _, err := p.write(make([]byte, 10)); err != nil {
+		t.Fatalf("write after read: %v", err)
+	}
+}
+
+func TestAsyncPipeBlockingWrite(t *testing.T) {
+	p := newAsyncPipe(4, true)
+	p.write([]byte("abcd"))
+	done := make(chan error)
+	go func() {
+		_, err := p.write([]byte("ef"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("write to a full pipe returned %v without blocking", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	b := make([]byte, 3)
+	p.read(b)
+	if err := <-done; err != nil {
+		t.Fatalf("blocked write: %v", err)
+	}
+	if _, err := p.write(make([]byte, 5)); err != errPipeFull {
+		t.Errorf("write larger than the capacity = %v, want %v", err, errPipeFull)
+	}
+
+	// Closing the reader releases a blocked writer.
+	go func() {
+		_, err := p.write([]byte("ghij"))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.rclose()
+	if err := <-done; err != io.ErrClosedPipe {
+		t.Errorf("write blocked across rclose = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestAsyncPipeClose(t *testing.T) {
+	p := apipe()
+	p.write([]byte("data"))
+	p.wclose(nil)
+	if _, err := p.write([]byte("more")); err != io.ErrClosedPipe {
+		t.Errorf("write after wclose = %v, want %v", err, io.ErrClosedPipe)
+	}
+	if b, err := io.ReadAll(readerFunc(p.read)); string(b) != "data" || err != nil {
+		t.Errorf("ReadAll = %q, %v; want %q, nil", b, err, "data")
+	}
+	if p.rclose() {
+		t.Error("rclose after the writer finished reported an unfinished body")
+	}
+
+	p = apipe()
+	p.write([]byte("data"))
+	if !p.rclose() {
+		t.Error("rclose before the writer finished reported a finished body")
+	}
+	if _, err := p.read(make([]byte, 4)); err != io.ErrClosedPipe {
+		t.Errorf("read after rclose = %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	// The first writer error sticks, and explains reads after rclose.
+	p = apipe()
+	p.wclose(errStreamReset)
+	p.wclose(io.EOF)
+	p.rclose()
+	if _, err := p.read(make([]byte, 4)); err != errStreamReset {
+		t.Errorf("read after reset = %v, want %v", err, errStreamReset)
+	}
+}
+
+func TestAsyncPipeReadDeadline(t *testing.T) {
+	p := apipe()
+	p.setReadDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	_, err := p.read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if d := time.Since(start); d < 15*time.Millisecond {
+		t.Errorf("read returned after %v, before the deadline", d)
+	}
+
+	// Buffered data is still returned, and clearing the deadline lets
+	// reads wait again.
+	p.write([]byte("x"))
+	if n, err := p.read(make([]byte, 1)); n != 1 || err != nil {
+		t.Errorf("read of buffered data past the deadline = %d, %v", n, err)
+	}
+	p.setReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.write([]byte("y"))
+	}()
+	if n, err := p.read(make([]byte, 1)); n != 1 || err != nil {
+		t.Errorf("read without a deadline = %d, %v", n, err)
+	}
+
+	// Moving the deadline into the past wakes a blocked reader.
+	errc := make(chan error)
+	go func() {
+		_, err := p.read(make([]byte, 1))
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.setReadDeadline(time.Now().Add(-time.Second))
+	if err := <-errc; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read after the deadline moved = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+// readerFunc adapts a read method to io.Reader.
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) { return f(b) }
+
+// TestAsyncPipeStress runs writers, a reader, deadline changes and closes
+// concurrently; run it with -race.
+func TestAsyncPipeStress(t *testing.T) {
+	for _, block := range []bool{false, true} {
+		p := newAsyncPipe(64, block)
+		const writers, chunks = 4, 200
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		written := 0
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				chunk := bytes.Repeat([]byte{byte('a' + w)}, 1+w)
+				for i := 0; i < chunks; i++ {
+					n, err := p.write(chunk)
+					if err == errPipeFull {
+						time.Sleep(time.Microsecond)
+						i--
+						continue
+					}
+					if err != nil {
+						t.Errorf("write: %v", err)
+						return
+					}
+					mu.Lock()
+					written += n
+					mu.Unlock()
+				}
+			}(w)
+		}
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				p.setReadDeadline(time.Now().Add(time.Millisecond))
+				p.setReadDeadline(time.Time{})
+			}
+		}()
+		go func() {
+			wg.Wait()
+			p.wclose(nil)
+		}()
+
+		read := 0
+		b := make([]byte, 7)
+		for {
+			n, err := p.read(b)
+			read += n
+			if err == io.EOF {
+				break
+			}
+			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("read: %v", err)
+			}
+		}
+		close(stop)
+		if want := chunks * (1 + 2 + 3 + 4); read != want || written != want {
+			t.Errorf("block=%v: read %d and wrote %d bytes, want %d", block, read, written, want)
+		}
+	}
+}
+
+// TestAsyncPipeStressClose closes the reader while writers and a reader are
+// busy; nothing may hang or race.
+func TestAsyncPipeStressClose(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		p := newAsyncPipe(16, i%2 == 0)
+		var wg sync.WaitGroup
+		for w := 0; w < 3; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if _, err := p.write([]byte("abcd")); err == io.ErrClosedPipe {
+						return
+					}
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := make([]byte, 5)
+			for {
+				if _, err := p.read(b); err != nil {
+					return
+				}
+			}
+		}()
+		time.Sleep(time.Duration(i%5) * 100 * time.Microsecond)
+		p.rclose()
+		wg.Wait()
+	}
+}
+
+func TestAsyncPipeAdoptsSlices(t *testing.T) {
+	p := apipe()
+	a, b := []byte("hello, "), []byte("world")
+	p.write(a)
+	p.write(b)
+	// next returns the written slices themselves.
+	if got, _ := p.next(); &got[0] != &a[0] {
+		t.Errorf("next returned a copy of the first slice")
+	}
+	buf := make([]byte, 3)
+	p.read(buf)
+	if got, _ := p.next(); string(got) != "ld" || &got[0] != &b[3] {
+		t.Errorf("next after a partial read = %q, want the rest of the second slice", got)
+	}
+}
+
+func TestAsyncPipeManyChunks(t *testing.T) {
+	// Enough chunks to make the queue compact while partly consumed.
+	p := apipe()
+	var want bytes.Buffer
+	for i := 0; i < 100; i++ {
+		chunk := bytes.Repeat([]byte{byte(i)}, i%7+1)
+		want.Write(chunk)
+		p.write(chunk)
+		if i%3 == 0 {
+			b := make([]byte, 5)
+			n, _ := p.read(b)
+			if !bytes.Equal(b[:n], want.Next(n)) {
+				t.Fatalf("read %d: wrong data", i)
+			}
+		}
+	}
+	p.wclose(nil)
+	got, _ := io.ReadAll(readerFunc(p.read))
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("remaining data differs: got %d bytes, want %d", len(got), want.Len())
+	}
+}
+
+// bufferPipe is the asyncPipe as it was before the chunk queue: one
+// bytes.Buffer that every write copies into.  It is kept for the
+// benchmarks.
+type bufferPipe struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	data bytes.Buffer
+	werr error
+}
+
+func newBufferPipe() *bufferPipe {
+	p := new(bufferPipe)
+	p.cond.L = &p.mu
+	return p
+}
+
+func (p *bufferPipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.data.Len() == 0 {
+		if p.werr != nil {
+			return 0, p.werr
+		}
+		p.cond.Wait()
+	}
+	return p.data.Read(b)
+}
+
+func (p *bufferPipe) write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.data.Write(b)
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+func (p *bufferPipe) wclose(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.werr = err
+	p.cond.Broadcast()
+}
+
+// benchPipe is the part of a pipe the benchmarks use.
+type benchPipe interface {
+	read([]byte) (int, error)
+	write([]byte) (int, error)
+	wclose(error)
+}
+
+// benchmarkPipe streams b.N DATA-frame-sized payloads from writers
+// goroutines through a pipe to one reader.  Each payload is freshly
+// allocated, as ReadFrame does.
+func benchmarkPipe(b *testing.B, p benchPipe, writers, frameSize int) {
+	b.SetBytes(int64(frameSize))
+	b.ReportAllocs()
+	var wg sync.WaitGroup
+	per := b.N / writers
+	for w := 0; w < writers; w++ {
+		n := per
+		if w == 0 {
+			n += b.N % writers
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				p.write(make([]byte, frameSize))
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		p.wclose(io.EOF)
+	}()
+	buf := make([]byte, 32<<10)
+	for {
+		if _, err := p.read(buf); err != nil {
+			break
+		}
+	}
+}
+
+func BenchmarkPipe(b *testing.B) {
+	for _, bc := range []struct {
+		name      string
+		writers   int
+		frameSize int
+	}{
+		{"1writer/1KB", 1, 1 << 10},
+		{"1writer/8KB", 1, 8 << 10},
+		{"4writers/8KB", 4, 8 << 10},
+		{"16writers/16KB", 16, 16 << 10},
+	} {
+		b.Run("chunks/"+bc.name, func(b *testing.B) {
+			benchmarkPipe(b, apipe(), bc.writers, bc.frameSize)
+		})
+		b.Run("buffer/"+bc.name, func(b *testing.B) {
+			benchmarkPipe(b, newBufferPipe(), bc.writers, bc.frameSize)
+		})
+	}
+}
+
+// BenchmarkPipeWriteTo measures the copy-free path io.Copy takes through
+// requestBody.WriteTo.
+func BenchmarkPipeWriteTo(b *testing.B) {
+	const frameSize = 8 << 10
+	b.SetBytes(frameSize)
+	b.ReportAllocs()
+	p := apipe()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			p.write(make([]byte, frameSize))
+		}
+		p.wclose(nil)
+	}()
+	for {
+		chunk, err := p.next()
+		if err != nil {
+			break
+		}
+		io.Discard.Write(chunk)
+	}
+}
@@ -0,0 +1,881 @@
+// spdy/client.go
+
+package spdy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A StreamError is returned when the server resets a stream with
+// RST_STREAM.
+type StreamError struct {
+	StreamID uint32
+	Status   RstStreamStatus
+}
+
+func (e StreamError) Error() string {
+	return "spdy: stream " + strconv.FormatUint(uint64(e.StreamID), 10) + " reset by server: " + e.Status.String()
+}
+
+// errResponseBuffer is returned by reads of a response body that
+// overflowed Transport.MaxStreamBufferBytes.
+var errResponseBuffer = errors.New("spdy: response body exceeded the stream buffer")
+
+// A clientSession is the client end of a SPDY connection.  Requests are
+// sent as streams and multiplexed by a frameScheduler; a read loop routes
+// the server's frames to them.
+type clientSession struct {
+	t    *Transport
+	pool *originPool
+	c    net.Conn
+	r    *bufio.Reader
+	out  *frameScheduler
+	hr   *HeaderReader
+
+	// version is the SPDY protocol version.  SPDY/3.1 adds a session
+	// window, which sendWindow and recvUnacked track.
+	version int
+
+	mu           sync.Mutex
+	cond         sync.Cond                // signalled when a send window grows or the session ends
+	streams      map[uint32]*clientStream // requests, with odd IDs
+	pushes       map[uint32]*clientStream // pushed streams, with even IDs
+	nextID       uint32                   // client streams have odd IDs
+	reserved     int                      // streams promised to requests but not yet opened
+	goingAway    bool                     // GOAWAY received; no new streams
+	err          error                    // set once the session is closed
+	peerSettings Settings
+	idleTimer    *time.Timer // nil without Transport.IdleTimeout
+
+	// initialWindow is the send window for each stream announced by the
+	// server's SETTINGS_INITIAL_WINDOW_SIZE, or zero while the server has
+	// not asked for flow control.  This holds for SPDY/3 too, although it
+	// has a default window: servers that never announce one, such as
+	// those built on spdystream, never send WINDOW_UPDATEs either.
+	initialWindow int
+
+	// sendWindow is the session's SPDY/3.1 send window, used while
+	// initialWindow is set.  recvUnacked counts the DATA bytes received
+	// but not yet returned to the server's session window; only the read
+	// loop uses it.
+	sendWindow  int
+	recvUnacked int
+
+	// recvWindow is the stream window announced to SPDY/3 servers: the
+	// response body buffer.
+	recvWindow int
+
+	// heard is set once the first frame from the server has been handled.
+	// A server sends its SETTINGS first, so until then request bodies wait
+	// in case it asks for flow control, and the session carries at most
+	// initialMaxStreams streams in case it sets a lower limit.  ready is
+	// closed when heard is set or the session closes.
+	heard bool
+	ready chan struct{}
+}
+
+// initialMaxStreams is the stream limit a session assumes until the
+// server's SETTINGS_MAX_CONCURRENT_STREAMS can have arrived.  Streams past
+// the server's limit would be refused, so the default is a single stream.
+const initialMaxStreams = 1
+
+func newClientSession(t *Transport, pool *originPool, c net.Conn, version int) *clientSession {
+	sess := &clientSession{
+		t:          t,
+		pool:       pool,
+		c:          c,
+		r:          bufio.NewReader(c),
+		out:        newFrameScheduler(c, newHeaderWriter(-1, version)),
+		hr:         newHeaderReader(version),
+		version:    version,
+		streams:    make(map[uint32]*clientStream),
+		pushes:     make(map[uint32]*clientStream),
+		nextID:     1,
+		sendWindow: defaultWindow3,
+		recvWindow: t.maxStreamBufferBytes(),
+		ready:      make(chan struct{}),
+	}
+	sess.cond.L = &sess.mu
+	if t.IdleTimeout > 0 {
+		sess.idleTimer = time.AfterFunc(t.IdleTimeout, sess.idleTimeout)
+	}
+	go func() {
+		sess.close(sess.out.run())
+	}()
+	go sess.readLoop()
+	if version >= version3 {
+		// Announcing the window tells the server that WINDOW_UPDATEs
+		// will follow.
+		window := Settings{{Id: SettingsInitialWindowSize, Value: uint32(sess.recvWindow)}}
+		sess.out.writeControl(queuedFrame{frame: settingsFrame(version, 0, window)})
+	}
+	// Any server answers a PING, so the first frame, and with it the
+	// server's SETTINGS, arrives within a round trip.
+	sess.out.writeControl(queuedFrame{frame: PingFrame(1)})
+	return sess
+}
+
+// usable reports whether new requests may be sent on the session.
+func (sess *clientSession) usable() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.usableLocked()
+}
+
+func (sess *clientSession) usableLocked() bool {
+	return sess.err == nil && !sess.goingAway && int(sess.nextID)+2*sess.reserved < 1<<31
+}
+
+// reserveStream claims a stream for a request that roundTrip will send, if
+// the session is usable and the server's stream limit allows another.
+func (sess *clientSession) reserveStream() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if !sess.usableLocked() {
+		return false
+	}
+	max, ok := sess.peerSettings.Get(SettingsMaxConcurrentStreams)
+	if !sess.heard {
+		max, ok = initialMaxStreams, true
+	}
+	if ok && len(sess.streams)+sess.reserved >= int(max) {
+		return false
+	}
+	sess.reserved++
+	if sess.idleTimer != nil {
+		sess.idleTimer.Stop()
+	}
+	return true
+}
+
+// pending returns a channel that is closed once the server's first frame
+// has been handled, or nil if it already has been or the session is closed.
+func (sess *clientSession) pending() <-chan struct{} {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.heard || sess.err != nil {
+		return nil
+	}
+	return sess.ready
+}
+
+// numStreams returns the number of open, reserved and pushed streams.
+func (sess *clientSession) numStreams() int {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return len(sess.streams) + len(sess.pushes) + sess.reserved
+}
+
+// idle reports whether the session has no open streams.
+func (sess *clientSession) idle() bool {
+	return sess.numStreams() == 0
+}
+
+// checkIdleLocked starts the idle timer once the session has no streams.
+// sess.mu must be held.
+func (sess *clientSession) checkIdleLocked() {
+	if sess.idleTimer != nil && sess.err == nil && len(sess.streams)+len(sess.pushes)+sess.reserved == 0 {
+		sess.idleTimer.Reset(sess.t.IdleTimeout)
+	}
+}
+
+// idleTimeout is called when the session has had no streams for
+// Transport.IdleTimeout.  Holding Transport.mu keeps requests from
+// reserving a stream while the session is closed.
+func (sess *clientSession) idleTimeout() {
+	t := sess.t
+	t.mu.Lock()
+	idle := sess.idle() && t.removeLocked(sess)
+	t.mu.Unlock()
+	if idle {
+		sess.pool.idleClosed.Add(1)
+		sess.close(nil)
+	}
+}
+
+// close ends the session.  Streams waiting for a reply fail with err, or
+// errSessionGone if err is nil; response bodies being read fail with
+// io.ErrUnexpectedEOF.
+func (sess *clientSession) close(err error) {
+	sess.mu.Lock()
+	if sess.err != nil {
+		sess.mu.Unlock()
+		return
+	}
+	if err == nil || err == errSchedulerClosed {
+		err = errSessionGone
+	}
+	sess.err = err
+	var streams []*clientStream
+	for _, st := range sess.streams {
+		streams = append(streams, st)
+	}
+	for _, st := range sess.pushes {
+		streams = append(streams, st)
+	}
+	sess.streams = make(map[uint32]*clientStream)
+	sess.pushes = make(map[uint32]*clientStream)
+	if sess.idleTimer != nil {
+		sess.idleTimer.Stop()
+	}
+	sess.closeReadyLocked()
+	sess.cond.Broadcast()
+	sess.mu.Unlock()
+
+	sess.t.forget(sess)
+	sess.out.close(err)
+	sess.c.Close()
+	for _, st := range streams {
+		st.fail(err, io.ErrUnexpectedEOF)
+	}
+}
+
+// readLoop reads frames from the server until the connection fails.
+func (sess *clientSession) readLoop() {
+	for {
+		f, err := ReadFrame(sess.r)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			sess.close(err)
+			return
+		}
+		if !f.IsControl() {
+			sess.handleData(f)
+			sess.hear()
+			continue
+		}
+		switch f.Type() {
+		case TypeSynReply:
+			err = sess.handleSynReply(f)
+		case TypeSynStream:
+			err = sess.handleSynStream(f)
+		case TypeHeaders:
+			// Only decoded to keep the decompressor in step.
+			if off := replyHeaderOffset(sess.version); len(f.Data) >= off {
+				_, err = sess.hr.Decode(f.Data[off:])
+			}
+		case TypeRstStream:
+			sess.handleRstStream(f)
+		case TypeSettings:
+			sess.handleSettings(f)
+		case TypeWindowUpdate:
+			sess.handleWindowUpdate(f)
+		case TypePing:
+			// Answer the server's PINGs, which have even IDs.
+			if len(f.Data) == 4 && binary.BigEndian.Uint32(f.Data)%2 == 0 {
+				sess.out.writeControl(queuedFrame{frame: PingFrame(binary.BigEndian.Uint32(f.Data))})
+			}
+		case TypeGoaway:
+			sess.handleGoaway(f)
+		}
+		if err != nil {
+			// A header block that cannot be decoded leaves the
+			// decompressor unusable for the rest of the session.
+			sess.close(err)
+			return
+		}
+		sess.hear()
+	}
+}
+
+// hear records that a frame from the server has been handled, releasing
+// request bodies that were waiting for it.
+func (sess *clientSession) hear() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if !sess.heard {
+		sess.heard = true
+		sess.closeReadyLocked()
+		sess.cond.Broadcast()
+	}
+}
+
+func (sess *clientSession) closeReadyLocked() {
+	select {
+	case <-sess.ready:
+	default:
+		close(sess.ready)
+	}
+}
+
+func (sess *clientSession) stream(id uint32) *clientStream {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.streamsFor(id)[id]
+}
+
+// streamsFor returns the map that holds stream id: requests have odd IDs
+// and pushes even ones.  sess.mu must be held.
+func (sess *clientSession) streamsFor(id uint32) map[uint32]*clientStream {
+	if id%2 == 0 {
+		return sess.pushes
+	}
+	return sess.streams
+}
+
+func (sess *clientSession) handleSynReply(f Frame) error {
+	off := replyHeaderOffset(sess.version)
+	if len(f.Data) < off {
+		return errors.New("spdy: short SYN_REPLY")
+	}
+	h, err := sess.hr.Decode(f.Data[off:])
+	if err != nil {
+		return err
+	}
+	st := sess.stream(binary.BigEndian.Uint32(f.Data[0:4]) & 0x7fffffff)
+	if st == nil || st.pushed {
+		return nil
+	}
+	resp, err := st.response(h)
+	if err != nil {
+		sess.reset(st, ProtocolError, err)
+		return nil
+	}
+	st.deliver(resp, nil)
+	if f.Flags&FlagFin != 0 {
+		st.body.wclose(nil)
+		sess.streamEvent(st, eventRecvFin)
+	}
+	return nil
+}
+
+// handleSynStream handles a stream pushed by the server.  Pushes are
+// refused unless Transport.AcceptPush takes them.
+func (sess *clientSession) handleSynStream(f Frame) error {
+	if len(f.Data) < 10 {
+		return errors.New("spdy: short SYN_STREAM")
+	}
+	h, err := sess.hr.Decode(f.Data[10:])
+	if err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint32(f.Data[0:4]) & 0x7fffffff
+	assoc := binary.BigEndian.Uint32(f.Data[4:8]) & 0x7fffffff
+	status := ProtocolError
+	// Server streams have even IDs, are unidirectional, and are pushed
+	// in association with a request.
+	if id != 0 && id%2 == 0 && assoc != 0 && f.Flags&FlagUnidirectional != 0 && sess.stream(id) == nil {
+		status = sess.push(id, assoc, f.Flags, h)
+	}
+	if status != 0 {
+		sess.out.writeControl(queuedFrame{frame: RstStreamFrame(id, status)})
+	}
+	return nil
+}
+
+// push offers a pushed stream to Transport.AcceptPush and caches it if it
+// is accepted.  It returns the status to reset the stream with, or zero.
+func (sess *clientSession) push(id, assoc uint32, flags FrameFlags, h http.Header) RstStreamStatus {
+	accept := sess.t.AcceptPush
+	if accept == nil {
+		return RefusedStream
+	}
+	u, err := url.Parse(h.Get("Url"))
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return ProtocolError
+	}
+	h.Del("Url")
+	parent := sess.stream(assoc)
+	// A server may only push resources of its own origin.
+	if parent == nil || parent.pushed || origin(u) != sess.pool.origin || !accept(u, parent.req) {
+		return Cancel
+	}
+	st := &clientStream{
+		id:     id,
+		sess:   sess,
+		req:    &http.Request{Method: "GET", URL: u, Host: u.Host, Header: make(http.Header)},
+		state:  stateHalfClosedLocal,
+		pushed: true,
+		// Nothing reads a push until a request claims it.
+		body:   newAsyncPipe(sess.t.maxStreamBufferBytes(), false),
+		replyc: make(chan clientReply, 1),
+	}
+	resp, err := st.response(h)
+	if err != nil {
+		return ProtocolError
+	}
+	sess.mu.Lock()
+	if sess.err != nil {
+		sess.mu.Unlock()
+		return 0
+	}
+	sess.pushes[id] = st
+	sess.mu.Unlock()
+	sess.pool.pushes.add(st, resp)
+	if flags&FlagFin != 0 {
+		st.body.wclose(nil)
+		sess.streamEvent(st, eventRecvFin)
+	}
+	return 0
+}
+
+func (sess *clientSession) handleData(f Frame) {
+	sess.ackSessionData(len(f.Data))
+	st := sess.stream(f.StreamId())
+	if st == nil {
+		return
+	}
+	event := eventRecvData
+	if f.Flags&FlagFin != 0 {
+		event = eventRecvFin
+	}
+	if status := sess.streamEvent(st, event); status != 0 {
+		sess.reset(st, status, StreamError{st.id, status})
+		return
+	}
+	if err := st.body.writeAll(f.Data); err == errPipeFull {
+		// A body the application does not keep up with, or a push
+		// nobody claims, is given up.
+		sess.reset(st, Cancel, errResponseBuffer)
+		return
+	}
+	if f.Flags&FlagFin != 0 {
+		st.body.wclose(nil)
+	}
+}
+
+func (sess *clientSession) handleRstStream(f Frame) {
+	if len(f.Data) != 8 {
+		return
+	}
+	id, status := rstFields(f)
+	st := sess.stream(id)
+	if st == nil {
+		return
+	}
+	var err error = StreamError{id, status}
+	if status == RefusedStream {
+		err = errSessionGone
+	}
+	sess.streamEvent(st, eventRecvRst)
+	sess.out.resetStream(id)
+	st.fail(err, err)
+}
+
+func rstFields(f Frame) (id uint32, status RstStreamStatus) {
+	return binary.BigEndian.Uint32(f.Data[0:4]) & 0x7fffffff, RstStreamStatus(binary.BigEndian.Uint32(f.Data[4:8]))
+}
+
+func (sess *clientSession) handleSettings(f Frame) {
+	settings, err := DecodeSettings(sess.version, f.Data)
+	if err != nil {
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for _, setting := range settings {
+		sess.peerSettings.Set(setting.Id, setting.Value)
+	}
+	if v, ok := settings.Get(SettingsInitialWindowSize); ok {
+		delta := int(v) - sess.initialWindow
+		if sess.initialWindow == 0 {
+			// Streams opened before flow control started have sent
+			// without a window.
+			for _, st := range sess.streams {
+				st.window = int(v) - st.sent
+			}
+		} else {
+			for _, st := range sess.streams {
+				st.window += delta
+			}
+		}
+		sess.initialWindow = int(v)
+		sess.cond.Broadcast()
+	}
+}
+
+func (sess *clientSession) handleWindowUpdate(f Frame) {
+	if len(f.Data) != 8 {
+		return
+	}
+	id := binary.BigEndian.Uint32(f.Data[0:4]) & 0x7fffffff
+	delta := int(binary.BigEndian.Uint32(f.Data[4:8]) & 0x7fffffff)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if id == 0 && sess.version >= version3 {
+		sess.sendWindow += delta
+		sess.cond.Broadcast()
+	} else if st := sess.streams[id]; st != nil {
+		st.window += delta
+		sess.cond.Broadcast()
+	}
+}
+
+// ackSessionData returns n bytes of DATA to the server's SPDY/3.1 session
+// window, in batches of half the window.  The stream windows and buffers
+// bound what the session holds, so the bytes are returned as soon as they
+// arrive.
+func (sess *clientSession) ackSessionData(n int) {
+	if sess.version < version3 {
+		return
+	}
+	sess.recvUnacked += n
+	if sess.recvUnacked >= defaultWindow3/2 {
+		sess.out.writeControl(queuedFrame{frame: WindowUpdateFrame(0, uint32(sess.recvUnacked))})
+		sess.recvUnacked = 0
+	}
+}
+
+// bodyRead returns n bytes of a SPDY/3 response body that the application
+// has read to the stream's window, in batches of half the window.
+func (sess *clientSession) bodyRead(st *clientStream, n int) {
+	if sess.version < version3 {
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	st.unacked += n
+	if st.unacked < sess.recvWindow/2 {
+		return
+	}
+	if sess.streamsFor(st.id)[st.id] == st && (st.state == stateOpen || st.state == stateHalfClosedLocal) {
+		sess.out.writeControl(queuedFrame{frame: WindowUpdateFrame(st.id, uint32(st.unacked))})
+	}
+	st.unacked = 0
+}
+
+// handleGoaway stops new requests on the session.  Streams the server did
+// not accept fail with errSessionGone so that they can be retried; the
+// session closes once the rest finish.
+func (sess *clientSession) handleGoaway(f Frame) {
+	if len(f.Data) < 4 {
+		return
+	}
+	lastGood := binary.BigEndian.Uint32(f.Data[0:4]) & 0x7fffffff
+	if sess.t.forget(sess) {
+		sess.pool.goaways.Add(1)
+	}
+	sess.mu.Lock()
+	sess.goingAway = true
+	var refused []*clientStream
+	for id, st := range sess.streams {
+		if id > lastGood {
+			refused = append(refused, st)
+			delete(sess.streams, id)
+		}
+	}
+	empty := len(sess.streams)+len(sess.pushes) == 0
+	sess.mu.Unlock()
+	for _, st := range refused {
+		sess.out.resetStream(st.id)
+		st.fail(errSessionGone, errSessionGone)
+	}
+	if empty {
+		sess.close(nil)
+	}
+}
+
+// streamEvent moves a stream to its next state and forgets it once it is
+// closed.  If the event is not allowed, the status for the RST_STREAM to
+// send is returned.
+func (sess *clientSession) streamEvent(st *clientStream, e streamEvent) RstStreamStatus {
+	sess.mu.Lock()
+	var status RstStreamStatus
+	st.state, status = st.state.transition(e)
+	closeSession := false
+	if streams := sess.streamsFor(st.id); st.state == stateClosed && streams[st.id] == st {
+		delete(streams, st.id)
+		closeSession = sess.goingAway && len(sess.streams)+len(sess.pushes) == 0
+		sess.checkIdleLocked()
+	}
+	sess.mu.Unlock()
+	if closeSession {
+		sess.close(nil)
+	}
+	return status
+}
+
+// reset fails a stream with err and, unless it has already closed, sends
+// RST_STREAM.  The stream fails first, so that a reset push has left the
+// push cache before the server can see the RST_STREAM.
+func (sess *clientSession) reset(st *clientStream, status RstStreamStatus, err error) {
+	st.fail(err, err)
+	sess.mu.Lock()
+	open := sess.streamsFor(st.id)[st.id] == st
+	sess.mu.Unlock()
+	if open {
+		sess.out.resetStream(st.id)
+		sess.out.writeControl(queuedFrame{frame: RstStreamFrame(st.id, status)})
+		sess.streamEvent(st, eventSendRst)
+	}
+}
+
+// hopHeaders plus Host, which SPDY carries in the url header, are not sent
+// as request headers.
+var clientSkipHeaders = append([]string{"Host", "Upgrade"}, hopHeaders...)
+
+// roundTrip sends req as a new stream, using the stream reserved by
+// Transport.session, and waits for the reply.
+func (sess *clientSession) roundTrip(req *http.Request) (*http.Response, error) {
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	h := make(http.Header, len(req.Header)+4)
+	for k, v := range req.Header {
+		h[k] = append([]string(nil), v...)
+	}
+	for _, k := range clientSkipHeaders {
+		h.Del(k)
+	}
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	u := *req.URL
+	u.Host = host
+	h.Set("method", method)
+	h.Set("url", u.String())
+	h.Set("version", "HTTP/1.1")
+	h.Set("host", host)
+	if hasBody && req.ContentLength > 0 {
+		h.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+	var flags FrameFlags
+	if !hasBody {
+		flags = FlagFin
+		closeBody(req)
+	}
+
+	st := &clientStream{
+		sess: sess,
+		req:  req,
+		// A SPDY/3 server keeps to the window announced for the
+		// buffer, or ignores windows altogether, as spdystream does,
+		// and is then held back by not reading the connection.
+		body:   newAsyncPipe(sess.t.maxStreamBufferBytes(), sess.version >= version3),
+		replyc: make(chan clientReply, 1),
+	}
+	sess.mu.Lock()
+	// Transport.session reserved the stream.
+	sess.reserved--
+	if sess.err != nil || sess.goingAway {
+		sess.checkIdleLocked()
+		sess.mu.Unlock()
+		if hasBody {
+			closeBody(req)
+		}
+		return nil, errSessionGone
+	}
+	st.id = sess.nextID
+	sess.nextID += 2
+	if sess.initialWindow > 0 {
+		st.window = sess.initialWindow
+	}
+	sess.streams[st.id] = st
+	sess.out.openStream(st.id, 0)
+	// Queued under sess.mu, so SYN_STREAMs go out in stream ID order.
+	data := make([]byte, 10)
+	binary.BigEndian.PutUint32(data[0:4], st.id)
+	err := sess.out.writeControl(queuedFrame{frame: ControlFrame(TypeSynStream, flags, data), header: h})
+	sess.mu.Unlock()
+	if err != nil {
+		return nil, errSessionGone
+	}
+	if !hasBody {
+		sess.out.finishStream(st.id)
+		sess.streamEvent(st, eventSendFin)
+	} else {
+		go st.writeBody(req.Body)
+	}
+
+	ctx := req.Context()
+	select {
+	case r := <-st.replyc:
+		if r.err != nil {
+			return nil, r.err
+		}
+		stop := context.AfterFunc(ctx, func() { sess.reset(st, Cancel, ctx.Err()) })
+		r.resp.Body = &clientBody{st: st, stop: stop}
+		return r.resp, nil
+	case <-ctx.Done():
+		sess.reset(st, Cancel, ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// A clientStream is one request on a clientSession.
+type clientStream struct {
+	id   uint32
+	sess *clientSession
+	req  *http.Request
+
+	state   streamState // protected by sess.mu
+	window  int         // bytes that may be sent with flow control; protected by sess.mu
+	sent    int         // request body bytes sent; protected by sess.mu
+	unacked int         // SPDY/3 response body bytes read but not returned to the window; protected by sess.mu
+
+	replyOnce sync.Once
+	replyc    chan clientReply
+	body      *asyncPipe // response body
+	pushed    bool       // opened by the server; cached until claimed
+}
+
+type clientReply struct {
+	resp *http.Response
+	err  error
+}
+
+// deliver hands the response, or the error, to the waiting roundTrip.  Only
+// the first call has an effect.
+func (st *clientStream) deliver(resp *http.Response, err error) {
+	st.replyOnce.Do(func() { st.replyc <- clientReply{resp, err} })
+}
+
+// fail ends the stream: a request still waiting for its reply gets
+// replyErr, and a response body being read gets bodyErr.
+func (st *clientStream) fail(replyErr, bodyErr error) {
+	st.deliver(nil, replyErr)
+	st.body.wclose(bodyErr)
+	if st.pushed {
+		st.sess.pool.pushes.drop(st)
+	}
+}
+
+// discard gives up the response body, resetting the stream if the server
+// is still sending it.
+func (st *clientStream) discard() {
+	if st.body.rclose() {
+		st.sess.reset(st, Cancel, errStreamReset)
+	}
+}
+
+// response builds the response to the stream's request from SYN_REPLY
+// headers.
+func (st *clientStream) response(h http.Header) (*http.Response, error) {
+	status := h.Get("Status")
+	code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+	if err != nil || code < 100 || code > 999 {
+		return nil, errors.New("spdy: malformed status " + strconv.Quote(status))
+	}
+	proto := h.Get("Version")
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	h.Del("Status")
+	h.Del("Version")
+	resp := &http.Response{
+		Status:        status,
+		StatusCode:    code,
+		Proto:         proto,
+		Header:        h,
+		ContentLength: -1,
+		Request:       st.req,
+	}
+	resp.ProtoMajor, resp.ProtoMinor, _ = http.ParseHTTPVersion(proto)
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+		resp.ContentLength = n
+	}
+	if st.req.Method == "HEAD" {
+		resp.ContentLength = 0
+	}
+	return resp, nil
+}
+
+// writeBody sends the request body as DATA frames, within the stream's
+// send window if the server uses flow control.
+func (st *clientStream) writeBody(body io.ReadCloser) {
+	defer body.Close()
+	sess := st.sess
+	buf := make([]byte, sess.t.maxDataFrameSize())
+	for {
+		n, rerr := body.Read(buf)
+		for p := buf[:n]; len(p) > 0; {
+			k, err := st.reserve(len(p))
+			if err != nil {
+				return
+			}
+			data := make([]byte, k)
+			copy(data, p)
+			if sess.out.writeStream(st.id, queuedFrame{frame: DataFrame(st.id, 0, data)}) != nil {
+				return
+			}
+			p = p[k:]
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			sess.reset(st, Cancel, rerr)
+			return
+		}
+	}
+	if sess.out.writeStream(st.id, queuedFrame{frame: DataFrame(st.id, FlagFin, nil)}) != nil {
+		return
+	}
+	sess.out.finishStream(st.id)
+	sess.streamEvent(st, eventSendFin)
+}
+
+// reserve waits until the stream may send some of n bytes and returns how
+// many.  It fails once the stream or session has ended.
+func (st *clientStream) reserve(n int) (int, error) {
+	sess := st.sess
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for {
+		if sess.err != nil {
+			return 0, sess.err
+		}
+		if sess.streams[st.id] != st || st.state == stateClosed {
+			return 0, errStreamReset
+		}
+		if !sess.heard {
+			sess.cond.Wait()
+			continue
+		}
+		if sess.initialWindow == 0 {
+			break
+		}
+		if st.window > 0 && (sess.version < version3 || sess.sendWindow > 0) {
+			n = min(n, st.window)
+			if sess.version >= version3 {
+				n = min(n, sess.sendWindow)
+				sess.sendWindow -= n
+			}
+			st.window -= n
+			break
+		}
+		sess.cond.Wait()
+	}
+	st.sent += n
+	return n, nil
+}
+
+// A clientBody is the body of a response.  Closing it before the end
+// resets the stream.
+type clientBody struct {
+	st   *clientStream
+	stop func() bool // stops the context watch
+}
+
+func (b *clientBody) Read(p []byte) (n int, err error) {
+	n, err = b.st.body.read(p)
+	if n > 0 {
+		b.st.sess.bodyRead(b.st, n)
+	}
+	if err != nil {
+		b.stop()
+	}
+	return
+}
+
+func (b *clientBody) Close() error {
+	b.stop()
+	b.st.discard()
+	return nil
+}
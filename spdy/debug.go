@@ -0,0 +1,119 @@
+// spdy/debug.go
+
+package spdy
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DebugHandler returns a handler that renders the server's live sessions
+// and their open streams, in the spirit of Chrome's net-internals.  It is
+// meant to be mounted at /debug/spdy on an internal listener:
+//
+//	http.Handle("/debug/spdy", srv.DebugHandler())
+//
+// A POST with the form value goaway=<session ID> sends GOAWAY on that
+// session.  POSTs that a browser reports as coming from another origin are
+// refused, so other sites cannot make a visitor's browser send them.
+func (srv *Server) DebugHandler() http.Handler {
+	return debugHandler{srv}
+}
+
+type debugHandler struct {
+	srv *Server
+}
+
+func (h debugHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD":
+	case "POST":
+		if !sameOrigin(req) {
+			http.Error(w, "spdy: cross-origin request refused", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseUint(req.FormValue("goaway"), 10, 64)
+		if err != nil {
+			http.Error(w, "spdy: bad session ID", http.StatusBadRequest)
+			return
+		}
+		if !h.srv.GoAwaySession(id) {
+			http.Error(w, "spdy: no such session", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, req, req.URL.Path, http.StatusSeeOther)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	debugTemplate.Execute(w, debugPage{Now: time.Now(), Sessions: h.srv.Sessions()})
+}
+
+// sameOrigin reports whether req came from a page of its own origin, as
+// browsers report it in Sec-Fetch-Site or, if they are older, in Origin.
+// Requests with neither, such as curl's, did not come from a page.
+func sameOrigin(req *http.Request) bool {
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "":
+	case "same-origin", "none":
+		return true
+	default:
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && u.Host == req.Host
+}
+
+type debugPage struct {
+	Now      time.Time
+	Sessions []SessionInfo
+}
+
+// Age returns the time elapsed since t, to the millisecond.
+func (p debugPage) Age(t time.Time) time.Duration {
+	return p.Now.Sub(t).Round(time.Millisecond)
+}
+
+var debugTemplate = template.Must(template.New("spdy").Parse(`<!DOCTYPE html>
+<html>
+<head><title>/debug/spdy</title></head>
+<body>
+<h1>SPDY sessions</h1>
+<p>{{len .Sessions}} live sessions at {{.Now.Format "2006-01-02 15:04:05.000 MST"}}</p>
+{{range $sess := .Sessions}}
+<h2 id="session-{{.ID}}">Session {{.ID}}: {{.RemoteAddr}}</h2>
+<table>
+<tr><th align="left">Version</th><td>spdy/{{.Version}}</td></tr>
+<tr><th align="left">State</th><td>{{.State}}{{if .GoingAway}}, going away{{end}}</td></tr>
+<tr><th align="left">Age</th><td>{{$.Age .Created}}</td></tr>
+<tr><th align="left">RTT</th><td>{{if .RTT}}{{.RTT}}{{else}}unmeasured{{end}}</td></tr>
+<tr><th align="left">Frames in/out</th><td>{{.FramesIn}} / {{.FramesOut}}</td></tr>
+<tr><th align="left">Bytes in/out</th><td>{{.BytesIn}} / {{.BytesOut}}</td></tr>
+<tr><th align="left">Settings sent</th><td>{{range .Settings}}{{.Id}}={{.Value}} {{else}}none{{end}}</td></tr>
+<tr><th align="left">Settings received</th><td>{{range .PeerSettings}}{{.Id}}={{.Value}} {{else}}none{{end}}</td></tr>
+</table>
+{{if not .GoingAway}}
+<form method="POST"><input type="hidden" name="goaway" value="{{.ID}}"><input type="submit" value="GOAWAY"></form>
+{{end}}
+{{if .OpenStreams}}
+<table border="1" cellspacing="0" cellpadding="3">
+<tr><th>ID</th><th>Priority</th><th>URL</th><th>State</th><th>Bytes in</th><th>Bytes out</th><th>Age</th></tr>
+{{range .OpenStreams}}<tr><td>{{.ID}}</td><td>{{.Priority}}</td><td>{{.URL}}</td><td>{{.State}}</td><td>{{.BytesIn}}</td><td>{{.BytesOut}}</td><td>{{$.Age .Opened}}</td></tr>
+{{end}}</table>
+{{else}}
+<p>No open streams.</p>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,111 @@
+// spdy/debug_test.go
+
+package spdy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		<-release
+	})}
+	c, r := testServerConn(t, srv)
+	hw, hr := NewHeaderWriter(-1), NewHeaderReader()
+	synStream(hw, 1, 3, FlagFin, getHeader("http://example.com/slow")).WriteTo(c)
+	readControl(t, r, TypeSettings)
+	hr.Decode(readControl(t, r, TypeSynReply).Data[6:])
+
+	rec := httptest.NewRecorder()
+	srv.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/spdy", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"1 live sessions",
+		"Session 1: pipe",
+		"spdy/2",
+		"MAX_CONCURRENT_STREAMS=100",
+		"<td>http://example.com/slow</td>",
+		"<td>half-closed (remote)</td>",
+		`name="goaway" value="1"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page lacks %q:\n%s", want, body)
+		}
+	}
+
+	// Another site's page cannot send GOAWAY through a visitor's browser.
+	for _, h := range []http.Header{
+		{"Origin": {"http://evil.example"}},
+		{"Origin": {"null"}},
+		{"Sec-Fetch-Site": {"cross-site"}, "Origin": {"http://example.com"}},
+	} {
+		rec = httptest.NewRecorder()
+		post := httptest.NewRequest("POST", "/debug/spdy?goaway=1", nil)
+		for k, v := range h {
+			post.Header[k] = v
+		}
+		srv.DebugHandler().ServeHTTP(rec, post)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("POST goaway with %v: status %d, want %d", h, rec.Code, http.StatusForbidden)
+		}
+	}
+	if infos := srv.Sessions(); len(infos) != 1 || infos[0].GoingAway {
+		t.Fatalf("Sessions() = %+v after cross-origin POSTs, want one live session", infos)
+	}
+
+	rec = httptest.NewRecorder()
+	post := httptest.NewRequest("POST", "/debug/spdy", strings.NewReader(url.Values{"goaway": {"1"}}.Encode()))
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	post.Header.Set("Origin", "http://example.com")
+	srv.DebugHandler().ServeHTTP(rec, post)
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("POST goaway: status %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	readControl(t, r, TypeGoaway)
+	if infos := srv.Sessions(); len(infos) != 1 || !infos[0].GoingAway {
+		t.Errorf("Sessions() = %+v, want one session going away", infos)
+	}
+
+	rec = httptest.NewRecorder()
+	post = httptest.NewRequest("POST", "/debug/spdy?goaway=42", nil)
+	srv.DebugHandler().ServeHTTP(rec, post)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("POST goaway on unknown session: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestSessionsWhileHandlerChangesHeader(t *testing.T) {
+	started := make(chan struct{})
+	stop := make(chan struct{})
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				req.Header.Set("Url", "http://example.com/changed")
+			}
+		}
+	})}
+	c, _ := testServerConn(t, srv)
+	synStream(NewHeaderWriter(-1), 1, 0, FlagFin, getHeader("http://example.com/")).WriteTo(c)
+	<-started
+	defer close(stop)
+	for i := 0; i < 100; i++ {
+		for _, info := range srv.Sessions() {
+			for _, st := range info.OpenStreams {
+				if st.URL != "http://example.com/" {
+					t.Fatalf("stream URL = %q, want %q", st.URL, "http://example.com/")
+				}
+			}
+		}
+	}
+}
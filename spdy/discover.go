@@ -0,0 +1,286 @@
+// spdy/discover.go
+
+package spdy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBrokenAltTimeout is how long an AltTransport avoids an alternate
+// that failed when AltTransport.BrokenTimeout is zero.
+const DefaultBrokenAltTimeout = 5 * time.Minute
+
+// An AltTransport is an http.RoundTripper for sites that advertise SPDY
+// on HTTP/1.x responses, as Advertiser does.  Requests to an origin go
+// over HTTP/1.x until a response names a SPDY alternate in Alt-Svc or
+// Alternate-Protocol; later requests to the origin go to that alternate
+// over SPDY until the advertisement expires.  Alternate-Protocol carries
+// no lifetime, so its alternates last DefaultAltSvcMaxAge.
+//
+// An alternate that cannot be reached is avoided for BrokenTimeout, and
+// the request is retried over HTTP/1.x if its body can be replayed.  So is
+// a request that the alternate went away without processing.  Other
+// failures, such as the alternate resetting the stream or the request
+// being canceled, are returned as they are.  Alternates without TLS are
+// ignored for https origins.  An alternate's TLS certificate must be valid
+// for the origin's host, wherever the alternate is.
+type AltTransport struct {
+	// HTTP carries requests over HTTP/1.x.  If nil,
+	// http.DefaultTransport is used.
+	HTTP http.RoundTripper
+
+	// SPDY carries requests to alternates.  If nil, a Transport with the
+	// default configuration is used.
+	SPDY *Transport
+
+	// BrokenTimeout is how long an alternate that failed is avoided.  If
+	// zero, DefaultBrokenAltTimeout is used.
+	BrokenTimeout time.Duration
+
+	mu   sync.Mutex
+	spdy *Transport
+	alts map[string]*alternate // by origin
+}
+
+// An alternate is where an origin said it serves SPDY.
+type alternate struct {
+	host    string // empty for the origin's own host
+	port    int
+	tls     bool
+	expires time.Time
+	broken  time.Time // avoided until then
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *AltTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	o := origin(req.URL)
+	if alt, ok := t.alternate(o); ok {
+		resp, err := t.roundTripAlt(req, alt)
+		if err == nil {
+			return resp, nil
+		}
+		// Only an alternate that could not be reached is broken, and only
+		// a request the alternate never saw is sent again.
+		var derr *dialError
+		switch {
+		case req.Context().Err() != nil:
+			return nil, err
+		case errors.As(err, &derr):
+			t.markBroken(o, alt)
+		case err != errSessionGone:
+			return nil, err
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, err
+			}
+			body, gerr := req.GetBody()
+			if gerr != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+	rt := t.HTTP
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.learn(o, resp.Header)
+	return resp, nil
+}
+
+// roundTripAlt sends req to alt over SPDY.
+func (t *AltTransport) roundTripAlt(req *http.Request, alt alternate) (*http.Response, error) {
+	areq := req.Clone(req.Context())
+	if areq.Host == "" {
+		areq.Host = req.URL.Host
+	}
+	host := alt.host
+	if host == "" {
+		host = req.URL.Hostname()
+	}
+	areq.URL.Host = net.JoinHostPort(host, strconv.Itoa(alt.port))
+	areq.URL.Scheme = "http"
+	// An alternate elsewhere must show a certificate for the origin
+	// (RFC 7838, section 2.1), so sessions to it are kept apart from
+	// those for the alternate's own host.
+	serverName := ""
+	if alt.tls {
+		areq.URL.Scheme = "https"
+		if host != req.URL.Hostname() {
+			serverName = req.URL.Hostname()
+		}
+	}
+	resp, err := t.spdyTransport().roundTrip(areq, serverName)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+func (t *AltTransport) spdyTransport() *Transport {
+	if t.SPDY != nil {
+		return t.SPDY
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.spdy == nil {
+		t.spdy = new(Transport)
+	}
+	return t.spdy
+}
+
+// CloseIdleConnections closes the idle connections of both transports.
+func (t *AltTransport) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	rt := t.HTTP
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if c, ok := rt.(closeIdler); ok {
+		c.CloseIdleConnections()
+	}
+	t.spdyTransport().CloseIdleConnections()
+}
+
+// alternate returns the usable alternate of origin o, if any.
+func (t *AltTransport) alternate(o string) (alternate, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	alt, ok := t.alts[o]
+	if !ok {
+		return alternate{}, false
+	}
+	now := time.Now()
+	if now.After(alt.expires) {
+		delete(t.alts, o)
+		return alternate{}, false
+	}
+	if now.Before(alt.broken) {
+		return alternate{}, false
+	}
+	return *alt, true
+}
+
+// markBroken avoids the alternate alt of origin o for BrokenTimeout.
+func (t *AltTransport) markBroken(o string, alt alternate) {
+	d := t.BrokenTimeout
+	if d == 0 {
+		d = DefaultBrokenAltTimeout
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cur, ok := t.alts[o]; ok && cur.host == alt.host && cur.port == alt.port && cur.tls == alt.tls {
+		cur.broken = time.Now().Add(d)
+	}
+}
+
+// learn records the alternate advertised by a response from origin o.
+// Alt-Svc takes precedence over Alternate-Protocol, and "Alt-Svc: clear"
+// forgets the origin's alternate.
+func (t *AltTransport) learn(o string, h http.Header) {
+	alt, clear, ok := parseAltSvc(h.Values("Alt-Svc"))
+	if !ok && !clear {
+		alt, ok = parseAlternateProtocol(h.Values("Alternate-Protocol"), strings.HasPrefix(o, "https://"))
+	}
+	if !ok && !clear {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if clear {
+		delete(t.alts, o)
+		return
+	}
+	if cur, ok := t.alts[o]; ok && cur.host == alt.host && cur.port == alt.port && cur.tls == alt.tls {
+		// Readvertising a broken alternate does not mend it.
+		alt.broken = cur.broken
+	}
+	if t.alts == nil {
+		t.alts = make(map[string]*alternate)
+	}
+	t.alts[o] = &alt
+}
+
+// parseAlternateProtocol returns the first SPDY alternate in
+// Alternate-Protocol values such as "5555:npn-spdy/2".  If tlsOnly is set,
+// alternates over plain TCP are skipped.
+func parseAlternateProtocol(values []string, tlsOnly bool) (alt alternate, ok bool) {
+	for _, v := range values {
+		for _, entry := range strings.Split(v, ",") {
+			port, proto, found := strings.Cut(strings.TrimSpace(entry), ":")
+			if !found {
+				continue
+			}
+			n, err := strconv.Atoi(port)
+			if err != nil || n <= 0 || n > 0xffff {
+				continue
+			}
+			switch proto {
+			case "npn-" + NextProtoSPDY2:
+				return alternate{port: n, tls: true, expires: time.Now().Add(DefaultAltSvcMaxAge)}, true
+			case NextProtoSPDY2:
+				if tlsOnly {
+					continue
+				}
+				return alternate{port: n, expires: time.Now().Add(DefaultAltSvcMaxAge)}, true
+			}
+		}
+	}
+	return alternate{}, false
+}
+
+// parseAltSvc returns the first SPDY alternate in Alt-Svc values such as
+// `spdy%2F2=":5555"; ma=3600`, or reports that they clear the origin's
+// alternates.  Alt-Svc alternates always use TLS.
+func parseAltSvc(values []string) (alt alternate, clear, ok bool) {
+	for _, v := range values {
+		if strings.TrimSpace(v) == "clear" {
+			return alternate{}, true, false
+		}
+		for _, entry := range strings.Split(v, ",") {
+			params := strings.Split(entry, ";")
+			id, authority, found := strings.Cut(strings.TrimSpace(params[0]), "=")
+			if !found {
+				continue
+			}
+			if id, err := url.PathUnescape(id); err != nil || id != NextProtoSPDY2 {
+				continue
+			}
+			host, port, err := net.SplitHostPort(strings.Trim(authority, `"`))
+			if err != nil {
+				continue
+			}
+			n, err := strconv.Atoi(port)
+			if err != nil || n <= 0 || n > 0xffff {
+				continue
+			}
+			maxAge := DefaultAltSvcMaxAge
+			for _, p := range params[1:] {
+				k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+				if k == "ma" {
+					if secs, err := strconv.ParseInt(strings.Trim(v, `"`), 10, 64); err == nil && secs >= 0 {
+						maxAge = time.Duration(secs) * time.Second
+					}
+				}
+			}
+			return alternate{host: host, port: n, tls: true, expires: time.Now().Add(maxAge)}, false, true
+		}
+	}
+	return alternate{}, false, false
+}
@@ -0,0 +1,290 @@
+// spdy/discover_test.go
+
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// protoHandler answers with the protocol the request arrived over and its
+// body.
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	if IsSPDY(req) {
+		io.WriteString(w, "spdy")
+	} else {
+		io.WriteString(w, "http")
+	}
+	io.Copy(w, req.Body)
+})
+
+// altGet sends a request with body through rt and returns the response
+// body.
+func altGet(t *testing.T, rt http.RoundTripper, method, url, body string) string {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := (&http.Client{Transport: rt, Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Request.URL.String() != url {
+		t.Errorf("response to %s %s has request URL %s", method, url, resp.Request.URL)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	return string(got)
+}
+
+func TestAltTransport(t *testing.T) {
+	srv := &Server{Handler: protoHandler}
+	addr := listen(t, srv, nil)
+	waitFor(t, "the server to listen", func() bool { return srv.port() != 0 })
+	ts := httptest.NewServer(&Advertiser{Handler: protoHandler, Server: srv})
+	defer ts.Close()
+
+	spdy := new(Transport)
+	at := &AltTransport{SPDY: spdy}
+	defer at.CloseIdleConnections()
+	for i, want := range []string{"http", "spdy", "spdy"} {
+		if got := altGet(t, at, "GET", ts.URL+"/", ""); got != want {
+			t.Errorf("request %d went over %q, want %q", i, got, want)
+		}
+	}
+	if got := altGet(t, at, "POST", ts.URL+"/post", " body"); got != "spdy body" {
+		t.Errorf("POST = %q, want %q", got, "spdy body")
+	}
+	if stats := spdy.Stats(); len(stats) != 1 || stats[0].Origin != "http://"+addr {
+		t.Errorf("SPDY transport stats = %+v, want one origin %s", stats, addr)
+	}
+
+	// An expired advertisement is forgotten until the origin repeats it.
+	o := "http://" + ts.Listener.Addr().String()
+	at.mu.Lock()
+	at.alts[o].expires = time.Now().Add(-time.Second)
+	at.mu.Unlock()
+	for i, want := range []string{"http", "spdy"} {
+		if got := altGet(t, at, "GET", ts.URL+"/", ""); got != want {
+			t.Errorf("after expiry, request %d went over %q, want %q", i, got, want)
+		}
+	}
+
+	// When the alternate goes away, requests fall back and the alternate
+	// is not tried again, although the origin keeps advertising it.
+	srv.Close()
+	spdy.CloseIdleConnections()
+	if got := altGet(t, at, "POST", ts.URL+"/", " again"); got != "http again" {
+		t.Errorf("POST after the alternate failed = %q, want %q", got, "http again")
+	}
+	dialErrors := spdy.Stats()[0].DialErrors
+	for i := 0; i < 2; i++ {
+		if got := altGet(t, at, "GET", ts.URL+"/", ""); got != "http" {
+			t.Errorf("request to a broken alternate went over %q", got)
+		}
+	}
+	if n := spdy.Stats()[0].DialErrors; n != dialErrors {
+		t.Errorf("%d dial errors after the alternate was marked broken, want %d", n, dialErrors)
+	}
+}
+
+func TestAltTransportAltSvc(t *testing.T) {
+	// Borrow httptest's certificate; it is valid for 127.0.0.1, where both
+	// the HTTPS server and its SPDY alternate listen.
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	clientConfig := ts.Client().Transport.(*http.Transport).TLSClientConfig
+	srv := &Server{Handler: protoHandler, TLSConfig: &tls.Config{Certificates: ts.TLS.Certificates}}
+	listen(t, srv, nil)
+	waitFor(t, "the server to listen", func() bool { return srv.port() != 0 })
+	ts.Config.Handler = &Advertiser{Handler: protoHandler, Server: srv, AltSvc: true}
+	defer ts.Close()
+
+	at := &AltTransport{HTTP: ts.Client().Transport, SPDY: &Transport{TLSClientConfig: clientConfig}}
+	defer at.CloseIdleConnections()
+	for i, want := range []string{"http", "spdy"} {
+		if got := altGet(t, at, "GET", ts.URL+"/", ""); got != want {
+			t.Errorf("request %d went over %q, want %q", i, got, want)
+		}
+	}
+	at.mu.Lock()
+	alt := *at.alts["https://"+ts.Listener.Addr().String()]
+	at.mu.Unlock()
+	if !alt.tls || time.Until(alt.expires) < DefaultAltSvcMaxAge-time.Minute {
+		t.Errorf("alternate = %+v, want TLS expiring in %v", alt, DefaultAltSvcMaxAge)
+	}
+}
+
+func TestAltTransportAltSvcCertificate(t *testing.T) {
+	// httptest's certificate is valid for example.com and 127.0.0.1, but
+	// not for localhost or origin.test.
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	defer ts.Close()
+	clientConfig := ts.Client().Transport.(*http.Transport).TLSClientConfig
+	srv := &Server{
+		Handler:   protoHandler,
+		TLSConfig: &tls.Config{Certificates: ts.TLS.Certificates},
+		Logger:    testLogger(new(logBuffer)),
+	}
+	listen(t, srv, nil)
+	waitFor(t, "the server to listen", func() bool { return srv.port() != 0 })
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	for _, tt := range []struct {
+		origin, alt string
+		want        string
+	}{
+		// The certificate fits the origin, although not the alternate.
+		{"example.com", "localhost", "spdy"},
+		// The certificate fits the alternate, but not the origin.
+		{"origin.test", "127.0.0.1", "http"},
+	} {
+		altSvc := fmt.Sprintf(`spdy%%2F2="%s:%d"`, tt.alt, srv.port())
+		ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Alt-Svc", altSvc)
+			protoHandler(w, req)
+		})
+		// Every origin is the HTTPS server, whose certificate the
+		// HTTP/1.1 leg does not check.
+		h1 := &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, network, ts.Listener.Addr().String())
+			},
+		}
+		at := &AltTransport{HTTP: h1, SPDY: &Transport{TLSClientConfig: clientConfig}}
+		url := "https://" + net.JoinHostPort(tt.origin, port) + "/"
+		for i, want := range []string{"http", tt.want} {
+			if got := altGet(t, at, "GET", url, ""); got != want {
+				t.Errorf("%s via %s: request %d went over %q, want %q", tt.origin, tt.alt, i, got, want)
+			}
+		}
+		at.CloseIdleConnections()
+		h1.CloseIdleConnections()
+	}
+}
+
+func TestParseAltSvc(t *testing.T) {
+	for _, tt := range []struct {
+		in    string
+		alt   alternate
+		clear bool
+		ok    bool
+	}{
+		{`spdy%2F2=":5555"; ma=60`, alternate{port: 5555, tls: true}, false, true},
+		{`h2=":443", spdy%2F2="alt.example.com:8443"`, alternate{host: "alt.example.com", port: 8443, tls: true}, false, true},
+		{`spdy/2=":80"`, alternate{port: 80, tls: true}, false, true},
+		{`h2=":443"; ma=60`, alternate{}, false, false},
+		{`spdy%2F2="no-port"`, alternate{}, false, false},
+		{`clear`, alternate{}, true, false},
+	} {
+		alt, clear, ok := parseAltSvc([]string{tt.in})
+		expires := alt.expires
+		alt.expires = time.Time{}
+		if alt != tt.alt || clear != tt.clear || ok != tt.ok {
+			t.Errorf("parseAltSvc(%q) = %+v, %v, %v, want %+v, %v, %v", tt.in, alt, clear, ok, tt.alt, tt.clear, tt.ok)
+		}
+		if strings.Contains(tt.in, "ma=60") && ok && time.Until(expires) > time.Minute {
+			t.Errorf("parseAltSvc(%q) expires in %v, want a minute", tt.in, time.Until(expires))
+		}
+	}
+}
+
+func TestParseAlternateProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		tlsOnly bool
+		alt     alternate
+		ok      bool
+	}{
+		{"5555:npn-spdy/2", false, alternate{port: 5555, tls: true}, true},
+		{"5555:spdy/2", false, alternate{port: 5555}, true},
+		{"5555:spdy/2", true, alternate{}, false},
+		{"5555:spdy/2, 443:npn-spdy/2", true, alternate{port: 443, tls: true}, true},
+		{"443:quic", false, alternate{}, false},
+	} {
+		alt, ok := parseAlternateProtocol([]string{tt.in}, tt.tlsOnly)
+		alt.expires = time.Time{}
+		if alt != tt.alt || ok != tt.ok {
+			t.Errorf("parseAlternateProtocol(%q, %v) = %+v, %v, want %+v, %v", tt.in, tt.tlsOnly, alt, ok, tt.alt, tt.ok)
+		}
+	}
+}
+
+func TestAltTransportHTTPSOriginIgnoresPlainAlternate(t *testing.T) {
+	srv := &Server{Handler: protoHandler}
+	listen(t, srv, nil)
+	waitFor(t, "the server to listen", func() bool { return srv.port() != 0 })
+	ts := httptest.NewTLSServer(&Advertiser{Handler: protoHandler, Server: srv})
+	defer ts.Close()
+
+	at := &AltTransport{HTTP: ts.Client().Transport}
+	defer at.CloseIdleConnections()
+	for i := 0; i < 2; i++ {
+		if got := altGet(t, at, "GET", ts.URL+"/", ""); got != "http" {
+			t.Errorf("request %d to an https origin went over %q to a plain alternate", i, got)
+		}
+	}
+}
+
+func TestAltTransportStreamFailures(t *testing.T) {
+	srv := &Server{
+		Logger:               testLogger(new(logBuffer)),
+		MaxStreamBufferBytes: 16,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/" {
+				protoHandler(w, req)
+				return
+			}
+			// Leave the body unread, and the request unanswered.
+			<-req.Context().Done()
+		}),
+	}
+	listen(t, srv, nil)
+	waitFor(t, "the server to listen", func() bool { return srv.port() != 0 })
+	var fallbacks atomic.Int32
+	ts := httptest.NewServer(&Advertiser{Server: srv, Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			fallbacks.Add(1)
+		}
+		protoHandler(w, req)
+	})})
+	defer ts.Close()
+
+	at := &AltTransport{}
+	defer at.CloseIdleConnections()
+	altGet(t, at, "GET", ts.URL+"/", "")
+	if got := altGet(t, at, "GET", ts.URL+"/", ""); got != "spdy" {
+		t.Fatalf("request went over %q, want spdy", got)
+	}
+
+	// The alternate resets a stream whose body overflows its buffer.
+	req, _ := http.NewRequest("POST", ts.URL+"/reset", strings.NewReader(strings.Repeat("x", 1024)))
+	if _, err := at.RoundTrip(req); !errors.As(err, new(StreamError)) {
+		t.Errorf("POST to a resetting alternate = %v, want a StreamError", err)
+	}
+
+	// The request is canceled while the alternate works on it.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, "GET", ts.URL+"/slow", nil)
+	if _, err := at.RoundTrip(req); err == nil {
+		t.Error("canceled request succeeded")
+	}
+
+	if n := fallbacks.Load(); n != 0 {
+		t.Errorf("%d requests fell back to HTTP/1.x", n)
+	}
+	if got := altGet(t, at, "GET", ts.URL+"/", ""); got != "spdy" {
+		t.Errorf("after the failures, request went over %q; the alternate was marked broken", got)
+	}
+}
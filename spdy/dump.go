@@ -0,0 +1,137 @@
+// spdy/dump.go
+
+package spdy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DumpFrame writes a readable description of f to w: a line for the frame
+// and indented lines for its fields and headers.  hr decompresses header
+// blocks.  The compression context spans a connection, so hr must have
+// decoded every earlier header block sent in the same direction, and the
+// two directions of a connection need separate readers.  An error is
+// returned for a malformed frame or a header block that cannot be decoded,
+// after which hr is unusable.
+func DumpFrame(w io.Writer, f Frame, hr *HeaderReader) error {
+	if !f.IsControl() {
+		_, err := fmt.Fprintf(w, "DATA stream=%d flags=%s length=%d\n", f.StreamId(), dumpFlags(f), len(f.Data))
+		return err
+	}
+	version := int(f.Header[0]&0x7f)<<8 | int(f.Header[1])
+	if _, err := fmt.Fprintf(w, "%v version=%d flags=%s length=%d\n", f.Type(), version, dumpFlags(f), len(f.Data)); err != nil {
+		return err
+	}
+	d := f.Data
+	short := func(n int) error {
+		if len(d) >= n {
+			return nil
+		}
+		fmt.Fprintf(w, "  (%d bytes, too short for %v)\n", len(d), f.Type())
+		return errors.New("spdy: short " + f.Type().String())
+	}
+	switch f.Type() {
+	case TypeSynStream:
+		if err := short(10); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  stream=%d assoc=%d priority=%d\n", id31(d[0:4]), id31(d[4:8]), d[8]>>6)
+		return dumpHeaders(w, hr, d[10:])
+	case TypeSynReply, TypeHeaders:
+		if err := short(6); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  stream=%d\n", id31(d[0:4]))
+		return dumpHeaders(w, hr, d[6:])
+	case TypeRstStream:
+		if err := short(8); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  stream=%d status=%v\n", id31(d[0:4]), RstStreamStatus(binary.BigEndian.Uint32(d[4:8])))
+	case TypeSettings:
+		settings, err := DecodeSettings(version, d)
+		if err != nil {
+			fmt.Fprintf(w, "  (%v)\n", err)
+			return err
+		}
+		for _, s := range settings {
+			fmt.Fprintf(w, "  %v=%d", s.Id, s.Value)
+			if s.Flags != 0 {
+				fmt.Fprintf(w, " flags=%#x", s.Flags)
+			}
+			fmt.Fprintln(w)
+		}
+	case TypePing:
+		if err := short(4); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  id=%d\n", binary.BigEndian.Uint32(d[0:4]))
+	case TypeGoaway:
+		if err := short(4); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  last-good-stream=%d\n", id31(d[0:4]))
+	case TypeWindowUpdate:
+		if err := short(8); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  stream=%d delta=%d\n", id31(d[0:4]), id31(d[4:8]))
+	}
+	return nil
+}
+
+func id31(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b) & 0x7fffffff
+}
+
+// dumpFlags names the flags that f's type defines.
+func dumpFlags(f Frame) string {
+	var names []string
+	flags := f.Flags
+	switch {
+	case f.IsControl() && f.Type() == TypeSettings:
+		if flags&FlagClearPreviouslyPersistedSettings != 0 {
+			names = append(names, "CLEAR_SETTINGS")
+			flags &^= FlagClearPreviouslyPersistedSettings
+		}
+	case !f.IsControl() || f.Type() == TypeSynStream || f.Type() == TypeSynReply || f.Type() == TypeHeaders:
+		if flags&FlagFin != 0 {
+			names = append(names, "FIN")
+			flags &^= FlagFin
+		}
+		if flags&FlagUnidirectional != 0 && f.IsControl() && f.Type() == TypeSynStream {
+			names = append(names, "UNIDIRECTIONAL")
+			flags &^= FlagUnidirectional
+		}
+	}
+	if flags != 0 || len(names) == 0 {
+		names = append(names, fmt.Sprintf("%#x", uint8(flags)))
+	}
+	return strings.Join(names, "|")
+}
+
+// dumpHeaders decodes a header block and writes its headers, sorted by
+// name, in the lower case they have on the wire.
+func dumpHeaders(w io.Writer, hr *HeaderReader, block []byte) error {
+	h, err := hr.Decode(block)
+	if err != nil {
+		fmt.Fprintf(w, "  (header block: %v)\n", err)
+		return err
+	}
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			fmt.Fprintf(w, "  %s: %s\n", strings.ToLower(name), v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// spdy/dump_test.go
+
+package spdy
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestDumpFrame(t *testing.T) {
+	hw, hr := NewHeaderWriter(-1), NewHeaderReader()
+	frames := []Frame{
+		synStream(hw, 1, 2, FlagFin, http.Header{"Method": {"GET"}, "Url": {"/"}, "Accept": {"a", "b"}}),
+		DataFrame(3, FlagFin, []byte("hello")),
+		RstStreamFrame(5, Cancel),
+		SettingsFrame(0, Settings{{Id: SettingsMaxConcurrentStreams, Flags: FlagSettingsPersistValue, Value: 100}}),
+		WindowUpdateFrame(1, 4096),
+		GoawayFrame(7),
+	}
+	buf := new(bytes.Buffer)
+	for _, f := range frames {
+		if err := DumpFrame(buf, f, hr); err != nil {
+			t.Fatalf("DumpFrame(%v): %v", f.Type(), err)
+		}
+	}
+	want := `SYN_STREAM version=2 flags=FIN length=` + strconv.Itoa(len(frames[0].Data)) + `
+  stream=1 assoc=0 priority=2
+  accept: a
+  accept: b
+  method: GET
+  url: /
+DATA stream=3 flags=FIN length=5
+RST_STREAM version=2 flags=0x0 length=8
+  stream=5 status=CANCEL
+SETTINGS version=2 flags=0x0 length=12
+  MAX_CONCURRENT_STREAMS=100 flags=0x1
+WINDOW_UPDATE version=2 flags=0x0 length=8
+  stream=1 delta=4096
+GOAWAY version=2 flags=0x0 length=4
+  last-good-stream=7
+`
+	if got := buf.String(); got != want {
+		t.Errorf("dump:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := DumpFrame(buf, ControlFrame(TypeSynReply, 0, []byte{0, 0}), hr); err == nil {
+		t.Errorf("short SYN_REPLY dumped without error:\n%s", buf)
+	}
+}
@@ -0,0 +1,224 @@
+// spdy/metrics.go
+
+package spdy
+
+import (
+	"encoding/binary"
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are published through expvar as the map "spdy", and so appear at
+// /debug/vars.  They add up the activity of every Server in the process:
+//
+//	sessions                  open sessions
+//	sessions_total            sessions accepted
+//	streams                   open streams
+//	streams_total             streams accepted
+//	frames_in, frames_out     frames by type; data frames count as "DATA"
+//	bytes_in, bytes_out       frame bytes, including the 8-byte frame headers
+//	rst_stream_in             RST_STREAMs received, by status
+//	rst_stream_out            RST_STREAMs sent, by status
+//	goaway_in, goaway_out     GOAWAYs received and sent
+//	header_bytes              header block sizes, compressed and not, by direction
+//	header_compression_ratio  compressed size over uncompressed size, by direction
+//	stream_duration           how long streams stayed open, in seconds
+//	session_list              per-session counters for every open session
+var (
+	metrics = expvar.NewMap("spdy")
+
+	metricSessions      = new(expvar.Int)
+	metricSessionsTotal = new(expvar.Int)
+	metricStreams       = new(expvar.Int)
+	metricStreamsTotal  = new(expvar.Int)
+	metricFramesIn      = new(expvar.Map).Init()
+	metricFramesOut     = new(expvar.Map).Init()
+	metricBytesIn       = new(expvar.Int)
+	metricBytesOut      = new(expvar.Int)
+	metricRstIn         = new(expvar.Map).Init()
+	metricRstOut        = new(expvar.Map).Init()
+	metricGoawayIn      = new(expvar.Int)
+	metricGoawayOut     = new(expvar.Int)
+	metricHeaderBytes   = new(expvar.Map).Init()
+	metricStreamTime    = newDurationHistogram(.001, .01, .1, 1, 10, 60)
+)
+
+func init() {
+	metrics.Set("sessions", metricSessions)
+	metrics.Set("sessions_total", metricSessionsTotal)
+	metrics.Set("streams", metricStreams)
+	metrics.Set("streams_total", metricStreamsTotal)
+	metrics.Set("frames_in", metricFramesIn)
+	metrics.Set("frames_out", metricFramesOut)
+	metrics.Set("bytes_in", metricBytesIn)
+	metrics.Set("bytes_out", metricBytesOut)
+	metrics.Set("rst_stream_in", metricRstIn)
+	metrics.Set("rst_stream_out", metricRstOut)
+	metrics.Set("goaway_in", metricGoawayIn)
+	metrics.Set("goaway_out", metricGoawayOut)
+	metrics.Set("header_bytes", metricHeaderBytes)
+	metrics.Set("header_compression_ratio", expvar.Func(headerCompressionRatio))
+	metrics.Set("stream_duration", metricStreamTime)
+	metrics.Set("session_list", expvar.Func(sessionList))
+}
+
+// countFrame records a frame received (in is true) or sent by sess.
+func countFrame(sess *session, f Frame, in bool) {
+	frames, bytes, rst, goaway := metricFramesOut, metricBytesOut, metricRstOut, metricGoawayOut
+	sessFrames, sessBytes := &sess.framesOut, &sess.bytesOut
+	if in {
+		frames, bytes, rst, goaway = metricFramesIn, metricBytesIn, metricRstIn, metricGoawayIn
+		sessFrames, sessBytes = &sess.framesIn, &sess.bytesIn
+	}
+	n := int64(len(f.Header) + len(f.Data))
+	sessFrames.Add(1)
+	sessBytes.Add(n)
+	bytes.Add(n)
+	if !f.IsControl() {
+		frames.Add("DATA", 1)
+		return
+	}
+	frames.Add(f.Type().String(), 1)
+	switch f.Type() {
+	case TypeRstStream:
+		if len(f.Data) == 8 {
+			rst.Add(RstStreamStatus(binary.BigEndian.Uint32(f.Data[4:8])).String(), 1)
+		}
+	case TypeGoaway:
+		goaway.Add(1)
+	}
+}
+
+// countHeaders records the size of a header block before and after
+// compression.  dir is "in" or "out".
+func countHeaders(dir string, h http.Header, compressed int) {
+	metricHeaderBytes.Add(dir+"_compressed", int64(compressed))
+	metricHeaderBytes.Add(dir+"_uncompressed", int64(headerBlockSize(h)))
+}
+
+// headerBlockSize returns the uncompressed size of h's header block.
+func headerBlockSize(h http.Header) int {
+	n := 2
+	for k, vals := range h {
+		n += 2 + len(k) + 2 + len(vals) - 1
+		for _, v := range vals {
+			n += len(v)
+		}
+	}
+	return n
+}
+
+func headerCompressionRatio() any {
+	ratio := make(map[string]float64)
+	for _, dir := range []string{"in", "out"} {
+		c, _ := metricHeaderBytes.Get(dir + "_compressed").(*expvar.Int)
+		u, _ := metricHeaderBytes.Get(dir + "_uncompressed").(*expvar.Int)
+		if c != nil && u != nil && u.Value() > 0 {
+			ratio[dir] = float64(c.Value()) / float64(u.Value())
+		}
+	}
+	return ratio
+}
+
+// liveSessions holds every open session of every Server for session_list.
+var liveSessions struct {
+	sync.Mutex
+	m map[*session]struct{}
+}
+
+// trackLive adds sess to or removes it from the session gauges and
+// session_list.
+func trackLive(sess *session, add bool) {
+	liveSessions.Lock()
+	defer liveSessions.Unlock()
+	if !add {
+		if _, ok := liveSessions.m[sess]; ok {
+			delete(liveSessions.m, sess)
+			metricSessions.Add(-1)
+		}
+		return
+	}
+	if liveSessions.m == nil {
+		liveSessions.m = make(map[*session]struct{})
+	}
+	liveSessions.m[sess] = struct{}{}
+	metricSessions.Add(1)
+	metricSessionsTotal.Add(1)
+}
+
+func sessionList() any {
+	liveSessions.Lock()
+	infos := make([]SessionInfo, 0, len(liveSessions.m))
+	for sess := range liveSessions.m {
+		infos = append(infos, sess.info())
+	}
+	liveSessions.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created.Before(infos[j].Created) })
+
+	list := make([]map[string]any, len(infos))
+	for i, info := range infos {
+		list[i] = map[string]any{
+			"id":         info.ID,
+			"remote":     info.RemoteAddr.String(),
+			"state":      info.State.String(),
+			"streams":    info.Streams,
+			"created":    info.Created,
+			"rtt":        info.RTT.Seconds(),
+			"frames_in":  info.FramesIn,
+			"frames_out": info.FramesOut,
+			"bytes_in":   info.BytesIn,
+			"bytes_out":  info.BytesOut,
+		}
+	}
+	return list
+}
+
+// A durationHistogram counts durations into buckets by upper bound, in
+// seconds.  It is an expvar.Var.
+type durationHistogram struct {
+	bounds []float64
+	counts []atomic.Int64 // the last bucket counts durations beyond every bound
+	count  atomic.Int64
+	sum    atomic.Int64 // nanoseconds
+}
+
+func newDurationHistogram(bounds ...float64) *durationHistogram {
+	return &durationHistogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+}
+
+func (dh *durationHistogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(dh.bounds, d.Seconds())
+	dh.counts[i].Add(1)
+	dh.count.Add(1)
+	dh.sum.Add(int64(d))
+}
+
+// String returns the histogram as a JSON object with the total count, the
+// sum in seconds and a cumulative count for each bucket.
+func (dh *durationHistogram) String() string {
+	b := []byte(`{"count": `)
+	b = strconv.AppendInt(b, dh.count.Load(), 10)
+	b = append(b, `, "sum": `...)
+	b = strconv.AppendFloat(b, time.Duration(dh.sum.Load()).Seconds(), 'g', -1, 64)
+	b = append(b, `, "buckets": {`...)
+	var cum int64
+	for i := range dh.counts {
+		cum += dh.counts[i].Load()
+		le := "+Inf"
+		if i < len(dh.bounds) {
+			le = strconv.FormatFloat(dh.bounds[i], 'g', -1, 64)
+		}
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = strconv.AppendQuote(b, le)
+		b = append(b, ": "...)
+		b = strconv.AppendInt(b, cum, 10)
+	}
+	return string(append(b, "}}"...))
+}
@@ -0,0 +1,124 @@
+// spdy/metrics_test.go
+
+package spdy
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// readVars decodes the "spdy" expvar map as it would appear at /debug/vars.
+func readVars(t *testing.T) map[string]any {
+	var m map[string]any
+	if err := json.Unmarshal([]byte(expvar.Get("spdy").String()), &m); err != nil {
+		t.Fatalf("spdy vars are not JSON: %v", err)
+	}
+	return m
+}
+
+// varInt returns the counter at path in vars, or zero if it is absent.
+func varInt(vars map[string]any, path ...string) int64 {
+	var v any = vars
+	for _, key := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return 0
+		}
+		v = m[key]
+	}
+	n, _ := v.(float64)
+	return int64(n)
+}
+
+func TestMetrics(t *testing.T) {
+	before := readVars(t)
+	c, r := testConn(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	synStream(NewHeaderWriter(-1), 1, 0, FlagFin, getHeader("http://example.com/")).WriteTo(c)
+	readResponse(t, r, NewHeaderReader(), 1)
+	RstStreamFrame(9, Cancel).WriteTo(c)
+
+	var during map[string]any
+	waitFor(t, "stream metrics", func() bool {
+		during = readVars(t)
+		return varInt(during, "stream_duration", "count") > varInt(before, "stream_duration", "count")
+	})
+	for _, path := range [][]string{
+		{"streams_total"},
+		{"frames_in", "SYN_STREAM"},
+		{"frames_in", "RST_STREAM"},
+		{"frames_out", "SYN_REPLY"},
+		{"frames_out", "DATA"},
+		{"rst_stream_in", "CANCEL"},
+		{"header_bytes", "in_compressed"},
+		{"header_bytes", "out_uncompressed"},
+	} {
+		if varInt(during, path...) <= varInt(before, path...) {
+			t.Errorf("%v did not increase", path)
+		}
+	}
+	if varInt(during, "bytes_out")-varInt(before, "bytes_out") < 8+2 {
+		t.Errorf("bytes_out grew by less than one DATA frame")
+	}
+	ratio, _ := during["header_compression_ratio"].(map[string]any)
+	if r, _ := ratio["out"].(float64); r <= 0 {
+		t.Errorf("header_compression_ratio = %v, want a positive ratio out", ratio)
+	}
+
+	// The session goes idle just after its last stream is counted.
+	waitFor(t, "idle session in session_list", func() bool {
+		list, _ := readVars(t)["session_list"].([]any)
+		for _, s := range list {
+			s := s.(map[string]any)
+			if s["state"] == "idle" && varInt(s, "frames_in") == 2 && varInt(s, "frames_out") >= 3 {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestSchedulerHeadersNotCounted(t *testing.T) {
+	// Client sessions share the scheduler; only server sessions count
+	// header bytes, from their sent hook.
+	before := readVars(t)
+	s := newFrameScheduler(io.Discard, NewHeaderWriter(-1))
+	s.writeControl(queuedFrame{frame: ControlFrame(TypeSynStream, 0, make([]byte, 10)), header: getHeader("http://example.com/")})
+	s.drain()
+	s.run()
+	after := readVars(t)
+	for _, key := range []string{"out_compressed", "out_uncompressed"} {
+		if varInt(after, "header_bytes", key) != varInt(before, "header_bytes", key) {
+			t.Errorf("header_bytes %s changed", key)
+		}
+	}
+}
+
+func TestDurationHistogram(t *testing.T) {
+	dh := newDurationHistogram(.01, 1)
+	for _, d := range []time.Duration{time.Millisecond, 10 * time.Millisecond, 500 * time.Millisecond, 2 * time.Second} {
+		dh.observe(d)
+	}
+	var got struct {
+		Count   int64
+		Sum     float64
+		Buckets map[string]int64
+	}
+	if err := json.Unmarshal([]byte(dh.String()), &got); err != nil {
+		t.Fatalf("String() = %s: %v", dh, err)
+	}
+	if got.Count != 4 || got.Sum != 2.511 {
+		t.Errorf("count, sum = %d, %v; want 4, 2.511", got.Count, got.Sum)
+	}
+	want := map[string]int64{"0.01": 2, "1": 3, "+Inf": 4}
+	for le, n := range want {
+		if got.Buckets[le] != n {
+			t.Errorf("bucket %s = %d, want %d", le, got.Buckets[le], n)
+		}
+	}
+}
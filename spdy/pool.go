@@ -0,0 +1,110 @@
+// spdy/pool.go
+
+package spdy
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// An originPool holds a Transport's sessions to one origin.  Requests share
+// the first session with a free stream; another session is dialed only when
+// every one has as many streams open as its server allows.
+type originPool struct {
+	origin     string
+	serverName string           // the TLS server name, if not origin's host
+	sessions   []*clientSession // usable for new requests; protected by Transport.mu
+	dial       *dialCall        // the dial in progress, if any; protected by Transport.mu
+
+	requests   atomic.Int64
+	dials      atomic.Int64
+	dialErrors atomic.Int64
+	goaways    atomic.Int64
+	idleClosed atomic.Int64
+
+	pushes pushCache
+}
+
+// A poolKey identifies an originPool.
+type poolKey struct {
+	origin, serverName string
+}
+
+// OriginStats describes a Transport's sessions to one origin.  The push
+// counts stay zero without Transport.AcceptPush.
+type OriginStats struct {
+	Origin     string // scheme://host:port
+	ServerName string // name certificates are checked for, if not Origin's host
+	Sessions   int    // sessions taking new requests
+	Streams    int    // streams open on those sessions
+	Requests   int64  // requests sent, counting retries
+	Dials      int64  // sessions dialed
+	DialErrors int64  // dials that failed
+	GoAways    int64  // sessions dropped because the server sent GOAWAY
+	IdleClosed int64  // sessions closed after Transport.IdleTimeout
+	Pushes     int64  // pushed streams accepted
+	PushHits   int64  // GETs answered from the push cache
+	PushMisses int64  // GETs the push cache could not answer
+}
+
+// Stats returns a snapshot of the Transport's sessions for every origin it
+// has connected to, sorted by origin.
+func (t *Transport) Stats() []OriginStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make([]OriginStats, 0, len(t.pools))
+	for _, pool := range t.pools {
+		s := OriginStats{
+			Origin:     pool.origin,
+			ServerName: pool.serverName,
+			Sessions:   len(pool.sessions),
+			Requests:   pool.requests.Load(),
+			Dials:      pool.dials.Load(),
+			DialErrors: pool.dialErrors.Load(),
+			GoAways:    pool.goaways.Load(),
+			IdleClosed: pool.idleClosed.Load(),
+			Pushes:     pool.pushes.pushes.Load(),
+			PushHits:   pool.pushes.hits.Load(),
+			PushMisses: pool.pushes.misses.Load(),
+		}
+		for _, sess := range pool.sessions {
+			s.Streams += sess.numStreams()
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Origin != stats[j].Origin {
+			return stats[i].Origin < stats[j].Origin
+		}
+		return stats[i].ServerName < stats[j].ServerName
+	})
+	return stats
+}
+
+// pool returns the pool for origin whose TLS sessions are verified for
+// serverName, creating it if needed.  t.mu must be held.
+func (t *Transport) pool(origin, serverName string) *originPool {
+	key := poolKey{origin, serverName}
+	pool := t.pools[key]
+	if pool == nil {
+		pool = &originPool{origin: origin, serverName: serverName}
+		if t.pools == nil {
+			t.pools = make(map[poolKey]*originPool)
+		}
+		t.pools[key] = pool
+	}
+	return pool
+}
+
+// removeLocked drops sess from its pool and reports whether it was there.
+// t.mu must be held.
+func (t *Transport) removeLocked(sess *clientSession) bool {
+	pool := sess.pool
+	for i, s := range pool.sessions {
+		if s == sess {
+			pool.sessions = append(pool.sessions[:i], pool.sessions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
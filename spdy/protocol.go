@@ -6,17 +6,18 @@
 //
 // The implementation follows draft 2 of the spec:
 // https://sites.google.com/a/chromium.org/dev/spdy/spdy-protocol/spdy-protocol-draft2
+// Connections upgraded from HTTP/1.1 may speak draft 3.1 instead.
 package spdy
 
 import (
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 )
 
 // Version is the protocol version number that this package implements.
@@ -75,6 +76,52 @@ const (
 	FlagClearPreviouslyPersistedSettings = 0x01
 )
 
+// RstStreamStatus is the status code carried by a RST_STREAM frame.
+type RstStreamStatus uint32
+
+// RST_STREAM status codes.  StreamInUse and later were added in SPDY/3.
+const (
+	ProtocolError       RstStreamStatus = 1
+	InvalidStream       RstStreamStatus = 2
+	RefusedStream       RstStreamStatus = 3
+	UnsupportedVersion  RstStreamStatus = 4
+	Cancel              RstStreamStatus = 5
+	InternalError       RstStreamStatus = 6
+	FlowControlError    RstStreamStatus = 7
+	StreamInUse         RstStreamStatus = 8
+	StreamAlreadyClosed RstStreamStatus = 9
+	InvalidCredentials  RstStreamStatus = 10
+	FrameTooLarge       RstStreamStatus = 11
+)
+
+func (s RstStreamStatus) String() string {
+	switch s {
+	case ProtocolError:
+		return "PROTOCOL_ERROR"
+	case InvalidStream:
+		return "INVALID_STREAM"
+	case RefusedStream:
+		return "REFUSED_STREAM"
+	case UnsupportedVersion:
+		return "UNSUPPORTED_VERSION"
+	case Cancel:
+		return "CANCEL"
+	case InternalError:
+		return "INTERNAL_ERROR"
+	case FlowControlError:
+		return "FLOW_CONTROL_ERROR"
+	case StreamInUse:
+		return "STREAM_IN_USE"
+	case StreamAlreadyClosed:
+		return "STREAM_ALREADY_CLOSED"
+	case InvalidCredentials:
+		return "INVALID_CREDENTIALS"
+	case FrameTooLarge:
+		return "FRAME_TOO_LARGE"
+	}
+	return "Status(" + strconv.Itoa(int(s)) + ")"
+}
+
 // MaxDataLength is the maximum number of bytes that can be stored in one frame.
 const MaxDataLength = 1<<24 - 1
 
@@ -114,6 +161,39 @@ func DataFrame(streamId uint32, f FrameFlags, data []byte) Frame {
 	}
 }
 
+// RstStreamFrame creates a RST_STREAM frame that aborts a stream.
+func RstStreamFrame(streamId uint32, status RstStreamStatus) Frame {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:4], streamId&0x7fffffff)
+	binary.BigEndian.PutUint32(data[4:8], uint32(status))
+	return ControlFrame(TypeRstStream, 0, data)
+}
+
+// GoawayFrame creates a GOAWAY frame.  lastGoodStreamId is the last stream
+// the sender accepted; streams with higher IDs were not processed.
+func GoawayFrame(lastGoodStreamId uint32) Frame {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, lastGoodStreamId&0x7fffffff)
+	return ControlFrame(TypeGoaway, 0, data)
+}
+
+// PingFrame creates a PING frame.  Clients use odd IDs and servers use
+// even IDs.
+func PingFrame(id uint32) Frame {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, id)
+	return ControlFrame(TypePing, 0, data)
+}
+
+// WindowUpdateFrame creates a WINDOW_UPDATE frame that lets the peer send
+// delta more bytes on a stream.
+func WindowUpdateFrame(streamId uint32, delta uint32) Frame {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:4], streamId&0x7fffffff)
+	binary.BigEndian.PutUint32(data[4:8], delta&0x7fffffff)
+	return ControlFrame(TypeWindowUpdate, 0, data)
+}
+
 // ReadFrame reads an entire frame into memory.
 func ReadFrame(r io.Reader) (f Frame, err error) {
 	_, err = io.ReadFull(r, f.Header[:])
@@ -223,81 +303,106 @@ const headerDictionary = "optionsgetheadpostputdeletetrace" +
 	"charset=iso-8859-1utf-8gzipdeflateHTTP/1.1statusversionurl\x00"
 
 // hrSource is a reader that passes through reads from another reader.
-// When the underlying reader reaches EOF, Read will block until another reader is added via change.
+// Once the underlying reader reaches EOF, Read fails with
+// io.ErrUnexpectedEOF until another reader is added via change, so a header
+// block that ends early is reported rather than waited for.
 type hrSource struct {
 	r io.Reader
-	m sync.RWMutex
-	c *sync.Cond
 }
 
 func (src *hrSource) Read(p []byte) (n int, err error) {
-	src.m.RLock()
-	for src.r == nil {
-		src.c.Wait()
+	if src.r == nil {
+		return 0, io.ErrUnexpectedEOF
 	}
 	n, err = src.r.Read(p)
-	src.m.RUnlock()
 	if err == io.EOF {
-		src.change(nil)
+		src.r = nil
 		err = nil
+		if n == 0 {
+			err = io.ErrUnexpectedEOF
+		}
 	}
 	return
 }
 
 func (src *hrSource) change(r io.Reader) {
-	src.m.Lock()
-	defer src.m.Unlock()
 	src.r = r
-	src.c.Broadcast()
 }
 
-// A HeaderReader reads zlib-compressed headers.
+// A HeaderReader reads zlib-compressed headers.  The compression context
+// spans all the header blocks read, so once a block fails to decode, the
+// HeaderReader returns the same error for every later block.
 type HeaderReader struct {
+	version      int
 	source       hrSource
 	decompressor io.ReadCloser
+	err          error
 }
 
 // NewHeaderReader creates a HeaderReader with the initial dictionary.
 func NewHeaderReader() (hr *HeaderReader) {
-	hr = new(HeaderReader)
-	hr.source.c = sync.NewCond(hr.source.m.RLocker())
-	return
+	return newHeaderReader(Version)
 }
 
-// ReadHeader reads a set of headers from a reader.
+// newHeaderReader creates a HeaderReader for the given protocol version.
+// SPDY/3 header blocks are returned with the SPDY/2 names of the special
+// headers; see fromHeaders3.
+func newHeaderReader(version int) *HeaderReader {
+	return &HeaderReader{version: version}
+}
+
+// ReadHeader reads a set of headers from a reader.  A header block that
+// ends before r does is an error.
 func (hr *HeaderReader) ReadHeader(r io.Reader) (h http.Header, err error) {
 	hr.source.change(r)
-	h, err = hr.read()
-	return
+	return hr.readBlock()
 }
 
-// Decode reads a set of headers from a block of bytes.
+// Decode reads a set of headers from a block of bytes.  A short or corrupt
+// block is an error.
 func (hr *HeaderReader) Decode(data []byte) (h http.Header, err error) {
-	hr.source.change(bytes.NewBuffer(data))
+	hr.source.change(bytes.NewReader(data))
+	return hr.readBlock()
+}
+
+func (hr *HeaderReader) readBlock() (h http.Header, err error) {
+	if hr.err != nil {
+		return nil, hr.err
+	}
 	h, err = hr.read()
-	return
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		hr.err = fmt.Errorf("spdy: malformed header block: %w", err)
+		return nil, hr.err
+	}
+	return h, nil
 }
 
 func (hr *HeaderReader) read() (h http.Header, err error) {
-	var count uint16
 	if hr.decompressor == nil {
-		hr.decompressor, err = zlib.NewReaderDict(&hr.source, []byte(headerDictionary))
+		dict := []byte(headerDictionary)
+		if hr.version >= version3 {
+			dict = headerDictionary3
+		}
+		hr.decompressor, err = zlib.NewReaderDict(&hr.source, dict)
 		if err != nil {
 			return
 		}
 	}
-	err = binary.Read(hr.decompressor, binary.BigEndian, &count)
+	count, err := hr.readLength()
 	if err != nil {
 		return
 	}
-	h = make(http.Header, int(count))
-	for i := 0; i < int(count); i++ {
+	h = make(http.Header, min(count, 64))
+	for i := 0; i < count; i++ {
 		var name, value string
-		name, err = readHeaderString(hr.decompressor)
+		name, err = hr.readString()
 		if err != nil {
 			return
 		}
-		value, err = readHeaderString(hr.decompressor)
+		value, err = hr.readString()
 		if err != nil {
 			return
 		}
@@ -306,17 +411,36 @@ func (hr *HeaderReader) read() (h http.Header, err error) {
 			h.Add(name, v)
 		}
 	}
+	if hr.version >= version3 {
+		fromHeaders3(h)
+	}
 	return
 }
 
-func readHeaderString(r io.Reader) (s string, err error) {
-	var length uint16
-	err = binary.Read(r, binary.BigEndian, &length)
+// readLength reads a count or length field: 16 bits in SPDY/2 and 32 bits
+// from SPDY/3 on.
+func (hr *HeaderReader) readLength() (int, error) {
+	if hr.version >= version3 {
+		var n uint32
+		err := binary.Read(hr.decompressor, binary.BigEndian, &n)
+		if n > MaxDataLength {
+			// Longer than any frame could carry compressed.
+			return 0, fmt.Errorf("length %d too large", n)
+		}
+		return int(n), err
+	}
+	var n uint16
+	err := binary.Read(hr.decompressor, binary.BigEndian, &n)
+	return int(n), err
+}
+
+func (hr *HeaderReader) readString() (s string, err error) {
+	length, err := hr.readLength()
 	if err != nil {
 		return
 	}
-	data := make([]byte, int(length))
-	_, err = io.ReadFull(r, data)
+	data := make([]byte, length)
+	_, err = io.ReadFull(hr.decompressor, data)
 	if err != nil {
 		return
 	}
@@ -325,14 +449,26 @@ func readHeaderString(r io.Reader) (s string, err error) {
 
 // HeaderWriter will write zlib-compressed headers on different streams.
 type HeaderWriter struct {
+	version    int
 	compressor *zlib.Writer
 	buffer     *bytes.Buffer
 }
 
 // NewHeaderWriter creates a HeaderWriter ready to compress headers.
 func NewHeaderWriter(level int) (hw *HeaderWriter) {
-	hw = &HeaderWriter{buffer: new(bytes.Buffer)}
-	hw.compressor, _ = zlib.NewWriterLevelDict(hw.buffer, level, []byte(headerDictionary))
+	return newHeaderWriter(level, Version)
+}
+
+// newHeaderWriter creates a HeaderWriter for the given protocol version.
+// It takes headers with the SPDY/2 names of the special headers; see
+// toHeaders3.
+func newHeaderWriter(level, version int) (hw *HeaderWriter) {
+	hw = &HeaderWriter{version: version, buffer: new(bytes.Buffer)}
+	dict := []byte(headerDictionary)
+	if version >= version3 {
+		dict = headerDictionary3
+	}
+	hw.compressor, _ = zlib.NewWriterLevelDict(hw.buffer, level, dict)
 	return
 }
 
@@ -353,14 +489,27 @@ func (hw *HeaderWriter) Encode(h http.Header) (data []byte) {
 }
 
 func (hw *HeaderWriter) write(h http.Header) {
-	binary.Write(hw.compressor, binary.BigEndian, uint16(len(h)))
+	if hw.version >= version3 {
+		h = toHeaders3(h)
+	}
+	hw.writeLength(len(h))
 	for k, vals := range h {
 		k = strings.ToLower(k)
-		binary.Write(hw.compressor, binary.BigEndian, uint16(len(k)))
-		binary.Write(hw.compressor, binary.BigEndian, []byte(k))
+		hw.writeLength(len(k))
+		hw.compressor.Write([]byte(k))
 		v := strings.Join(vals, "\x00")
-		binary.Write(hw.compressor, binary.BigEndian, uint16(len(v)))
-		binary.Write(hw.compressor, binary.BigEndian, []byte(v))
+		hw.writeLength(len(v))
+		hw.compressor.Write([]byte(v))
 	}
 	hw.compressor.Flush()
 }
+
+// writeLength writes a count or length field: 16 bits in SPDY/2 and 32
+// bits from SPDY/3 on.
+func (hw *HeaderWriter) writeLength(n int) {
+	if hw.version >= version3 {
+		binary.Write(hw.compressor, binary.BigEndian, uint32(n))
+	} else {
+		binary.Write(hw.compressor, binary.BigEndian, uint16(n))
+	}
+}
@@ -7,9 +7,11 @@ package spdy
 import (
 	"bytes"
 	"compress/zlib"
+	"encoding/binary"
 	"io"
 	"net/http"
 	"testing"
+	"time"
 )
 
 type frameIoTest struct {
@@ -257,3 +259,96 @@ func TestWriteHeader(t *testing.T) {
 		}
 	}
 }
+
+func TestHeaders3(t *testing.T) {
+	block := newHeaderWriter(-1, 3).Encode(http.Header{
+		"Method":  {"GET"},
+		"Url":     {"https://example.com/a?b"},
+		"Version": {"HTTP/1.1"},
+		"Host":    {"example.com"},
+		"Accept":  {"text/plain", "text/html"},
+	})
+
+	// On the wire, the special headers have their SPDY/3 names.
+	zr, err := zlib.NewReaderDict(bytes.NewReader(block), headerDictionary3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readString := func() string {
+		var n uint32
+		if err := binary.Read(zr, binary.BigEndian, &n); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(zr, b); err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	var count uint32
+	if err := binary.Read(zr, binary.BigEndian, &count); err != nil {
+		t.Fatal(err)
+	}
+	wire := make(map[string]string)
+	for i := 0; i < int(count); i++ {
+		name := readString()
+		wire[name] = readString()
+	}
+	want := map[string]string{
+		":method":  "GET",
+		":scheme":  "https",
+		":host":    "example.com",
+		":path":    "/a?b",
+		":version": "HTTP/1.1",
+		"accept":   "text/plain\x00text/html",
+	}
+	if len(wire) != len(want) {
+		t.Errorf("header block = %q, want %q", wire, want)
+	}
+	for k, v := range want {
+		if wire[k] != v {
+			t.Errorf("%s = %q, want %q", k, wire[k], v)
+		}
+	}
+
+	// Decoding restores the SPDY/2 names.
+	h, err := newHeaderReader(3).Decode(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 4 || h.Get("Method") != "GET" || h.Get("Url") != "https://example.com/a?b" ||
+		h.Get("Version") != "HTTP/1.1" || len(h.Values("Accept")) != 2 {
+		t.Errorf("decoded headers = %q", h)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		desc  string
+		block []byte
+	}{
+		{"empty", []byte{}},
+		{"truncated", headerDataTest[:len(headerDataTest)/2]},
+		{"corrupt", append(append([]byte(nil), headerDataTest[:2]...), bytes.Repeat([]byte{0xff}, 16)...)},
+	}
+	for _, tt := range tests {
+		r := NewHeaderReader()
+		done := make(chan error, 1)
+		go func() {
+			_, err := r.Decode(tt.block)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%s: Decode succeeded", tt.desc)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: Decode blocked", tt.desc)
+		}
+		// The decompressor is out of step; later blocks must fail too.
+		if _, err := r.Decode(headerDataTest); err == nil {
+			t.Errorf("%s: Decode after an error succeeded", tt.desc)
+		}
+	}
+}
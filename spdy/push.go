@@ -0,0 +1,122 @@
+// spdy/push.go
+
+package spdy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPushCacheEntries bounds the pushed responses kept for one origin.  The
+// oldest is dropped to make room for a new one.
+const maxPushCacheEntries = 32
+
+// A pushCache holds the responses a server pushed until requests for their
+// URLs claim them.  Each push answers one request.
+type pushCache struct {
+	mu      sync.Mutex
+	entries map[string]*pushEntry // by pushKey
+	order   []*pushEntry          // oldest first
+
+	pushes atomic.Int64 // pushes accepted
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type pushEntry struct {
+	key  string
+	st   *clientStream
+	resp *http.Response // without Body until claimed
+}
+
+// pushKey returns the cache key for u: its origin and request URI.
+func pushKey(u *url.URL) string {
+	return origin(u) + u.RequestURI()
+}
+
+// add caches the response of a pushed stream, replacing any earlier push of
+// the same URL.
+func (c *pushCache) add(st *clientStream, resp *http.Response) {
+	e := &pushEntry{key: pushKey(resp.Request.URL), st: st, resp: resp}
+	c.pushes.Add(1)
+	c.mu.Lock()
+	var evicted []*pushEntry
+	if old := c.entries[e.key]; old != nil {
+		c.removeLocked(old)
+		evicted = append(evicted, old)
+	}
+	if len(c.order) == maxPushCacheEntries {
+		old := c.order[0]
+		c.removeLocked(old)
+		evicted = append(evicted, old)
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*pushEntry)
+	}
+	c.entries[e.key] = e
+	c.order = append(c.order, e)
+	c.mu.Unlock()
+	// Resetting a stream drops it from the cache, so it is done unlocked.
+	for _, old := range evicted {
+		old.st.discard()
+	}
+}
+
+// take removes and returns the pushed response for req, or nil if there is
+// none.  The response's body is canceled with req's context.
+func (c *pushCache) take(req *http.Request) *http.Response {
+	c.mu.Lock()
+	e := c.entries[pushKey(req.URL)]
+	if e != nil {
+		c.removeLocked(e)
+	}
+	c.mu.Unlock()
+	if e == nil {
+		c.misses.Add(1)
+		return nil
+	}
+	c.hits.Add(1)
+	st, ctx := e.st, req.Context()
+	resp := e.resp
+	resp.Request = req
+	resp.Body = &clientBody{st: st, stop: context.AfterFunc(ctx, func() { st.sess.reset(st, Cancel, ctx.Err()) })}
+	return resp
+}
+
+// drop removes the entry for st, whose stream failed, if it is cached.
+func (c *pushCache) drop(st *clientStream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.order {
+		if e.st == st {
+			c.removeLocked(e)
+			return
+		}
+	}
+}
+
+func (c *pushCache) removeLocked(e *pushEntry) {
+	delete(c.entries, e.key)
+	for i, o := range c.order {
+		if o == e {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// pushed returns the response the server pushed for req, if there is one
+// and req may be answered from the push cache.  serverName is as for
+// roundTrip.
+func (t *Transport) pushed(req *http.Request, serverName string) *http.Response {
+	if t.AcceptPush == nil || (req.Method != "" && req.Method != "GET") || (req.Body != nil && req.Body != http.NoBody) {
+		return nil
+	}
+	t.mu.Lock()
+	pool := t.pool(origin(req.URL), serverName)
+	t.mu.Unlock()
+	return pool.pushes.take(req)
+}
@@ -0,0 +1,198 @@
+// spdy/push_test.go
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A testPush is a resource that pushServer pushes.
+type testPush struct {
+	url  string
+	body []byte
+}
+
+// pushServer runs a fake SPDY server, since Server does not push.  It
+// answers each request with the request's path; before answering the first
+// it pushes pushes, with stream IDs 2, 4 and so on.  The RST_STREAMs it
+// receives are sent on the returned channel.
+func pushServer(t *testing.T, pushes ...testPush) (addr string, rsts <-chan Frame) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ch := make(chan Frame, 16)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		hr, hw := NewHeaderReader(), NewHeaderWriter(-1)
+		for {
+			f, err := ReadFrame(r)
+			if err != nil {
+				return
+			}
+			switch f.Type() {
+			case TypeRstStream:
+				ch <- f
+			case TypeSynStream:
+				h, err := hr.Decode(f.Data[10:])
+				if err != nil {
+					t.Errorf("decoding SYN_STREAM: %v", err)
+					return
+				}
+				id := binary.BigEndian.Uint32(f.Data[0:4])
+				if id == 1 {
+					for i, p := range pushes {
+						pid := uint32(2 * (i + 1))
+						pushFrame(hw, pid, id, http.Header{"Url": {p.url}, "Status": {"200 OK"}, "Version": {"HTTP/1.1"}}).WriteTo(c)
+						for b := p.body; len(b) > 0; b = b[min(len(b), 32<<10):] {
+							DataFrame(pid, 0, b[:min(len(b), 32<<10)]).WriteTo(c)
+						}
+						DataFrame(pid, FlagFin, nil).WriteTo(c)
+					}
+				}
+				u, _ := url.Parse(h.Get("Url"))
+				data := binary.BigEndian.AppendUint32(nil, id)
+				data = append(data, 0, 0)
+				data = append(data, hw.Encode(http.Header{"Status": {"200 OK"}, "Version": {"HTTP/1.1"}})...)
+				ControlFrame(TypeSynReply, 0, data).WriteTo(c)
+				DataFrame(id, FlagFin, []byte(u.Path)).WriteTo(c)
+			}
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+// pushFrame returns a SYN_STREAM pushing stream id in association with
+// stream assoc.
+func pushFrame(hw *HeaderWriter, id, assoc uint32, h http.Header) Frame {
+	data := binary.BigEndian.AppendUint32(nil, id)
+	data = binary.BigEndian.AppendUint32(data, assoc)
+	data = append(data, 0, 0)
+	data = append(data, hw.Encode(h)...)
+	return ControlFrame(TypeSynStream, FlagUnidirectional, data)
+}
+
+// pushClient returns a client whose Transport reaches addr for every URL.
+func pushClient(t *testing.T, addr string, accept func(*url.URL, *http.Request) bool) (*http.Client, *Transport) {
+	tr := &Transport{
+		AcceptPush: accept,
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}, tr
+}
+
+func getBody(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: reading body: %v", url, err)
+	}
+	return resp, string(body)
+}
+
+func expectRst(t *testing.T, rsts <-chan Frame, id uint32, status RstStreamStatus) {
+	t.Helper()
+	select {
+	case f := <-rsts:
+		if gotID, got := rstFields(f); gotID != id || got != status {
+			t.Errorf("RST_STREAM %d %v, want %d %v", gotID, got, id, status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no RST_STREAM for stream %d", id)
+	}
+}
+
+func TestTransportPush(t *testing.T) {
+	addr, rsts := pushServer(t,
+		testPush{"http://example.com/style.css", []byte("pushed css")},
+		testPush{"http://example.com/app.js", []byte("pushed js")},
+		testPush{"http://other.example/style.css", []byte("pushed elsewhere")},
+	)
+	var offered []string
+	client, tr := pushClient(t, addr, func(u *url.URL, req *http.Request) bool {
+		if req.URL.Path != "/" {
+			t.Errorf("push of %s associated with %s, want /", u, req.URL)
+		}
+		if u.Host == "example.com" {
+			offered = append(offered, u.Path)
+		}
+		return !strings.HasSuffix(u.Path, ".js")
+	})
+	if _, body := getBody(t, client, "http://example.com/"); body != "/" {
+		t.Errorf("GET / = %q", body)
+	}
+	// The declined push and the one for another origin are reset.
+	expectRst(t, rsts, 4, Cancel)
+	expectRst(t, rsts, 6, Cancel)
+	if want := []string{"/style.css", "/app.js"}; strings.Join(offered, " ") != strings.Join(want, " ") {
+		t.Errorf("AcceptPush offered %v, want %v", offered, want)
+	}
+
+	resp, body := getBody(t, client, "http://example.com/style.css")
+	if body != "pushed css" || resp.StatusCode != 200 {
+		t.Errorf("GET /style.css = %d %q, want the pushed response", resp.StatusCode, body)
+	}
+	if resp.Request.URL.Path != "/style.css" || resp.Request.Header == nil {
+		t.Errorf("pushed response's Request = %+v, want the GET", resp.Request)
+	}
+	// A push answers one request.
+	if _, body := getBody(t, client, "http://example.com/style.css"); body != "/style.css" {
+		t.Errorf("second GET /style.css = %q, want the server's response", body)
+	}
+	if _, body := getBody(t, client, "http://example.com/app.js"); body != "/app.js" {
+		t.Errorf("GET /app.js = %q, want the server's response", body)
+	}
+	s := tr.Stats()[0]
+	if s.Pushes != 1 || s.PushHits != 1 || s.PushMisses != 3 {
+		t.Errorf("stats = %+v, want 1 push, 1 hit and 3 misses", s)
+	}
+}
+
+func TestTransportRefusesPushes(t *testing.T) {
+	addr, rsts := pushServer(t, testPush{"http://example.com/style.css", []byte("pushed")})
+	client, tr := pushClient(t, addr, nil)
+	getBody(t, client, "http://example.com/")
+	expectRst(t, rsts, 2, RefusedStream)
+	if _, body := getBody(t, client, "http://example.com/style.css"); body != "/style.css" {
+		t.Errorf("GET /style.css = %q, want the server's response", body)
+	}
+	if s := tr.Stats()[0]; s.Pushes != 0 || s.PushHits != 0 || s.PushMisses != 0 {
+		t.Errorf("stats = %+v, want no push activity", s)
+	}
+}
+
+func TestTransportPushBufferLimit(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), DefaultMaxStreamBufferBytes+1)
+	addr, rsts := pushServer(t, testPush{"http://example.com/big", big})
+	client, _ := pushClient(t, addr, func(*url.URL, *http.Request) bool { return true })
+	getBody(t, client, "http://example.com/")
+	// Nobody claimed the push, so it may not buffer more.
+	expectRst(t, rsts, 2, Cancel)
+	if _, body := getBody(t, client, "http://example.com/big"); body != "/big" {
+		t.Errorf("GET /big = %d bytes, want the server's response", len(body))
+	}
+}
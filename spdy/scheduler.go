@@ -0,0 +1,331 @@
+// spdy/scheduler.go
+
+package spdy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// numPriorities is the number of distinct stream priorities.  SPDY/2 carries
+// two bits of priority in SYN_STREAM and SPDY/3 carries three; in both, zero
+// is the most urgent.
+const numPriorities = 8
+
+// maxQueuedFrames is the number of data frames a single stream may have
+// waiting in the scheduler before its writer blocks.
+const maxQueuedFrames = 4
+
+var errSchedulerClosed = errors.New("spdy: frame scheduler closed")
+
+// A queuedFrame is a frame waiting to be written by a frameScheduler.
+type queuedFrame struct {
+	frame Frame
+
+	// If header is non-nil, it is compressed and appended to frame.Data
+	// just before the frame is written.  Header compression has to happen
+	// in the order frames reach the wire, so it is deferred until then.
+	header http.Header
+
+	// written, if non-nil, is called once the frame has been written.
+	written func()
+}
+
+// A streamQueue holds the pending data frames of one stream.
+type streamQueue struct {
+	id       uint32
+	priority uint8
+	frames   []queuedFrame
+	ready    bool // whether the queue is on a ready list
+	finished bool // no more frames will be added
+}
+
+// A frameScheduler serializes outgoing frames onto a connection.  Control
+// frames jump the queue.  Data frames are queued per stream, and the most
+// urgent stream with a pending frame is always served first, round-robin
+// among streams of equal priority.
+type frameScheduler struct {
+	dst io.Writer
+	w   *bufio.Writer
+	hw  *HeaderWriter
+
+	// writeTimeout, if positive, bounds each write when dst supports
+	// write deadlines.
+	writeTimeout time.Duration
+
+	// sent, if non-nil, is called with every frame written.  If the frame
+	// carries a header block, h holds its headers and compressed is the
+	// block's size on the wire.
+	sent func(f Frame, h http.Header, compressed int)
+
+	mu       sync.Mutex
+	cond     sync.Cond // signalled on every change of the queues
+	control  []queuedFrame
+	streams  map[uint32]*streamQueue
+	ready    [numPriorities][]*streamQueue
+	draining bool  // stop once the queues are empty
+	err      error // set once the scheduler is closed
+}
+
+func newFrameScheduler(w io.Writer, hw *HeaderWriter) *frameScheduler {
+	s := &frameScheduler{
+		dst:     w,
+		w:       bufio.NewWriter(w),
+		hw:      hw,
+		streams: make(map[uint32]*streamQueue),
+	}
+	s.cond.L = &s.mu
+	return s
+}
+
+// openStream registers a stream with the given priority.  Priorities beyond
+// the lowest level are clamped to it.
+func (s *frameScheduler) openStream(id uint32, priority uint8) {
+	if priority >= numPriorities {
+		priority = numPriorities - 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.streams[id]; !exists {
+		s.streams[id] = &streamQueue{id: id, priority: priority}
+	}
+}
+
+// finishStream marks that no more frames will be queued for a stream.  The
+// stream is forgotten once its remaining frames have been written.
+func (s *frameScheduler) finishStream(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.streams[id]
+	if !ok {
+		return
+	}
+	q.finished = true
+	if len(q.frames) == 0 {
+		delete(s.streams, id)
+	}
+}
+
+// resetStream discards a stream's queued frames and forgets the stream.
+// Writers blocked on it return an error.
+func (s *frameScheduler) resetStream(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.streams[id]
+	if !ok {
+		return
+	}
+	delete(s.streams, id)
+	if q.ready {
+		list := s.ready[q.priority]
+		for i := range list {
+			if list[i] == q {
+				s.ready[q.priority] = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+	}
+	q.frames = nil
+	s.cond.Broadcast()
+}
+
+// writeControl queues a control frame ahead of all data frames.
+func (s *frameScheduler) writeControl(f queuedFrame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.control = append(s.control, f)
+	s.cond.Broadcast()
+	return nil
+}
+
+// writeAfter queues f behind the data frames a stream still has waiting, so
+// that a RST_STREAM does not cut off a finished response.  A stream with
+// nothing waiting gets f at once, like writeControl.
+func (s *frameScheduler) writeAfter(id uint32, f queuedFrame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	q, ok := s.streams[id]
+	if !ok || len(q.frames) == 0 {
+		s.control = append(s.control, f)
+	} else {
+		q.frames = append(q.frames, f)
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+// writeStream queues a data frame for a stream opened with openStream.  It
+// blocks while the stream already has maxQueuedFrames frames waiting.
+func (s *frameScheduler) writeStream(id uint32, f queuedFrame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.err != nil {
+			return s.err
+		}
+		q, ok := s.streams[id]
+		if !ok || q.finished {
+			return errors.New("spdy: write on unknown or finished stream")
+		}
+		if len(q.frames) < maxQueuedFrames {
+			q.frames = append(q.frames, f)
+			if !q.ready {
+				q.ready = true
+				s.ready[q.priority] = append(s.ready[q.priority], q)
+			}
+			s.cond.Broadcast()
+			return nil
+		}
+		s.cond.Wait()
+	}
+}
+
+// next blocks until a frame is available and removes it from the queues.
+// It returns false once the scheduler is closed.
+func (s *frameScheduler) next() (f queuedFrame, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.err != nil {
+			return
+		}
+		if len(s.control) > 0 {
+			f = s.control[0]
+			s.control[0] = queuedFrame{}
+			s.control = s.control[1:]
+			return f, true
+		}
+		for pri := range s.ready {
+			list := s.ready[pri]
+			if len(list) == 0 {
+				continue
+			}
+			q := list[0]
+			list[0] = nil
+			list = list[1:]
+			f = q.frames[0]
+			q.frames[0] = queuedFrame{}
+			q.frames = q.frames[1:]
+			if len(q.frames) > 0 {
+				// Round-robin: go to the back of the line.
+				list = append(list, q)
+			} else {
+				q.ready = false
+				if q.finished {
+					delete(s.streams, q.id)
+				}
+			}
+			s.ready[pri] = list
+			s.cond.Broadcast()
+			return f, true
+		}
+		if s.draining {
+			s.err = errSchedulerClosed
+			s.cond.Broadcast()
+			return
+		}
+		s.cond.Wait()
+	}
+}
+
+// pending reports whether any frame is waiting to be written.
+func (s *frameScheduler) pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.control) > 0 {
+		return true
+	}
+	for _, list := range s.ready {
+		if len(list) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// run writes frames until the scheduler is closed or a write fails.  The
+// output is flushed whenever the queues run dry.
+func (s *frameScheduler) run() error {
+	for {
+		f, ok := s.next()
+		if !ok {
+			s.w.Flush()
+			return s.closeErr()
+		}
+		// Control frames carry the version of the session's header
+		// blocks.
+		f.frame = withVersion(f.frame, s.hw.version)
+		compressed := 0
+		if f.header != nil {
+			data := make([]byte, len(f.frame.Data), len(f.frame.Data)+64)
+			copy(data, f.frame.Data)
+			block := s.hw.Encode(f.header)
+			compressed = len(block)
+			f.frame.Data = append(data, block...)
+		}
+		s.setWriteDeadline()
+		_, err := f.frame.WriteTo(s.w)
+		if s.sent != nil {
+			s.sent(f.frame, f.header, compressed)
+		}
+		if err == nil && f.written != nil {
+			f.written()
+		}
+		if err == nil && !s.pending() {
+			err = s.w.Flush()
+		}
+		if err != nil {
+			s.close(err)
+			return err
+		}
+	}
+}
+
+func (s *frameScheduler) setWriteDeadline() {
+	if s.writeTimeout <= 0 {
+		return
+	}
+	if d, ok := s.dst.(interface {
+		SetWriteDeadline(time.Time) error
+	}); ok {
+		d.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+}
+
+// drain makes run return once every queued frame has been written.
+func (s *frameScheduler) drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	s.cond.Broadcast()
+}
+
+// close stops the scheduler.  Queued frames are discarded and blocked
+// writers return err.
+func (s *frameScheduler) close(err error) {
+	if err == nil {
+		err = errSchedulerClosed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+func (s *frameScheduler) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
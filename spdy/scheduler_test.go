@@ -0,0 +1,188 @@
+// spdy/scheduler_test.go
+
+package spdy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collectFrames returns the stream ID of every data frame in buf (zero for
+// control frames) and the types of every control frame, in order.
+func collectFrames(t *testing.T, buf *bytes.Buffer) (ids []uint32, controls []ControlFrameType) {
+	for {
+		f, err := ReadFrame(buf)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		if f.IsControl() {
+			controls = append(controls, f.Type())
+			ids = append(ids, 0)
+		} else {
+			ids = append(ids, f.StreamId())
+		}
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	buf := new(bytes.Buffer)
+	s := newFrameScheduler(buf, NewHeaderWriter(-1))
+	s.openStream(1, 3)
+	s.openStream(3, 0)
+	s.openStream(5, 3)
+	for i := 0; i < 2; i++ {
+		s.writeStream(1, queuedFrame{frame: DataFrame(1, 0, []byte("low"))})
+		s.writeStream(5, queuedFrame{frame: DataFrame(5, 0, []byte("low"))})
+	}
+	s.writeStream(3, queuedFrame{frame: DataFrame(3, 0, []byte("high"))})
+	s.writeControl(queuedFrame{frame: ControlFrame(TypePing, 0, []byte{0, 0, 0, 1})})
+	for i := 0; i < 6; i++ {
+		f, ok := s.next()
+		if !ok {
+			t.Fatal("scheduler closed early")
+		}
+		f.frame.WriteTo(buf)
+	}
+
+	ids, controls := collectFrames(t, buf)
+	want := []uint32{0, 3, 1, 5, 1, 5}
+	if len(ids) != len(want) {
+		t.Fatalf("wrote %d frames, want %d", len(ids), len(want))
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Errorf("frame %d: stream %d, want %d (order %v)", i, ids[i], want[i], ids)
+			break
+		}
+	}
+	if len(controls) != 1 || controls[0] != TypePing {
+		t.Errorf("control frames = %v, want [PING]", controls)
+	}
+}
+
+func TestSchedulerHeaderOrder(t *testing.T) {
+	buf := new(bytes.Buffer)
+	s := newFrameScheduler(buf, NewHeaderWriter(-1))
+	done := make(chan error)
+	go func() { done <- s.run() }()
+	for i := uint32(1); i <= 3; i++ {
+		h := make(map[string][]string)
+		h["Status"] = []string{"200 OK"}
+		s.writeControl(queuedFrame{frame: ControlFrame(TypeSynReply, 0, []byte{0, 0, 0, byte(i), 0, 0}), header: h})
+	}
+	for s.pending() {
+		time.Sleep(time.Millisecond)
+	}
+	s.close(nil)
+	<-done
+
+	hr := NewHeaderReader()
+	for i := 0; i < 3; i++ {
+		f, err := ReadFrame(buf)
+		if err != nil {
+			t.Fatalf("frame %d: ReadFrame: %v", i, err)
+		}
+		h, err := hr.Decode(f.Data[6:])
+		if err != nil {
+			t.Fatalf("frame %d: Decode: %v", i, err)
+		}
+		if h.Get("Status") != "200 OK" {
+			t.Errorf("frame %d: status = %q", i, h.Get("Status"))
+		}
+	}
+}
+
+func TestSchedulerBackpressure(t *testing.T) {
+	s := newFrameScheduler(io.Discard, NewHeaderWriter(-1))
+	s.openStream(1, 0)
+	for i := 0; i < maxQueuedFrames; i++ {
+		s.writeStream(1, queuedFrame{frame: DataFrame(1, 0, nil)})
+	}
+	blocked := make(chan error)
+	go func() {
+		blocked <- s.writeStream(1, queuedFrame{frame: DataFrame(1, 0, nil)})
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("writeStream did not block on a full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.close(nil)
+	if err := <-blocked; err != errSchedulerClosed {
+		t.Errorf("blocked writeStream = %v, want %v", err, errSchedulerClosed)
+	}
+}
+
+// ttfbWriter records when the first byte of a given stream is written.
+type ttfbWriter struct {
+	id    uint32
+	mu    sync.Mutex
+	first chan struct{}
+	buf   []byte
+	seen  bool
+}
+
+func (w *ttfbWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.seen {
+		// Frame boundaries are not preserved by the bufio.Writer, so
+		// look for the stream's data frame header anywhere in the output.
+		w.buf = append(w.buf, p...)
+		hdr := DataFrame(w.id, 0, nil).Header
+		if bytes.Contains(w.buf, hdr[:]) {
+			w.seen = true
+			close(w.first)
+		}
+		if len(w.buf) > 64 {
+			w.buf = w.buf[len(w.buf)-8:]
+		}
+	}
+	return len(p), nil
+}
+
+// BenchmarkHighPriorityTTFB measures how long a high priority stream waits
+// for its first byte while many low priority streams are saturating the
+// connection.
+func BenchmarkHighPriorityTTFB(b *testing.B) {
+	const lowStreams = 16
+	chunk := make([]byte, 16<<10)
+	var total time.Duration
+	for i := 0; i < b.N; i++ {
+		w := &ttfbWriter{id: 0x7ffffff1, first: make(chan struct{})}
+		s := newFrameScheduler(w, NewHeaderWriter(-1))
+		go s.run()
+
+		var wg sync.WaitGroup
+		for j := uint32(0); j < lowStreams; j++ {
+			id := 2*j + 1
+			s.openStream(id, 3)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if s.writeStream(id, queuedFrame{frame: DataFrame(id, 0, chunk)}) != nil {
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+
+		start := time.Now()
+		s.openStream(w.id, 0)
+		s.writeStream(w.id, queuedFrame{frame: DataFrame(w.id, 0, []byte("critical"))})
+		<-w.first
+		total += time.Since(start)
+
+		s.close(nil)
+		wg.Wait()
+	}
+	b.ReportMetric(float64(total.Nanoseconds())/float64(b.N), "ns/ttfb")
+}
@@ -3,25 +3,26 @@
 package spdy
 
 import (
-  "fmt"
-  "bytes"
-  //"crypto/rand"
-  //"crypto/tls"
-  //"encoding/binary"
-  //"errors"
-  "io"
-  "net"
-  //"net/url"
-  "net/http"
-  //"strconv"
-  //"time"
+	"context"
+	//"crypto/rand"
+	"crypto/tls"
+	//"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	//"net/url"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // ListenAndServe creates a new Server that serves on the given address.  If
 // the handler is nil, then http.DefaultServeMux is used.
 func ListenAndServe(addr string, handler http.Handler) error {
-  srv := &Server{addr, handler}
-  return srv.ListenAndServe()
+	srv := &Server{Addr: addr, Handler: handler}
+	return srv.ListenAndServe()
 }
 
 // ListenAndServeTLS acts like ListenAndServe except it uses TLS.
@@ -48,340 +49,563 @@ func ListenAndServeTLS(addr string, certFile, keyFile string, handler http.Handl
 }
 */
 
+// DefaultMaxDataFrameSize is the DATA frame payload size used when
+// Server.MaxDataFrameSize is zero.
+const DefaultMaxDataFrameSize = 8 << 10
+
+// DefaultMaxConcurrentStreams is the stream limit used when
+// Server.MaxConcurrentStreams is zero.
+const DefaultMaxConcurrentStreams = 100
+
+// DefaultMaxStreamBufferBytes and DefaultMaxSessionBufferBytes are the
+// request body buffer limits used when Server.MaxStreamBufferBytes and
+// Server.MaxSessionBufferBytes are zero.  DefaultMaxStreamBufferBytes also
+// bounds response bodies when Transport.MaxStreamBufferBytes is zero.
+const (
+	DefaultMaxStreamBufferBytes  = 64 << 10
+	DefaultMaxSessionBufferBytes = 1 << 20
+)
+
 // A Server handles incoming SPDY connections with HTTP handlers.
 type Server struct {
-  Addr    string
-  Handler http.Handler
+	Addr    string
+	Handler http.Handler
+
+	// MaxDataFrameSize is the largest DATA frame payload the server sends.
+	// Responses are sliced into frames of at most this size so that
+	// concurrent streams interleave.  If zero, DefaultMaxDataFrameSize is
+	// used.
+	MaxDataFrameSize int
+
+	// ReadTimeout is the maximum duration for reading a frame once its
+	// first byte has arrived.  A client that stalls mid-frame has its
+	// session closed.  Zero means no timeout.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the maximum duration of each write to a connection.
+	// A session whose client stops reading is closed.  Zero means no
+	// timeout.
+	WriteTimeout time.Duration
+
+	// IdleTimeout is how long a session may go without active streams
+	// before the server sends GOAWAY and closes it.  Zero means no
+	// timeout.
+	IdleTimeout time.Duration
+
+	// HandlerTimeout bounds the time a handler may spend on one stream.
+	// When it expires, the request's context is canceled and the client
+	// receives a 503, or a RST_STREAM if the reply was already sent.
+	// Zero means no timeout.
+	HandlerTimeout time.Duration
+
+	// PingInterval, if non-zero, is how often the server sends a PING on
+	// each session to check that the client is still there and to measure
+	// the round-trip time.
+	PingInterval time.Duration
+
+	// PingTimeout is how long the server waits for a PING reply before
+	// closing the session.  If zero, PingInterval is used.
+	PingTimeout time.Duration
+
+	// MaxConcurrentStreams is the number of streams a client may have
+	// open at once in one session.  It is announced in SETTINGS, and
+	// SYN_STREAMs beyond it are refused with RST_STREAM REFUSED_STREAM.
+	// If zero, DefaultMaxConcurrentStreams is used.
+	MaxConcurrentStreams uint32
+
+	// InitialWindowSize, if non-zero, is announced to clients as
+	// SETTINGS_INITIAL_WINDOW_SIZE and turns on flow control of request
+	// bodies: the server sends WINDOW_UPDATE only as handlers read, so a
+	// client uploading faster than its handler reads is held back.  A
+	// client that overruns its window has the stream reset with
+	// FLOW_CONTROL_ERROR.  Sessions upgraded to SPDY/3.1 always use flow
+	// control, with the protocol's 64KiB window if InitialWindowSize is
+	// zero.  Responses are held to the client's windows only on SPDY/3.1
+	// sessions whose client announces SETTINGS_INITIAL_WINDOW_SIZE.
+	InitialWindowSize uint32
+
+	// MaxStreamBufferBytes limits the request body data buffered for a
+	// stream whose handler has not read it yet.  Without flow control a
+	// client that overruns it has the stream reset with
+	// FLOW_CONTROL_ERROR; with flow control the window bounds the buffer
+	// instead.  If zero, DefaultMaxStreamBufferBytes is used.
+	MaxStreamBufferBytes int
+
+	// MaxSessionBufferBytes limits the request body data buffered for all
+	// streams of a session together.  Without flow control the stream
+	// whose data overruns it is reset with FLOW_CONTROL_ERROR.  With flow
+	// control the server stops sending WINDOW_UPDATEs while the session
+	// buffers this much, so clients wait instead; windows already granted
+	// are honored, and may take the session past the limit.  If zero,
+	// DefaultMaxSessionBufferBytes is used.
+	MaxSessionBufferBytes int
+
+	// MaxRequestBodyBytes, if positive, limits the size of request
+	// bodies.  A request whose Content-Length exceeds it is answered with
+	// 413 Request Entity Too Large without running the handler.  A body
+	// that grows past it fails the handler's reads with
+	// ErrBodyTooLarge, and the stream is answered with 413 if no reply
+	// was sent yet, then reset with CANCEL.
+	MaxRequestBodyBytes int64
+
+	// Settings holds additional values to announce in the SETTINGS frame
+	// sent at the start of each session.
+	Settings Settings
+
+	// SettingsStore, if non-nil, persists the SETTINGS values that clients
+	// send with FlagSettingsPersistValue.  They are returned, flagged
+	// FlagSettingsPersisted, to later sessions from the same client host.
+	SettingsStore SettingsStore
+
+	// MaxConns, if positive, caps the number of sessions served at once.
+	// Further connections wait in the listener's backlog until a session
+	// ends.
+	MaxConns int
+
+	// ConnState, if non-nil, is called when a session changes state.  See
+	// the ConnState type.
+	ConnState func(net.Conn, ConnState)
+
+	// Logger receives the server's log records.  Records about a session
+	// carry its ID and remote address, and records about a stream also
+	// carry the stream ID.  Errors are logged at slog.LevelError, trouble
+	// caused by clients at slog.LevelWarn, and session and stream
+	// lifecycle events at slog.LevelDebug.  If nil, slog.Default() is
+	// used.
+	Logger *slog.Logger
+
+	// LogFrames logs every frame received and sent, including payloads,
+	// at slog.LevelDebug.  Payloads hold request and response bodies, so
+	// this is meant for debugging only.
+	LogFrames bool
+
+	// TLSConfig, if non-nil, lets plain listeners passed to Serve accept
+	// TLS as well: a connection that begins with a TLS handshake is
+	// served over TLS with this configuration.  Browsers connect so after
+	// an npn-spdy/2 Alternate-Protocol advertisement.  If NextProtos is
+	// empty, spdy/2 and http/1.1 are offered.  Without TLSConfig such
+	// connections are logged and closed.
+	TLSConfig *tls.Config
+
+	mu            sync.Mutex
+	listeners     map[net.Listener]struct{}
+	sessions      map[*session]struct{}
+	sniffing      map[net.Conn]struct{} // connections of unknown protocol
+	http1         *http.Server          // serves HTTP/1.x connections; started on demand
+	http1L        *connListener
+	sessionDone   *sync.Cond // see connFreed
+	nextSessionID uint64
+	inShutdown    bool
 }
 
-// ListenAndServe services SPDY requests on the given address.
-// If the handler is nil, then http.DefaultServeMux is used.
-func (srv *Server) ListenAndServe() error {
-  addr := srv.Addr
-  if addr == "" {
-    addr = ":http"
-  }
-  l, err := net.Listen("tcp", addr)
-  fmt.Println("Spdy listening on... %v", l.Addr())
-  if err != nil {
-    return err
-  }
-  return srv.Serve(l)
+func (srv *Server) logger() *slog.Logger {
+	if srv.Logger == nil {
+		return slog.Default()
+	}
+	return srv.Logger
 }
 
-// ListenAndServe services SPDY requests using the given listener.
-// If the handler is nil, then http.DefaultServeMux is used.
-func (srv *Server) Serve(l net.Listener) error {
-  defer l.Close()
-  handler := srv.Handler
-  if handler == nil {
-    handler = http.DefaultServeMux
-  }
-  for {
-    fmt.Println("Spdy waiting for connections...")
-    conn, err := l.Accept()
-    fmt.Println("...Spdy accepted connection... %v->%v", conn.RemoteAddr(), conn.LocalAddr())
-    if err != nil {
-      return err
-    }
-    go func(c net.Conn) {
-      // Echo all incoming data.
-      fmt.Println("echoing data...")
-      bb := new(bytes.Buffer)
-      io.Copy(bb, c)
-      // Shut down the connection.
-      fmt.Println("spdyrequest: %s", bb.String())
-      fmt.Println("closing conn...")
-      c.Close()
-    }(conn)
-    // s, err := newSession(c, handler)
-    // if err != nil {
-    // return err
-    // }
-    // go s.serve()
-  }
-  /*
-  */
-  return nil
+func (srv *Server) pingTimeout() time.Duration {
+	if srv.PingTimeout == 0 {
+		return srv.PingInterval
+	}
+	return srv.PingTimeout
 }
 
-type session struct {
-  conn net.Conn
-  handler http.Handler
-  frameIn, frameOut chan Frame
-  // streams map[uint32]*serverStream
-  headerReader *HeaderReader
-  headerWriter *HeaderWriter
+func (srv *Server) maxConcurrentStreams() uint32 {
+	if srv.MaxConcurrentStreams == 0 {
+		return DefaultMaxConcurrentStreams
+	}
+	return srv.MaxConcurrentStreams
 }
 
-/*
-// A session manages a single TCP connection to a client.
-type session struct {
-  c       net.Conn
-  handler http.Handler
-  in, out chan Frame
-  streams map[uint32]*serverStream // all access is done synchronously
-
-  headerReader *HeaderReader
-  headerWriter *HeaderWriter
+func (srv *Server) maxStreamBufferBytes() int {
+	if srv.MaxStreamBufferBytes <= 0 {
+		return DefaultMaxStreamBufferBytes
+	}
+	return srv.MaxStreamBufferBytes
 }
 
-func newSession(c net.Conn, h http.Handler) (s *session, err error) {
-  s = &session{
-    c:            c,
-    handler:      h,
-    headerReader: NewHeaderReader(),
-    headerWriter: NewHeaderWriter(-1),
-    in:           make(chan Frame),
-    out:          make(chan Frame),
-    streams:      make(map[uint32]*serverStream),
-  }
-  return
+func (srv *Server) maxSessionBufferBytes() int {
+	if srv.MaxSessionBufferBytes <= 0 {
+		return DefaultMaxSessionBufferBytes
+	}
+	return srv.MaxSessionBufferBytes
 }
 
-func (sess *session) serve() {
-  fmt.Println("serving new session!")
-  defer sess.c.Close()
-  go sess.sendFrames()
-  go sess.receiveFrames()
-
-  for {
-    select {
-    case f := <-sess.in:
-      switch frame := f.(type) {
-      case ControlFrame:
-        sess.handleControl(frame)
-        fmt.Println("control frame received")
-      case DataFrame:
-        sess.handleData(frame)
-        fmt.Println("data frame received")
-      }
-    }
-  }
+// settings returns the values announced at the start of a session with a
+// client from origin, including any the client asked to have persisted.
+func (srv *Server) settings(origin string) Settings {
+	s := append(Settings(nil), srv.Settings...)
+	s.Set(SettingsMaxConcurrentStreams, srv.maxConcurrentStreams())
+	if srv.InitialWindowSize != 0 {
+		s.Set(SettingsInitialWindowSize, srv.InitialWindowSize)
+	}
+	if srv.SettingsStore == nil {
+		return s
+	}
+	for _, setting := range srv.SettingsStore.Load(origin) {
+		if _, ok := s.Get(setting.Id); !ok {
+			s = append(s, Setting{Id: setting.Id, Flags: FlagSettingsPersisted, Value: setting.Value})
+		}
+	}
+	return s
 }
 
-func (sess *session) handleControl(frame ControlFrame) {
-  switch frame.Type {
-  case TypeSynStream:
-    if stream, err := newServerStream(sess, frame); err == nil {
-      if _, exists := sess.streams[stream.id]; !exists {
-        sess.streams[stream.id] = stream
-        go func() {
-          sess.handler.ServeHTTP(stream, stream.Request())
-          stream.finish()
-        }()
-      }
-      // TODO(syu) -- else return an error?
-    }
-  case TypeRstStream:
-    d := bytes.NewBuffer(frame.Data)
-    var streamId, statusCode uint32
-    readBinary(d, &streamId, &statusCode)
-  case TypePing:
-    d := bytes.NewBuffer(frame.Data)
-    var pingId uint32
-    readBinary(d, &pingId)
-    sess.out <- ControlFrame{
-      Type: TypePing,
-      Data: []byte{
-        byte(pingId & 0xff000000 >> 24),
-        byte(pingId & 0x00ff0000 >> 16),
-        byte(pingId & 0x0000ff00 >> 8),
-        byte(pingId & 0x000000ff >> 0),
-      },
-    }
-  }
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to
+// Shutdown or Close.
+var ErrServerClosed = errors.New("spdy: Server closed")
+
+func (srv *Server) maxDataFrameSize() int {
+	return clampDataFrameSize(srv.MaxDataFrameSize)
 }
 
-func (sess *session) handleData(frame DataFrame) {
-  st, found := sess.streams[frame.StreamID]
-  if !found {
-    // TODO: Error?
-    return
-  }
-  if st.dataPipe != nil {
-    st.dataPipe.write(frame.Data)
-    if frame.Flags & FlagFin != 0 {
-      st.dataPipe.wclose(nil)
-    }
-  }
+// clampDataFrameSize returns the DATA frame payload size to use for a
+// configured size of n: DefaultMaxDataFrameSize if n is not positive, and
+// at most MaxDataLength.
+func clampDataFrameSize(n int) int {
+	switch {
+	case n <= 0:
+		return DefaultMaxDataFrameSize
+	case n > MaxDataLength:
+		return MaxDataLength
+	default:
+		return n
+	}
 }
 
-func (sess *session) sendFrames() {
-  for frame := range sess.out {
-    // TODO: Check for errors
-    frame.WriteTo(sess.c)
-  }
+// ListenAndServe services SPDY requests on the given address.
+// If the handler is nil, then http.DefaultServeMux is used.
+func (srv *Server) ListenAndServe() error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv.logger().Debug("spdy: listening", "addr", l.Addr())
+	return srv.Serve(l)
 }
 
-func (sess *session) receiveFrames() {
-  defer close(sess.in)
-  for {
-    frame, err := ReadFrame(sess.c)
-    if err != nil {
-      return
-    }
-    sess.in <- frame
-  }
+// Serve accepts connections on l and serves each according to the protocol
+// it begins with.  SPDY control frames start a session.  A TLS handshake is
+// served with TLSConfig, or rejected without it.  HTTP/1.x requests are
+// served by net/http with the same handler, except that those asking to
+// Upgrade to spdy/2 turn their connection into a session.  Anything else
+// is logged and closed.  If the handler is nil, then http.DefaultServeMux
+// is used.
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if !srv.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		if !srv.waitConnSlot() {
+			return ErrServerClosed
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				srv.logger().Warn("spdy: accept error; retrying", "err", err, "delay", tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		if !srv.trackSniffing(conn, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go srv.serveConn(conn, handler)
+	}
 }
 
-// A serverStream is a logical data stream inside a session.  A serverStream
-// services a single request.
-type serverStream struct {
-  id      uint32
-  session *session
-  closed  bool
+// waitConnSlot blocks while the server has MaxConns sessions.  It reports
+// false if the server shuts down while waiting.
+func (srv *Server) waitConnSlot() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for srv.MaxConns > 0 && len(srv.sessions)+len(srv.sniffing) >= srv.MaxConns && !srv.inShutdown {
+		srv.connFreed().Wait()
+	}
+	return !srv.inShutdown
+}
 
-  requestHeaders  http.Header
-  responseHeaders http.Header
-  wroteHeader     bool
+// connFreed returns the condition signalled when a session ends or the
+// server shuts down.  srv.mu must be held.
+func (srv *Server) connFreed() *sync.Cond {
+	if srv.sessionDone == nil {
+		srv.sessionDone = sync.NewCond(&srv.mu)
+	}
+	return srv.sessionDone
+}
 
-  dataPipe *asyncPipe
+// shutdownPollInterval is how often Shutdown checks whether every session
+// has finished.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown gracefully shuts down the server.  It closes all listeners, then
+// sends GOAWAY to every session so that clients stop opening streams, and
+// waits for the active streams to finish.  Sessions close as soon as they
+// are idle.  If ctx expires first, the remaining sessions are closed
+// forcibly and ctx.Err() is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.inShutdown = true
+	srv.connFreed().Broadcast()
+	err := srv.closeListenersLocked()
+	for sess := range srv.sessions {
+		sess.goAway()
+	}
+	srv.closeSniffingLocked()
+	http1 := srv.http1
+	srv.mu.Unlock()
+
+	if http1 != nil {
+		if herr := http1.Shutdown(ctx); herr != nil {
+			srv.closeSessions()
+			return herr
+		}
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.numSessions() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			srv.closeSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
-func newServerStream(sess *session, frame ControlFrame) (st *serverStream, err error) {
-  if frame.Type != TypeSynStream {
-    err = errors.New("Server stream must be created from a SynStream frame")
-    return
-  }
-  st = &serverStream{
-    session:         sess,
-    responseHeaders: make(http.Header),
-  }
-  if frame.Flags&FlagFin == 0 {
-    // Request body will follow
-    st.dataPipe = apipe()
-  }
-  // Read frame data
-  data := bytes.NewBuffer(frame.Data)
-  err = binary.Read(data, binary.BigEndian, &st.id)
-  if err != nil {
-    return
-  }
-  _, err = io.ReadFull(data, make([]byte, 6)) // skip associated stream ID and priority
-  if err != nil {
-    return
-  }
-  st.requestHeaders, err = sess.headerReader.Decode(data.Bytes())
-  return
+// Close immediately closes all listeners and sessions.  Streams in flight
+// are dropped; use Shutdown to let them finish.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.inShutdown = true
+	srv.connFreed().Broadcast()
+	err := srv.closeListenersLocked()
+	http1 := srv.http1
+	srv.mu.Unlock()
+	if http1 != nil {
+		http1.Close()
+	}
+	srv.closeSessions()
+	return err
 }
 
-// Request returns the request data associated with the serverStream.
-func (st *serverStream) Request() (req *http.Request) {
-  // TODO: Add more info
-  req = &http.Request{
-    Method:     st.requestHeaders.Get("method"),
-    // RawURL:     st.requestHeaders.Get("url"),
-    Proto:      st.requestHeaders.Get("version"),
-    Header:     st.requestHeaders,
-    Body:       st,
-    RemoteAddr: st.session.c.RemoteAddr().String(),
-  }
-  // req.URL, _ = httputil.ParseRequestURL(req.RawURL)
-  req.URL, _ = url.Parse(st.requestHeaders.Get("url"))
-  return
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.inShutdown
 }
 
-func (st *serverStream) Read(p []byte) (n int, err error) {
-  return st.dataPipe.read(p)
+func (srv *Server) closeListenersLocked() (err error) {
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(srv.listeners, l)
+	}
+	return
 }
 
-// Header returns the current response headers.
-func (st *serverStream) Header() http.Header {
-  return st.responseHeaders
+func (srv *Server) closeSessions() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for sess := range srv.sessions {
+		sess.c.Close()
+	}
+	srv.closeSniffingLocked()
 }
 
-func (st *serverStream) Write(p []byte) (n int, err error) {
-  if st.closed {
-    err = errors.New("Write on closed serverStream")
-    return
-  }
-  if !st.wroteHeader {
-    st.WriteHeader(http.StatusOK)
-  }
-  for len(p) > 0 {
-    frame := DataFrame{
-      StreamID: st.id,
-    }
-    if len(p) < MaxDataLength {
-      frame.Data = make([]byte, len(p))
-    } else {
-      frame.Data = make([]byte, MaxDataLength)
-    }
-    copy(frame.Data, p)
-    p = p[len(frame.Data):]
-    st.session.out <- frame
-    n += len(frame.Data)
-  }
-  return
+// closeSniffingLocked closes the connections whose protocol is not yet
+// known.  srv.mu must be held.
+func (srv *Server) closeSniffingLocked() {
+	for c := range srv.sniffing {
+		c.Close()
+	}
 }
 
-// A synReplyFrame defers header compression until the server writes the frame.
-// This is necessary to guarantee correctly ordered compression.
-type synReplyFrame struct {
-  stream *serverStream
-  header http.Header
-  flags  FrameFlags
+// trackListener adds or removes a listener from the set closed by Shutdown.
+// It reports false if the server is already shutting down.
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !add {
+		delete(srv.listeners, l)
+		return true
+	}
+	if srv.inShutdown {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	srv.listeners[l] = struct{}{}
+	return true
 }
 
-func (frame synReplyFrame) GetFlags() FrameFlags {
-  return frame.flags
+func (srv *Server) trackSession(sess *session, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	trackLive(sess, add)
+	if !add {
+		delete(srv.sessions, sess)
+		srv.connFreed().Broadcast()
+		return
+	}
+	if srv.sessions == nil {
+		srv.sessions = make(map[*session]struct{})
+	}
+	srv.nextSessionID++
+	sess.id = srv.nextSessionID
+	srv.sessions[sess] = struct{}{}
+	if srv.inShutdown {
+		sess.goAway()
+	}
 }
 
-func (frame synReplyFrame) GetData() []byte {
-  buf := new(bytes.Buffer)
-  binary.Write(buf, binary.BigEndian, frame.stream.id & 0x7fffffff)
-  arr := make([]byte, 2)
-  arr[0] = 1
-  arr[1] = 1
-  // buf.Write(([2]byte{1, 1})[0:1]) // TODO(syu) why am i commenting this.... ?
-  buf.Write(arr) // TODO(syu) why am i commenting this.... ?
-  frame.stream.session.headerWriter.WriteHeader(buf, frame.stream.responseHeaders)
-  return buf.Bytes()
+// A ConnState is the state of a session, as reported to Server.ConnState.
+type ConnState int
+
+const (
+	// StateNew is a connection that has just been accepted.
+	StateNew ConnState = iota
+
+	// StateActive is a session with at least one open stream.
+	StateActive
+
+	// StateIdle is a session whose streams have all finished.
+	StateIdle
+
+	// StateClosed is a session whose connection has been closed.  It is
+	// the last state reported.
+	StateClosed
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateClosed:
+		return "closed"
+	}
+	return "ConnState(" + strconv.Itoa(int(c)) + ")"
 }
 
-func (frame synReplyFrame) WriteTo(w io.Writer) (n int64, err error) {
-  cf := ControlFrame{Type: TypeSynReply, Data: frame.GetData()}
-  return cf.WriteTo(w)
+// SessionInfo describes a live session.
+type SessionInfo struct {
+	ID         uint64 // unique for the lifetime of the Server
+	RemoteAddr net.Addr
+	Version    int // SPDY protocol version
+	State      ConnState
+	Streams    int       // number of open streams
+	Created    time.Time // when the connection was accepted
+	GoingAway  bool      // GOAWAY sent; no new streams are accepted
+
+	// RTT is the round-trip time measured by the last answered PING, or
+	// zero if none has been answered yet.
+	RTT time.Duration
+
+	// Settings holds the values the server sent in its SETTINGS frame and
+	// PeerSettings the last values received from the client.
+	Settings     Settings
+	PeerSettings Settings
+
+	// Frames and bytes received and sent, counting frame headers.
+	FramesIn, FramesOut int64
+	BytesIn, BytesOut   int64
+
+	OpenStreams []StreamInfo // sorted by ID
 }
 
-func (st *serverStream) WriteHeader(code int) {
-  if st.wroteHeader {
-    return
-  }
-  st.responseHeaders.Set("status", strconv.Itoa(code)+" "+http.StatusText(code))
-  st.responseHeaders.Set("version", "HTTP/1.1")
-  if st.responseHeaders.Get("Content-Type") == "" {
-    st.responseHeaders.Set("Content-Type", "text/html; charset=utf-8")
-  }
-  if st.responseHeaders.Get("Date") == "" {
-    st.responseHeaders.Set("Date", time.Now().UTC().Format(http.TimeFormat))
-  }
-  // Write the frame
-  // TODO: Copy headers
-  st.session.out <- synReplyFrame{stream: st, header: st.responseHeaders}
-  st.wroteHeader = true
+// StreamInfo describes an open stream of a live session.
+type StreamInfo struct {
+	ID       uint32
+	Priority uint8
+	URL      string
+	State    string    // "open", "half-closed (local)" or "half-closed (remote)"
+	Opened   time.Time // when the SYN_STREAM was accepted
+
+	// DATA payload bytes received and sent.
+	BytesIn, BytesOut int64
 }
 
-// Close sends a closing frame, thus preventing the server from sending more
-// data over the stream.  The client may still send data.
-func (st *serverStream) Close() (err error) {
-  if st.closed {
-    return
-  }
-  st.session.out <- DataFrame{
-    StreamID: st.id,
-    Flags:    FlagFin,
-    Data:     []byte{},
-  }
-  st.closed = true
-  return nil
+// Sessions returns a description of every live session.
+func (srv *Server) Sessions() []SessionInfo {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	infos := make([]SessionInfo, 0, len(srv.sessions))
+	for sess := range srv.sessions {
+		infos = append(infos, sess.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
 }
 
-func (st *serverStream) finish() (err error) {
-  if !st.wroteHeader {
-    st.WriteHeader(http.StatusOK)
-  }
-  return st.Close()
+// GoAwaySession sends GOAWAY on the session with the given ID.  The session
+// refuses new streams and closes once its open streams finish.  It reports
+// whether the session was found.
+func (srv *Server) GoAwaySession(id uint64) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for sess := range srv.sessions {
+		if sess.id == id {
+			sess.goAway()
+			return true
+		}
+	}
+	return false
+}
+
+// CloseSession immediately closes the session with the given ID, dropping
+// its streams.  It reports whether the session was found.
+func (srv *Server) CloseSession(id uint64) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for sess := range srv.sessions {
+		if sess.id == id {
+			sess.c.Close()
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) numSessions() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.sessions)
 }
-*/
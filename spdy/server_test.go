@@ -0,0 +1,975 @@
+// spdy/server_test.go
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// synStream builds a SYN_STREAM frame for a test client.
+func synStream(hw *HeaderWriter, id uint32, priority uint8, flags FrameFlags, h http.Header) Frame {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, id&0x7fffffff)
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	binary.Write(buf, binary.BigEndian, uint16(priority)<<14)
+	hw.WriteHeader(buf, h)
+	return ControlFrame(TypeSynStream, flags, buf.Bytes())
+}
+
+func getHeader(url string) http.Header {
+	return http.Header{
+		"Method":  {"GET"},
+		"Url":     {url},
+		"Version": {"HTTP/1.1"},
+	}
+}
+
+// testConn starts a session serving h and returns the client side of the
+// connection.
+func testConn(t *testing.T, h http.Handler) (net.Conn, *bufio.Reader) {
+	return testServerConn(t, &Server{Handler: h})
+}
+
+// testServerConn is like testConn but serves with the configuration in srv.
+func testServerConn(t *testing.T, srv *Server) (net.Conn, *bufio.Reader) {
+	client, server := net.Pipe()
+	sess := newSession(srv, server, srv.Handler, Version)
+	srv.trackSession(sess, true)
+	go sess.serve()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, bufio.NewReader(client)
+}
+
+// readResponse reads frames for stream id until it is finished and returns
+// the reply headers and body.
+func readResponse(t *testing.T, r io.Reader, hr *HeaderReader, id uint32) (http.Header, []byte) {
+	var h http.Header
+	body := new(bytes.Buffer)
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		if f.IsControl() {
+			if f.Type() != TypeSynReply {
+				continue
+			}
+			h, err = hr.Decode(f.Data[6:])
+			if err != nil {
+				t.Fatalf("decoding SYN_REPLY: %v", err)
+			}
+			if f.Flags&FlagFin != 0 {
+				return h, body.Bytes()
+			}
+			continue
+		}
+		if f.StreamId() != id {
+			continue
+		}
+		body.Write(f.Data)
+		if f.Flags&FlagFin != 0 {
+			return h, body.Bytes()
+		}
+	}
+}
+
+func TestServeRequest(t *testing.T) {
+	c, r := testConn(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, req.Method+" "+req.URL.Path)
+	}))
+	hw := NewHeaderWriter(-1)
+	synStream(hw, 1, 0, FlagFin, getHeader("http://example.com/foo")).WriteTo(c)
+
+	h, body := readResponse(t, r, NewHeaderReader(), 1)
+	if got := h.Get("Status"); got != "200 OK" {
+		t.Errorf("status = %q, want %q", got, "200 OK")
+	}
+	if got := h.Get("Content-Type"); got != "text/plain" {
+		t.Errorf("content-type = %q, want %q", got, "text/plain")
+	}
+	if string(body) != "GET /foo" {
+		t.Errorf("body = %q, want %q", body, "GET /foo")
+	}
+}
+
+func TestServeRequestBody(t *testing.T) {
+	c, r := testConn(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(w, req.Body)
+	}))
+	hw := NewHeaderWriter(-1)
+	h := getHeader("http://example.com/echo")
+	h.Set("Method", "POST")
+	synStream(hw, 1, 0, 0, h).WriteTo(c)
+	DataFrame(1, 0, []byte("hello, ")).WriteTo(c)
+	DataFrame(1, FlagFin, []byte("world")).WriteTo(c)
+
+	_, body := readResponse(t, r, NewHeaderReader(), 1)
+	if string(body) != "hello, world" {
+		t.Errorf("body = %q, want %q", body, "hello, world")
+	}
+}
+
+// frameSizes returns the payload sizes of the DATA frames for stream id up to
+// and including the one carrying FLAG_FIN.
+func frameSizes(t *testing.T, r io.Reader, id uint32) (sizes []int) {
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		if f.IsControl() || f.StreamId() != id {
+			continue
+		}
+		sizes = append(sizes, len(f.Data))
+		if f.Flags&FlagFin != 0 {
+			return
+		}
+	}
+}
+
+func TestMaxDataFrameSize(t *testing.T) {
+	const size = 10000
+	tests := []struct {
+		desc  string
+		write func(w io.Writer, data []byte)
+	}{
+		{"Write", func(w io.Writer, data []byte) { w.Write(data) }},
+		{"ReadFrom", func(w io.Writer, data []byte) { io.Copy(w, io.LimitReader(bytes.NewReader(data), size)) }},
+	}
+	for _, tt := range tests {
+		c, r := testServerConn(t, &Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				tt.write(w, make([]byte, size))
+			}),
+			MaxDataFrameSize: 4096,
+		})
+		synStream(NewHeaderWriter(-1), 1, 0, FlagFin, getHeader("http://example.com/")).WriteTo(c)
+		sizes := frameSizes(t, r, 1)
+		want := []int{4096, 4096, 1808, 0}
+		if len(sizes) != len(want) {
+			t.Errorf("%s: frame sizes = %v, want %v", tt.desc, sizes, want)
+			continue
+		}
+		for i := range want {
+			if sizes[i] != want[i] {
+				t.Errorf("%s: frame sizes = %v, want %v", tt.desc, sizes, want)
+				break
+			}
+		}
+	}
+}
+
+// readControl reads frames until a control frame of type t arrives.
+func readControl(t *testing.T, r io.Reader, typ ControlFrameType) Frame {
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			t.Fatalf("waiting for %v: ReadFrame: %v", typ, err)
+		}
+		if f.Type() == typ {
+			return f
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error)
+	go func() { serveErr <- srv.Serve(l) }()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	hw := NewHeaderWriter(-1)
+	synStream(hw, 1, 0, FlagFin, getHeader("http://example.com/slow")).WriteTo(c)
+	<-started
+
+	shutdownErr := make(chan error)
+	go func() { shutdownErr <- srv.Shutdown(context.Background()) }()
+
+	f := readControl(t, r, TypeGoaway)
+	if id := binary.BigEndian.Uint32(f.Data); id != 1 {
+		t.Errorf("GOAWAY last-good-stream-id = %d, want 1", id)
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("Serve = %v, want %v", err, ErrServerClosed)
+	}
+
+	synStream(hw, 3, 0, FlagFin, getHeader("http://example.com/late")).WriteTo(c)
+	f = readControl(t, r, TypeRstStream)
+	if id, status := binary.BigEndian.Uint32(f.Data[0:4]), RstStreamStatus(binary.BigEndian.Uint32(f.Data[4:8])); id != 3 || status != RefusedStream {
+		t.Errorf("RST_STREAM = (%d, %v), want (3, %v)", id, status, RefusedStream)
+	}
+
+	close(release)
+	if _, body := readResponse(t, r, NewHeaderReader(), 1); string(body) != "done" {
+		t.Errorf("body = %q, want %q", body, "done")
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+	if _, err := ReadFrame(r); err != io.EOF {
+		t.Errorf("after Shutdown, ReadFrame = %v, want EOF", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	hang := make(chan struct{})
+	defer close(hang)
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-hang
+	})}
+	c, _ := testServerConn(t, srv)
+	synStream(NewHeaderWriter(-1), 1, 0, FlagFin, getHeader("http://example.com/hang")).WriteTo(c)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+	for deadline := time.Now().Add(time.Second); srv.numSessions() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions still open after forced shutdown", srv.numSessions())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// expectClosed reads from r until the connection is closed, failing if that
+// takes longer than limit.
+func expectClosed(t *testing.T, c net.Conn, r io.Reader, limit time.Duration) {
+	c.SetReadDeadline(time.Now().Add(limit))
+	for {
+		_, err := ReadFrame(r)
+		if err == nil {
+			continue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("connection still open after %v", limit)
+		}
+		return
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	c, r := testServerConn(t, &Server{ReadTimeout: 50 * time.Millisecond})
+	// Half of a frame header, then nothing.
+	c.Write([]byte{0x80, 0x02, 0x00, 0x01})
+	expectClosed(t, c, r, time.Second)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	c, r := testServerConn(t, &Server{
+		Handler:     http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	synStream(NewHeaderWriter(-1), 1, 0, FlagFin, getHeader("http://example.com/")).WriteTo(c)
+	readResponse(t, r, NewHeaderReader(), 1)
+	f := readControl(t, r, TypeGoaway)
+	if id := binary.BigEndian.Uint32(f.Data); id != 1 {
+		t.Errorf("GOAWAY last-good-stream-id = %d, want 1", id)
+	}
+	expectClosed(t, c, r, time.Second)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	writeErr := make(chan error, 1)
+	c, _ := testServerConn(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			buf := make([]byte, 1<<10)
+			for {
+				if _, err := w.Write(buf); err != nil {
+					writeErr <- err
+					return
+				}
+			}
+		}),
+		WriteTimeout: 50 * time.Millisecond,
+	})
+	synStream(NewHeaderWriter(-1), 1, 0, FlagFin, getHeader("http://example.com/big")).WriteTo(c)
+	// Never read the response.
+	select {
+	case err := <-writeErr:
+		if err == nil {
+			t.Error("Write succeeded on a stalled connection")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still writing to a stalled connection")
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	canceled := make(chan bool, 1)
+	c, r := testServerConn(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+				canceled <- true
+			case <-hang:
+				canceled <- false
+			}
+		}),
+		HandlerTimeout: 50 * time.Millisecond,
+	})
+	synStream(NewHeaderWriter(-1), 1, 0, FlagFin, getHeader("http://example.com/slow")).WriteTo(c)
+	h, _ := readResponse(t, r, NewHeaderReader(), 1)
+	if got := h.Get("Status"); got != "503 Service Unavailable" {
+		t.Errorf("status = %q, want %q", got, "503 Service Unavailable")
+	}
+	if !<-canceled {
+		t.Error("request context not canceled on timeout")
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	c, r := testServerConn(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			started <- struct{}{}
+			<-release
+		}),
+		MaxConcurrentStreams: 2,
+		InitialWindowSize:    1 << 20,
+	})
+
+	f := readControl(t, r, TypeSettings)
+	want := SettingsFrame(0, Settings{
+		{Id: SettingsMaxConcurrentStreams, Value: 2},
+		{Id: SettingsInitialWindowSize, Value: 1 << 20},
+	})
+	if !bytes.Equal(f.Data, want.Data) {
+		t.Errorf("SETTINGS = % x, want % x", f.Data, want.Data)
+	}
+
+	hw := NewHeaderWriter(-1)
+	synStream(hw, 1, 0, FlagFin, getHeader("http://example.com/1")).WriteTo(c)
+	synStream(hw, 3, 0, FlagFin, getHeader("http://example.com/3")).WriteTo(c)
+	<-started
+	<-started
+	synStream(hw, 5, 0, FlagFin, getHeader("http://example.com/5")).WriteTo(c)
+	f = readControl(t, r, TypeRstStream)
+	if id, status := binary.BigEndian.Uint32(f.Data[0:4]), RstStreamStatus(binary.BigEndian.Uint32(f.Data[4:8])); id != 5 || status != RefusedStream {
+		t.Errorf("RST_STREAM = (%d, %v), want (5, %v)", id, status, RefusedStream)
+	}
+	close(release)
+}
+
+func TestPingEcho(t *testing.T) {
+	c, r := testConn(t, nil)
+	// An even ID belongs to the server; it must not be echoed.
+	PingFrame(2).WriteTo(c)
+	PingFrame(7).WriteTo(c)
+	f := readControl(t, r, TypePing)
+	if id := binary.BigEndian.Uint32(f.Data); id != 7 {
+		t.Errorf("PING reply id = %d, want 7", id)
+	}
+}
+
+func TestPingKeepalive(t *testing.T) {
+	srv := &Server{PingInterval: 20 * time.Millisecond}
+	c, r := testServerConn(t, srv)
+	for i := 0; i < 2; i++ {
+		f := readControl(t, r, TypePing)
+		id := binary.BigEndian.Uint32(f.Data)
+		if id%2 != 0 {
+			t.Fatalf("server PING id %d is odd", id)
+		}
+		PingFrame(id).WriteTo(c)
+	}
+	// Wait for the reply to the second PING to be processed.
+	readControl(t, r, TypePing)
+	sessions := srv.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("len(Sessions()) = %d, want 1", len(sessions))
+	}
+	if sessions[0].RTT <= 0 {
+		t.Errorf("RTT = %v, want > 0", sessions[0].RTT)
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	c, r := testServerConn(t, &Server{
+		PingInterval: 20 * time.Millisecond,
+		PingTimeout:  20 * time.Millisecond,
+	})
+	readControl(t, r, TypePing)
+	// Never answer.
+	expectClosed(t, c, r, time.Second)
+}
+
+func TestHeadersFrame(t *testing.T) {
+	c, r := testConn(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.URL.Path)
+	}))
+	hw := NewHeaderWriter(-1)
+	synStream(hw, 1, 0, 0, getHeader("http://example.com/first")).WriteTo(c)
+	// HEADERS shares the compression context with SYN_STREAM.
+	buf := []byte{0, 0, 0, 1, 0, 0}
+	buf = append(buf, hw.Encode(http.Header{"X-Trailer": {"x"}})...)
+	ControlFrame(TypeHeaders, 0, buf).WriteTo(c)
+	DataFrame(1, FlagFin, nil).WriteTo(c)
+	hr := NewHeaderReader()
+	readResponse(t, r, hr, 1)
+
+	synStream(hw, 3, 0, FlagFin, getHeader("http://example.com/second")).WriteTo(c)
+	if _, body := readResponse(t, r, hr, 3); string(body) != "/second" {
+		t.Errorf("body = %q, want %q", body, "/second")
+	}
+}
+
+func TestMalformedHeaderBlock(t *testing.T) {
+	canceled := make(chan struct{})
+	c, r := testConn(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		close(canceled)
+	}))
+	hw := NewHeaderWriter(-1)
+	synStream(hw, 1, 0, FlagFin, getHeader("http://example.com/")).WriteTo(c)
+	f := synStream(hw, 3, 0, FlagFin, getHeader("http://example.com/truncated"))
+	f.Data = f.Data[:len(f.Data)-8]
+	f.WriteTo(c)
+
+	f = readControl(t, r, TypeGoaway)
+	if id := binary.BigEndian.Uint32(f.Data); id != 1 {
+		t.Errorf("GOAWAY last-good-stream-id = %d, want 1", id)
+	}
+	expectClosed(t, c, r, time.Second)
+	<-canceled
+}
+
+// logBuffer collects log output written by concurrent sessions.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// testLogger returns a logger writing every record to b.
+func testLogger(b *logBuffer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func TestHandlerPanic(t *testing.T) {
+	logs := new(logBuffer)
+	c, r := testServerConn(t, &Server{
+		Logger: testLogger(logs),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/before":
+				panic("before reply")
+			case "/after":
+				io.WriteString(w, "partial")
+				panic("after reply")
+			}
+			io.WriteString(w, "ok")
+		}),
+	})
+	hw := NewHeaderWriter(-1)
+	hr := NewHeaderReader()
+
+	synStream(hw, 1, 0, FlagFin, getHeader("http://example.com/before")).WriteTo(c)
+	h, _ := readResponse(t, r, hr, 1)
+	if got := h.Get("Status"); got != "500 Internal Server Error" {
+		t.Errorf("status = %q, want %q", got, "500 Internal Server Error")
+	}
+
+	synStream(hw, 3, 0, FlagFin, getHeader("http://example.com/after")).WriteTo(c)
+	var f Frame
+	for f.Type() != TypeRstStream {
+		var err error
+		if f, err = ReadFrame(r); err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		// Keep the header decompressor in step with the server.
+		if f.Type() == TypeSynReply {
+			hr.Decode(f.Data[6:])
+		}
+	}
+	if id, status := binary.BigEndian.Uint32(f.Data[0:4]), RstStreamStatus(binary.BigEndian.Uint32(f.Data[4:8])); id != 3 || status != InternalError {
+		t.Errorf("RST_STREAM = (%d, %v), want (3, %v)", id, status, InternalError)
+	}
+
+	// The session survives.
+	synStream(hw, 5, 0, FlagFin, getHeader("http://example.com/fine")).WriteTo(c)
+	if _, body := readResponse(t, r, hr, 5); string(body) != "ok" {
+		t.Errorf("body after panics = %q, want %q", body, "ok")
+	}
+
+	var panics []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "panic serving stream") {
+			panics = append(panics, line)
+		}
+	}
+	if len(panics) != 2 {
+		t.Fatalf("logged %d panics, want 2:\n%s", len(panics), logs)
+	}
+	for i, want := range []string{"stream=1 url=http://example.com/before", "stream=3 url=http://example.com/after"} {
+		if !strings.Contains(panics[i], "level=ERROR") || !strings.Contains(panics[i], "session=") || !strings.Contains(panics[i], want) {
+			t.Errorf("panic record %d = %q, want an ERROR with the session and %q", i, panics[i], want)
+		}
+	}
+}
+
+func TestLogFrames(t *testing.T) {
+	logs := new(logBuffer)
+	c, r := testServerConn(t, &Server{
+		Logger:    testLogger(logs),
+		LogFrames: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			io.WriteString(w, "ok")
+		}),
+	})
+	synStream(NewHeaderWriter(-1), 1, 0, FlagFin, getHeader("http://example.com/")).WriteTo(c)
+	readResponse(t, r, NewHeaderReader(), 1)
+	c.Close()
+	waitFor(t, "session end", func() bool { return strings.Contains(logs.String(), "session closed") })
+
+	out := logs.String()
+	for _, want := range []string{
+		`msg="spdy: frame received" session=1`,
+		"type=SYN_STREAM",
+		`msg="spdy: frame sent"`,
+		"type=SYN_REPLY",
+		"stream=1",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("frame log lacks %q:\n%s", want, out)
+		}
+	}
+
+	// Without LogFrames, no frames are logged.
+	logs = new(logBuffer)
+	c, r = testServerConn(t, &Server{Logger: testLogger(logs), Handler: http.NotFoundHandler()})
+	synStream(NewHeaderWriter(-1), 1, 0, FlagFin, getHeader("http://example.com/")).WriteTo(c)
+	readResponse(t, r, NewHeaderReader(), 1)
+	if strings.Contains(logs.String(), "spdy: frame") {
+		t.Errorf("frames logged without LogFrames:\n%s", logs)
+	}
+}
+
+// tempErr is a temporary net.Error such as EMFILE.
+type tempErr struct{}
+
+func (tempErr) Error() string   { return "too many open files" }
+func (tempErr) Timeout() bool   { return false }
+func (tempErr) Temporary() bool { return true }
+
+// flakyListener fails its first n Accepts with a temporary error.
+type flakyListener struct {
+	net.Listener
+	n int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.n > 0 {
+		l.n--
+		return nil, tempErr{}
+	}
+	return l.Listener.Accept()
+}
+
+// listen starts srv on a local port and returns its address.  The server
+// is closed when the test ends.
+func listen(t *testing.T, srv *Server, wrap func(net.Listener) net.Listener) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	if wrap != nil {
+		l = wrap(l)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return addr
+}
+
+func TestAcceptTemporaryError(t *testing.T) {
+	logs := new(logBuffer)
+	srv := &Server{
+		Logger: testLogger(logs),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			io.WriteString(w, "ok")
+		}),
+	}
+	addr := listen(t, srv, func(l net.Listener) net.Listener { return &flakyListener{l, 3} })
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	synStream(NewHeaderWriter(-1), 1, 0, FlagFin, getHeader("http://example.com/")).WriteTo(c)
+	if _, body := readResponse(t, bufio.NewReader(c), NewHeaderReader(), 1); string(body) != "ok" {
+		t.Errorf("body = %q, want %q", body, "ok")
+	}
+	if n := strings.Count(logs.String(), "level=WARN msg=\"spdy: accept error; retrying\""); n != 3 {
+		t.Errorf("logged %d accept retries, want 3:\n%s", n, logs)
+	}
+}
+
+func TestListenAndServeError(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:-1"}
+	if err := srv.ListenAndServe(); err == nil {
+		t.Error("ListenAndServe on a bad address succeeded")
+	}
+}
+
+// waitFor polls cond until it is true or a second has passed.
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", desc)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	srv := &Server{MaxConns: 1}
+	addr := listen(t, srv, nil)
+	// A connection becomes a session once it is seen to speak SPDY.
+	c1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	PingFrame(1).WriteTo(c1)
+	waitFor(t, "first session", func() bool { return srv.numSessions() == 1 })
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	PingFrame(1).WriteTo(c2)
+	time.Sleep(20 * time.Millisecond)
+	if n := srv.numSessions(); n != 1 {
+		t.Fatalf("%d sessions with MaxConns 1", n)
+	}
+	c1.Close()
+	waitFor(t, "second session", func() bool {
+		s := srv.Sessions()
+		return len(s) == 1 && s[0].RemoteAddr.String() == c2.LocalAddr().String()
+	})
+}
+
+func TestConnState(t *testing.T) {
+	var mu sync.Mutex
+	var states []ConnState
+	srv := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		ConnState: func(c net.Conn, state ConnState) {
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+		},
+	}
+	addr := listen(t, srv, nil)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	synStream(NewHeaderWriter(-1), 1, 0, FlagFin, getHeader("http://example.com/")).WriteTo(c)
+	readResponse(t, bufio.NewReader(c), NewHeaderReader(), 1)
+	waitFor(t, "idle session", func() bool {
+		s := srv.Sessions()
+		return len(s) == 1 && s[0].State == StateIdle
+	})
+
+	id := srv.Sessions()[0].ID
+	if !srv.CloseSession(id) {
+		t.Fatalf("CloseSession(%d) did not find the session", id)
+	}
+	waitFor(t, "closed session", func() bool { return srv.numSessions() == 0 })
+	c.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []ConnState{StateNew, StateActive, StateIdle, StateClosed}
+	if len(states) != len(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states = %v, want %v", states, want)
+		}
+	}
+}
+
+// post opens stream id with a POST for url, leaving the body to follow.
+func post(hw *HeaderWriter, id uint32, url string, contentLength int) Frame {
+	h := getHeader(url)
+	h.Set("method", "POST")
+	if contentLength >= 0 {
+		h.Set("Content-Length", strconv.Itoa(contentLength))
+	}
+	return synStream(hw, id, 0, 0, h)
+}
+
+// readRst reads frames until a RST_STREAM and returns its stream ID and
+// status.
+func readRst(t *testing.T, r io.Reader) (uint32, RstStreamStatus) {
+	return rstStream(readControl(t, r, TypeRstStream))
+}
+
+func TestRequestBodyBufferLimits(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	srv := &Server{
+		MaxStreamBufferBytes:  100,
+		MaxSessionBufferBytes: 150,
+		Logger:                testLogger(new(logBuffer)),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			<-hang // never read the body
+		}),
+	}
+	c, r := testServerConn(t, srv)
+	hw := NewHeaderWriter(-1)
+
+	// One stream overruns its own buffer.
+	post(hw, 1, "http://example.com/a", -1).WriteTo(c)
+	DataFrame(1, 0, make([]byte, 80)).WriteTo(c)
+	DataFrame(1, 0, make([]byte, 80)).WriteTo(c)
+	if id, status := readRst(t, r); id != 1 || status != FlowControlError {
+		t.Errorf("stream buffer overrun: RST_STREAM = (%d, %v), want (1, %v)", id, status, FlowControlError)
+	}
+
+	// Two streams within their own limits overrun the session's.
+	post(hw, 3, "http://example.com/b", -1).WriteTo(c)
+	post(hw, 5, "http://example.com/c", -1).WriteTo(c)
+	DataFrame(3, 0, make([]byte, 90)).WriteTo(c)
+	DataFrame(5, 0, make([]byte, 90)).WriteTo(c)
+	if id, status := readRst(t, r); id != 5 || status != FlowControlError {
+		t.Errorf("session buffer overrun: RST_STREAM = (%d, %v), want (5, %v)", id, status, FlowControlError)
+	}
+	waitFor(t, "stream 5 to be forgotten", func() bool {
+		infos := srv.Sessions()
+		return len(infos) == 1 && infos[0].Streams == 1
+	})
+}
+
+func TestRequestBodyFlowControl(t *testing.T) {
+	read := make(chan []byte)
+	srv := &Server{
+		InitialWindowSize: 100,
+		Logger:            testLogger(new(logBuffer)),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/stalled" {
+				<-req.Context().Done()
+			}
+			body, _ := io.ReadAll(req.Body)
+			read <- body
+		}),
+	}
+	c, r := testServerConn(t, srv)
+	hw := NewHeaderWriter(-1)
+
+	// The handler does not read, so the window is not replenished and a
+	// byte beyond it is an error.
+	post(hw, 1, "http://example.com/stalled", 250).WriteTo(c)
+	DataFrame(1, 0, make([]byte, 100)).WriteTo(c)
+	DataFrame(1, 0, make([]byte, 1)).WriteTo(c)
+	if id, status := readRst(t, r); id != 1 || status != FlowControlError {
+		t.Errorf("window overrun: RST_STREAM = (%d, %v), want (1, %v)", id, status, FlowControlError)
+	}
+	<-read
+
+	// A client that respects the window gets its whole body through.
+	post(hw, 3, "http://example.com/", 250).WriteTo(c)
+	window := 100
+	for sent := 0; sent < 250; {
+		n := min(window, 250-sent)
+		flags := FrameFlags(0)
+		if sent+n == 250 {
+			flags = FlagFin
+		}
+		DataFrame(3, flags, make([]byte, n)).WriteTo(c)
+		sent += n
+		window -= n
+		if window == 0 && sent < 250 {
+			f := readControl(t, r, TypeWindowUpdate)
+			window += int(binary.BigEndian.Uint32(f.Data[4:8]))
+		}
+	}
+	if body := <-read; len(body) != 250 {
+		t.Errorf("handler read %d bytes, want 250", len(body))
+	}
+}
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	errc := make(chan error, 1)
+	srv := &Server{
+		MaxRequestBodyBytes: 100,
+		Logger:              testLogger(new(logBuffer)),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, err := io.ReadAll(req.Body)
+			errc <- err
+		}),
+	}
+	c, r := testServerConn(t, srv)
+	hw, hr := NewHeaderWriter(-1), NewHeaderReader()
+
+	// A declared length over the limit is refused without the handler.
+	post(hw, 1, "http://example.com/", 101).WriteTo(c)
+	h, _ := readResponse(t, r, hr, 1)
+	if got := h.Get("Status"); got != "413 Request Entity Too Large" {
+		t.Errorf("declared length: status = %q, want 413", got)
+	}
+	if id, status := readRst(t, r); id != 1 || status != Cancel {
+		t.Errorf("declared length: RST_STREAM = (%d, %v), want (1, %v)", id, status, Cancel)
+	}
+
+	// An undeclared body that grows too large fails the handler's reads.
+	post(hw, 3, "http://example.com/", -1).WriteTo(c)
+	DataFrame(3, 0, make([]byte, 60)).WriteTo(c)
+	DataFrame(3, 0, make([]byte, 60)).WriteTo(c)
+	h, _ = readResponse(t, r, hr, 3)
+	if got := h.Get("Status"); got != "413 Request Entity Too Large" {
+		t.Errorf("streamed body: status = %q, want 413", got)
+	}
+	if id, status := readRst(t, r); id != 3 || status != Cancel {
+		t.Errorf("streamed body: RST_STREAM = (%d, %v), want (3, %v)", id, status, Cancel)
+	}
+	if err := <-errc; err != ErrBodyTooLarge {
+		t.Errorf("handler read error = %v, want %v", err, ErrBodyTooLarge)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("handler ran for the refused stream: %v", err)
+	default:
+	}
+}
+
+func TestRequestBodyReadDeadline(t *testing.T) {
+	errc := make(chan error, 1)
+	c, r := testConn(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+			errc <- err
+			return
+		}
+		_, err := io.ReadAll(req.Body)
+		errc <- err
+		w.WriteHeader(http.StatusRequestTimeout)
+	}))
+	hw := NewHeaderWriter(-1)
+	post(hw, 1, "http://example.com/", 100).WriteTo(c)
+	DataFrame(1, 0, make([]byte, 10)).WriteTo(c)
+	// The rest of the upload never comes.
+	if err := <-errc; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read of a stalled upload = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if h, _ := readResponse(t, r, NewHeaderReader(), 1); h.Get("Status") != "408 Request Timeout" {
+		t.Errorf("status = %q, want 408", h.Get("Status"))
+	}
+}
+
+func TestUnreadBodyResetsStream(t *testing.T) {
+	c, r := testConn(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "not interested")
+	}))
+	hw := NewHeaderWriter(-1)
+	post(hw, 1, "http://example.com/", 1000).WriteTo(c)
+	DataFrame(1, 0, make([]byte, 10)).WriteTo(c)
+
+	// The whole response arrives before the RST_STREAM that stops the
+	// upload.
+	if _, body := readResponse(t, r, NewHeaderReader(), 1); string(body) != "not interested" {
+		t.Errorf("body = %q, want %q", body, "not interested")
+	}
+	if id, status := readRst(t, r); id != 1 || status != Cancel {
+		t.Errorf("RST_STREAM = (%d, %v), want (1, %v)", id, status, Cancel)
+	}
+}
+
+func TestCloseBodyResetsStream(t *testing.T) {
+	release := make(chan struct{})
+	writeErr := make(chan error, 1)
+	c, r := testConn(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.ReadFull(req.Body, make([]byte, 5))
+		io.WriteString(w, "not interested")
+		req.Body.Close()
+		<-release
+		_, err := io.WriteString(w, "more")
+		writeErr <- err
+	}))
+	hw := NewHeaderWriter(-1)
+	post(hw, 1, "http://example.com/", 1000).WriteTo(c)
+	DataFrame(1, 0, make([]byte, 10)).WriteTo(c)
+	DataFrame(1, 0, make([]byte, 10)).WriteTo(c)
+
+	// The client is told to stop while the handler is still running, after
+	// the response written so far.  DATA that was already on its way when
+	// the body was closed must not reset the stream first.
+	body := new(bytes.Buffer)
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		if !f.IsControl() && f.StreamId() == 1 {
+			body.Write(f.Data)
+		}
+		if f.Type() == TypeRstStream {
+			if id, status := rstStream(f); id != 1 || status != Cancel {
+				t.Errorf("RST_STREAM = (%d, %v), want (1, %v)", id, status, Cancel)
+			}
+			break
+		}
+	}
+	if body.String() != "not interested" {
+		t.Errorf("body = %q, want %q", body, "not interested")
+	}
+	close(release)
+	if err := <-writeErr; err == nil {
+		t.Error("write after the stream was reset succeeded")
+	}
+}
@@ -0,0 +1,1299 @@
+// spdy/session.go
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A session manages a single TCP connection to a client.
+type session struct {
+	id      uint64 // assigned by Server.trackSession
+	created time.Time
+	srv     *Server
+	c       net.Conn
+	r       *bufio.Reader
+	handler http.Handler
+	out     *frameScheduler
+	log     *slog.Logger
+	version int // SPDY protocol version
+
+	mu           sync.Mutex
+	streams      map[uint32]*serverStream
+	lastStreamID uint32 // highest stream ID the client has used
+	lastGoodID   uint32 // highest stream ID accepted
+	goingAway    bool   // GOAWAY sent; refuse new streams
+	idleTimer    *time.Timer
+
+	origin        string   // key for the server's SettingsStore
+	localSettings Settings // values sent to the client
+	peerSettings  Settings // last values received from the client
+
+	pingID   uint32    // ID of the last PING sent; server IDs are even
+	pingSent time.Time // when it was sent, or zero once answered
+	rtt      time.Duration
+
+	stateMu   sync.Mutex // serializes changes to connState
+	connState ConnState  // protected by mu
+
+	bodyBuffered int             // request body bytes buffered for all streams; protected by mu
+	windowsHeld  []*serverStream // streams owed a WINDOW_UPDATE; protected by mu
+
+	// sessionUnacked counts the DATA bytes received but not yet returned
+	// to the client's SPDY/3.1 session window.  Only the read loop uses
+	// it.
+	sessionUnacked int
+
+	// Responses on SPDY/3 sessions keep to the client's windows once it
+	// announces SETTINGS_INITIAL_WINDOW_SIZE; clients that do not, such
+	// as those built on spdystream, never send WINDOW_UPDATEs either.
+	// Protected by mu.
+	sendCond   sync.Cond // signalled when a send window grows or a stream is forgotten
+	peerWindow int       // the client's initial stream window, or zero
+	sendWindow int       // the session's send window
+
+	framesIn, framesOut atomic.Int64
+	bytesIn, bytesOut   atomic.Int64
+
+	headerReader *HeaderReader
+}
+
+func newSession(srv *Server, c net.Conn, h http.Handler, version int) *session {
+	sess := &session{
+		created:      time.Now(),
+		srv:          srv,
+		c:            c,
+		r:            bufio.NewReader(c),
+		handler:      h,
+		version:      version,
+		out:          newFrameScheduler(c, newHeaderWriter(-1, version)),
+		streams:      make(map[uint32]*serverStream),
+		headerReader: newHeaderReader(version),
+		sendWindow:   defaultWindow3,
+	}
+	sess.sendCond.L = &sess.mu
+	sess.out.writeTimeout = srv.WriteTimeout
+	sess.origin = settingsOrigin(c.RemoteAddr())
+	sess.localSettings = srv.settings(sess.origin)
+	if version >= version3 {
+		// Announced even at SPDY/3's default, since the window is
+		// returned: a Transport only keeps to announced windows.
+		sess.localSettings.Set(SettingsInitialWindowSize, uint32(sess.initialWindow()))
+	}
+	sess.log = srv.logger()
+	return sess
+}
+
+func (sess *session) serve() {
+	sess.log = sess.srv.logger().With("session", sess.id, "remote", sess.c.RemoteAddr().String())
+	sess.log.Debug("spdy: session started")
+	sess.out.sent = func(f Frame, h http.Header, compressed int) {
+		countFrame(sess, f, false)
+		if h != nil {
+			countHeaders("out", h, compressed)
+		}
+		if sess.srv.LogFrames {
+			sess.logFrame("sent", f)
+		}
+	}
+	defer func() {
+		sess.c.Close()
+		sess.srv.trackSession(sess, false)
+		sess.setState(StateClosed)
+	}()
+	written := make(chan struct{})
+	go func() {
+		sess.out.run()
+		close(written)
+		// Unblock the read loop if the connection can no longer be written.
+		sess.c.Close()
+	}()
+	sess.out.writeControl(queuedFrame{frame: settingsFrame(sess.version, 0, sess.localSettings)})
+	if sess.srv.PingInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go sess.keepalive(done)
+	}
+	if d := sess.srv.IdleTimeout; d > 0 {
+		sess.mu.Lock()
+		sess.idleTimer = time.AfterFunc(d, sess.idle)
+		sess.mu.Unlock()
+		defer sess.idleTimer.Stop()
+	}
+
+	var err error
+	for {
+		var f Frame
+		f, err = sess.readFrame()
+		if err != nil {
+			break
+		}
+		countFrame(sess, f, true)
+		if sess.srv.LogFrames {
+			sess.logFrame("received", f)
+		}
+		if f.IsControl() {
+			err = sess.handleControl(f)
+		} else {
+			sess.handleData(f)
+		}
+		if err != nil {
+			sess.log.Warn("spdy: closing session after protocol error", "err", err)
+			sess.abort(written)
+			break
+		}
+	}
+	sess.out.close(err)
+	if err == io.EOF {
+		sess.log.Debug("spdy: session closed by client")
+	} else {
+		sess.log.Debug("spdy: session ended", "err", err)
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for _, st := range sess.streams {
+		if st.dataPipe != nil {
+			st.dataPipe.wclose(io.ErrUnexpectedEOF)
+		}
+		st.cancel()
+		sess.forgetStreamLocked(st)
+	}
+}
+
+// logFrame logs a frame for Server.LogFrames.
+func (sess *session) logFrame(dir string, f Frame) {
+	if f.IsControl() {
+		sess.log.Debug("spdy: frame "+dir, "type", f.Type().String(), "flags", f.Flags, "data", f.Data)
+	} else {
+		sess.log.Debug("spdy: frame "+dir, "stream", f.StreamId(), "flags", f.Flags, "data", f.Data)
+	}
+}
+
+// readFrame reads the next frame.  Waiting for a frame to begin is not
+// limited, but once its first byte arrives the rest must follow within
+// Server.ReadTimeout.
+func (sess *session) readFrame() (Frame, error) {
+	d := sess.srv.ReadTimeout
+	if d <= 0 {
+		return ReadFrame(sess.r)
+	}
+	if _, err := sess.r.Peek(1); err != nil {
+		return Frame{}, err
+	}
+	sess.c.SetReadDeadline(time.Now().Add(d))
+	defer sess.c.SetReadDeadline(time.Time{})
+	return ReadFrame(sess.r)
+}
+
+// handleControl handles a control frame.  An error means the session
+// cannot go on.
+func (sess *session) handleControl(frame Frame) error {
+	switch frame.Type() {
+	case TypeSynStream:
+		return sess.handleSynStream(frame)
+	case TypeHeaders:
+		// Only decoded to keep the decompressor in step.
+		if off := replyHeaderOffset(sess.version); len(frame.Data) >= off {
+			_, err := sess.headerReader.Decode(frame.Data[off:])
+			return err
+		}
+	case TypeRstStream:
+		sess.handleRstStream(frame)
+	case TypeSettings:
+		sess.handleSettings(frame)
+	case TypePing:
+		sess.handlePing(frame)
+	case TypeWindowUpdate:
+		sess.handleWindowUpdate(frame)
+	}
+	return nil
+}
+
+// errStreamIDOrder reports a SYN_STREAM whose ID is lower than that of an
+// earlier one, which the spec makes a session error.
+var errStreamIDOrder = errors.New("spdy: SYN_STREAM with a decreasing stream ID")
+
+// handleSynStream opens a stream and starts its handler.  Client streams
+// must have odd IDs that increase monotonically.  A SYN_STREAM that cannot
+// be parsed is an error: its header block leaves the shared decompressor
+// unusable for the rest of the session.  So is one whose ID is lower than
+// an earlier one, unless that stream is still open.
+func (sess *session) handleSynStream(frame Frame) error {
+	st, err := newServerStream(sess, frame)
+	if err != nil {
+		return err
+	}
+	sess.mu.Lock()
+	existing := sess.streams[st.id]
+	var status RstStreamStatus
+	switch {
+	case st.id == 0 || st.id%2 == 0:
+		status = ProtocolError
+	case existing != nil:
+		// A second SYN_STREAM for an open stream is a stream error
+		// that ends both.  SPDY/2 has no STREAM_IN_USE, and SPDY/3
+		// keeps it for a SYN_REPLY on an open stream, so both use
+		// PROTOCOL_ERROR.
+		status = ProtocolError
+	case st.id <= sess.lastStreamID:
+		sess.mu.Unlock()
+		return errStreamIDOrder
+	case sess.goingAway || uint32(len(sess.streams)) >= sess.srv.maxConcurrentStreams():
+		sess.lastStreamID = st.id
+		status = RefusedStream
+	}
+	if status != 0 {
+		sess.mu.Unlock()
+		sess.log.Debug("spdy: rejecting stream", "stream", st.id, "status", status.String())
+		if existing != nil {
+			existing.reset()
+			sess.streamEvent(existing, eventSendRst)
+		}
+		sess.out.writeControl(queuedFrame{frame: RstStreamFrame(st.id, status)})
+		return nil
+	}
+	sess.streams[st.id] = st
+	st.sendWindow = sess.peerWindow
+	st.opened = time.Now()
+	metricStreams.Add(1)
+	metricStreamsTotal.Add(1)
+	sess.lastStreamID = st.id
+	sess.lastGoodID = st.id
+	if sess.idleTimer != nil {
+		sess.idleTimer.Stop()
+	}
+	sess.mu.Unlock()
+	sess.out.openStream(st.id, st.priority)
+	sess.updateState()
+	go st.serve()
+	return nil
+}
+
+// handleRstStream aborts a stream the client has reset.
+func (sess *session) handleRstStream(frame Frame) {
+	if len(frame.Data) != 8 {
+		return
+	}
+	id := binary.BigEndian.Uint32(frame.Data[0:4]) & 0x7fffffff
+	sess.mu.Lock()
+	st, found := sess.streams[id]
+	sess.mu.Unlock()
+	if found {
+		sess.log.Debug("spdy: stream reset by client", "stream", id, "status", RstStreamStatus(binary.BigEndian.Uint32(frame.Data[4:8])).String())
+		st.reset()
+		sess.streamEvent(st, eventRecvRst)
+	}
+}
+
+// handlePing echoes PINGs initiated by the client and records the round-trip
+// time when one of the server's own PINGs comes back.
+func (sess *session) handlePing(frame Frame) {
+	if len(frame.Data) != 4 {
+		return
+	}
+	id := binary.BigEndian.Uint32(frame.Data)
+	if id%2 == 1 {
+		sess.out.writeControl(queuedFrame{frame: PingFrame(id)})
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if id == sess.pingID && !sess.pingSent.IsZero() {
+		sess.rtt = time.Since(sess.pingSent)
+		sess.pingSent = time.Time{}
+	}
+}
+
+// keepalive sends a PING every Server.PingInterval and closes the session
+// if one goes unanswered for Server.PingTimeout.
+func (sess *session) keepalive(done <-chan struct{}) {
+	t := time.NewTimer(sess.srv.PingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		sess.mu.Lock()
+		sess.pingID += 2
+		sess.pingSent = time.Now()
+		id := sess.pingID
+		sess.mu.Unlock()
+		sess.out.writeControl(queuedFrame{frame: PingFrame(id)})
+
+		t.Reset(sess.srv.pingTimeout())
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		sess.mu.Lock()
+		answered := sess.pingSent.IsZero()
+		sess.mu.Unlock()
+		if !answered {
+			sess.log.Warn("spdy: PING unanswered; closing session")
+			sess.c.Close()
+			return
+		}
+		t.Reset(sess.srv.PingInterval)
+	}
+}
+
+// info returns a description of the session for Server.Sessions.
+func (sess *session) info() SessionInfo {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	info := SessionInfo{
+		ID:           sess.id,
+		RemoteAddr:   sess.c.RemoteAddr(),
+		Version:      sess.version,
+		State:        sess.connState,
+		Streams:      len(sess.streams),
+		Created:      sess.created,
+		RTT:          sess.rtt,
+		GoingAway:    sess.goingAway,
+		Settings:     append(Settings(nil), sess.localSettings...),
+		PeerSettings: append(Settings(nil), sess.peerSettings...),
+		FramesIn:     sess.framesIn.Load(),
+		FramesOut:    sess.framesOut.Load(),
+		BytesIn:      sess.bytesIn.Load(),
+		BytesOut:     sess.bytesOut.Load(),
+	}
+	for _, st := range sess.streams {
+		info.OpenStreams = append(info.OpenStreams, StreamInfo{
+			ID:       st.id,
+			Priority: st.priority,
+			URL:      st.url,
+			State:    st.state.String(),
+			Opened:   st.opened,
+			BytesIn:  st.bytesIn.Load(),
+			BytesOut: st.bytesOut.Load(),
+		})
+	}
+	sort.Slice(info.OpenStreams, func(i, j int) bool { return info.OpenStreams[i].ID < info.OpenStreams[j].ID })
+	return info
+}
+
+// handleSettings records the client's SETTINGS and updates the server's
+// persisted values for the client.
+func (sess *session) handleSettings(frame Frame) {
+	settings, err := DecodeSettings(sess.version, frame.Data)
+	if err != nil {
+		sess.log.Warn("spdy: malformed SETTINGS", "err", err)
+		return
+	}
+	sess.mu.Lock()
+	for _, setting := range settings {
+		sess.peerSettings.Set(setting.Id, setting.Value)
+	}
+	if v, ok := settings.Get(SettingsInitialWindowSize); ok && sess.version >= version3 {
+		for _, st := range sess.streams {
+			if sess.peerWindow == 0 {
+				// Streams opened before flow control started have
+				// sent without a window.
+				st.sendWindow = int(v) - int(st.bytesOut.Load())
+			} else {
+				st.sendWindow += int(v) - sess.peerWindow
+			}
+		}
+		sess.peerWindow = int(v)
+		sess.sendCond.Broadcast()
+	}
+	sess.mu.Unlock()
+
+	store := sess.srv.SettingsStore
+	if store == nil {
+		return
+	}
+	if frame.Flags&FlagClearPreviouslyPersistedSettings != 0 {
+		store.Clear(sess.origin)
+	}
+	var persist Settings
+	for _, setting := range settings {
+		if setting.Flags&FlagSettingsPersistValue != 0 {
+			persist = append(persist, setting)
+		}
+	}
+	if len(persist) > 0 {
+		store.Store(sess.origin, persist)
+	}
+}
+
+// handleWindowUpdate grows a SPDY/3 send window: the session's for stream
+// 0, otherwise the stream's.
+func (sess *session) handleWindowUpdate(frame Frame) {
+	if len(frame.Data) != 8 || sess.version < version3 {
+		return
+	}
+	id := binary.BigEndian.Uint32(frame.Data[0:4]) & 0x7fffffff
+	delta := int(binary.BigEndian.Uint32(frame.Data[4:8]) & 0x7fffffff)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if id == 0 {
+		sess.sendWindow += delta
+	} else if st := sess.streams[id]; st != nil {
+		st.sendWindow += delta
+	}
+	sess.sendCond.Broadcast()
+}
+
+func (sess *session) handleData(frame Frame) {
+	id := frame.StreamId()
+	sess.ackSessionData(len(frame.Data))
+	sess.mu.Lock()
+	st, found := sess.streams[id]
+	sess.mu.Unlock()
+	if !found {
+		sess.log.Debug("spdy: DATA on unknown stream", "stream", id)
+		sess.out.writeControl(queuedFrame{frame: RstStreamFrame(id, InvalidStream)})
+		return
+	}
+	event := eventRecvData
+	if frame.Flags&FlagFin != 0 {
+		event = eventRecvFin
+	}
+	if status := sess.streamEvent(st, event); status != 0 {
+		sess.log.Debug("spdy: DATA on closed stream", "stream", id, "state", st.state.String())
+		sess.out.writeControl(queuedFrame{frame: RstStreamFrame(id, status)})
+		st.reset()
+		return
+	}
+	st.bytesIn.Add(int64(len(frame.Data)))
+	if st.dataPipe == nil {
+		return
+	}
+	switch err := sess.receiveBody(st, frame); err {
+	case ErrBodyTooLarge:
+		sess.log.Warn("spdy: request body too large", "stream", id)
+		st.rejectBody()
+	case errFlowControl:
+		sess.log.Warn("spdy: request body buffer overrun", "stream", id)
+		sess.out.writeControl(queuedFrame{frame: RstStreamFrame(id, FlowControlError)})
+		st.reset()
+		sess.streamEvent(st, eventSendRst)
+	}
+}
+
+// streamEvent moves a stream to its next state and forgets it once it is
+// closed.  If the event is not allowed, the stream is closed and the status
+// for the RST_STREAM the caller must send is returned.
+func (sess *session) streamEvent(st *serverStream, e streamEvent) RstStreamStatus {
+	sess.mu.Lock()
+	var status RstStreamStatus
+	st.state, status = st.state.transition(e)
+	removed := st.state == stateClosed && sess.streams[st.id] == st
+	if removed {
+		sess.removeStreamLocked(st.id)
+	}
+	sess.mu.Unlock()
+	if removed {
+		sess.updateState()
+	}
+	return status
+}
+
+// updateState moves the session between StateActive and StateIdle
+// according to whether it has open streams.
+func (sess *session) updateState() {
+	sess.stateMu.Lock()
+	defer sess.stateMu.Unlock()
+	sess.mu.Lock()
+	state := StateIdle
+	if len(sess.streams) > 0 {
+		state = StateActive
+	}
+	sess.mu.Unlock()
+	sess.setStateLocked(state)
+}
+
+func (sess *session) setState(state ConnState) {
+	sess.stateMu.Lock()
+	defer sess.stateMu.Unlock()
+	sess.setStateLocked(state)
+}
+
+// setStateLocked records the session's ConnState and reports changes to
+// Server.ConnState.  A new session stays StateNew until its first stream,
+// and nothing follows StateClosed.  sess.stateMu must be held.
+func (sess *session) setStateLocked(state ConnState) {
+	sess.mu.Lock()
+	old := sess.connState
+	if old == state || old == StateClosed || old == StateNew && state == StateIdle {
+		sess.mu.Unlock()
+		return
+	}
+	sess.connState = state
+	sess.mu.Unlock()
+	if hook := sess.srv.ConnState; hook != nil {
+		hook(sess.c, state)
+	}
+}
+
+// removeStreamLocked forgets a closed stream.  A session that has sent
+// GOAWAY closes once its last stream is removed.
+func (sess *session) removeStreamLocked(id uint32) {
+	sess.forgetStreamLocked(sess.streams[id])
+	if len(sess.streams) > 0 {
+		return
+	}
+	if sess.goingAway {
+		sess.out.drain()
+	} else if sess.idleTimer != nil {
+		sess.idleTimer.Reset(sess.srv.IdleTimeout)
+	}
+}
+
+// forgetStreamLocked deletes st from the session's streams and records its
+// lifetime.
+func (sess *session) forgetStreamLocked(st *serverStream) {
+	delete(sess.streams, st.id)
+	sess.bodyBuffered -= st.buffered
+	st.buffered = 0
+	st.bodyClosed = true
+	sess.releaseWindowsLocked()
+	sess.sendCond.Broadcast()
+	metricStreams.Add(-1)
+	metricStreamTime.observe(time.Since(st.opened))
+}
+
+// idle is called when the session has had no active streams for
+// Server.IdleTimeout.
+func (sess *session) idle() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if len(sess.streams) == 0 {
+		sess.log.Debug("spdy: session idle; sending GOAWAY")
+		sess.goAwayLocked(goawayOK)
+	}
+}
+
+// abortTimeout bounds how long abort waits for the GOAWAY to be written.
+const abortTimeout = time.Second
+
+// abort ends a session that cannot go on.  Its streams are reset, and the
+// client gets a GOAWAY before the connection is closed.  written is closed
+// once the frame scheduler has stopped.
+func (sess *session) abort(written <-chan struct{}) {
+	sess.mu.Lock()
+	streams := make([]*serverStream, 0, len(sess.streams))
+	for _, st := range sess.streams {
+		streams = append(streams, st)
+	}
+	sess.mu.Unlock()
+	for _, st := range streams {
+		st.reset()
+	}
+	sess.mu.Lock()
+	sess.goAwayLocked(goawayProtocolError)
+	sess.out.drain()
+	sess.mu.Unlock()
+	t := time.NewTimer(abortTimeout)
+	defer t.Stop()
+	select {
+	case <-written:
+	case <-t.C:
+	}
+}
+
+// goAway sends GOAWAY with the last accepted stream ID.  Later SYN_STREAMs
+// are refused, and the session closes when its active streams finish.
+func (sess *session) goAway() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.goAwayLocked(goawayOK)
+}
+
+// goAwayLocked sends GOAWAY once.  SPDY/3 sends status with it.
+func (sess *session) goAwayLocked(status uint32) {
+	if sess.goingAway {
+		return
+	}
+	sess.goingAway = true
+	sess.out.writeControl(queuedFrame{frame: goawayFrame(sess.version, sess.lastGoodID, status)})
+	if len(sess.streams) == 0 {
+		sess.out.drain()
+	}
+}
+
+// A serverStream is a logical data stream inside a session.  A serverStream
+// services a single request.
+type serverStream struct {
+	id       uint32
+	priority uint8
+	session  *session
+
+	requestHeaders  http.Header // becomes the handler's req.Header
+	responseHeaders http.Header
+
+	// url is the request's URL, kept apart from requestHeaders so that
+	// Server.Sessions can read it while the handler changes req.Header.
+	url string
+
+	// ctx is the request's context; cancel is called when the stream is
+	// reset or the session ends.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	state  streamState // protected by session.mu
+	opened time.Time   // when the stream was accepted
+
+	bytesIn, bytesOut atomic.Int64 // DATA payload received and sent
+
+	// Request body accounting, protected by session.mu.
+	buffered   int  // bytes received but not yet read by the handler
+	window     int  // bytes the client may still send, with flow control
+	unacked    int  // bytes read but not yet returned to the window
+	windowHeld bool // on session.windowsHeld
+	bodyClosed bool // the handler stopped reading; data is discarded
+	blocking   bool // the body holds back the read loop; see receiveBlocking
+
+	sendWindow int // response bytes the client accepts; protected by session.mu
+
+	mu          sync.Mutex // protects closed and wroteHeader
+	closed      bool
+	wroteHeader bool
+
+	dataPipe *asyncPipe
+}
+
+func newServerStream(sess *session, frame Frame) (st *serverStream, err error) {
+	if frame.Type() != TypeSynStream {
+		err = errors.New("Server stream must be created from a SynStream frame")
+		return
+	}
+	st = &serverStream{
+		session:         sess,
+		responseHeaders: make(http.Header),
+		state:           initialState(frame.Flags),
+	}
+	st.ctx, st.cancel = context.WithCancel(context.WithValue(context.Background(), sessionKey{}, sess))
+	if frame.Flags&FlagFin == 0 {
+		// Request body will follow
+		st.window = sess.initialWindow()
+		st.blocking = sess.version >= version3 && sess.peerWindow == 0
+		st.dataPipe = newAsyncPipe(max(sess.srv.maxStreamBufferBytes(), st.window), st.blocking)
+	}
+	// Read frame data
+	data := bytes.NewBuffer(frame.Data)
+	var assocId uint32
+	var pri uint16
+	err = binary.Read(data, binary.BigEndian, &st.id)
+	if err != nil {
+		return
+	}
+	err = binary.Read(data, binary.BigEndian, &assocId)
+	if err != nil {
+		return
+	}
+	err = binary.Read(data, binary.BigEndian, &pri)
+	if err != nil {
+		return
+	}
+	st.id &= 0x7fffffff
+	st.priority = synStreamPriority(sess.version, pri)
+	st.requestHeaders, err = sess.headerReader.Decode(data.Bytes())
+	if err == nil {
+		st.url = st.requestHeaders.Get("url")
+		countHeaders("in", st.requestHeaders, data.Len())
+	}
+	return
+}
+
+// sessionKey is the context key under which a stream's context holds its
+// session.
+type sessionKey struct{}
+
+// IsSPDY reports whether req arrived over a SPDY session.
+func IsSPDY(req *http.Request) bool {
+	_, ok := req.Context().Value(sessionKey{}).(*session)
+	return ok
+}
+
+// Request returns the request data associated with the serverStream.
+func (st *serverStream) Request() (req *http.Request) {
+	req = &http.Request{
+		Method:     strings.ToUpper(st.requestHeaders.Get("method")),
+		Proto:      st.requestHeaders.Get("version"),
+		Header:     st.requestHeaders,
+		Body:       requestBody{st},
+		RemoteAddr: st.session.c.RemoteAddr().String(),
+	}
+	req.ProtoMajor, req.ProtoMinor, _ = http.ParseHTTPVersion(strings.ToUpper(req.Proto))
+	req.URL, _ = url.Parse(st.requestHeaders.Get("url"))
+	if req.URL == nil {
+		req.URL = new(url.URL)
+	}
+	req.RequestURI = req.URL.RequestURI()
+	req.Host = req.URL.Host
+	if tc, ok := st.session.c.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		req.TLS = &state
+	}
+	req.ContentLength = -1
+	if st.dataPipe == nil {
+		req.ContentLength = 0
+	} else if n, err := strconv.ParseInt(st.requestHeaders.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+		req.ContentLength = n
+	}
+	req = req.WithContext(st.ctx)
+	return
+}
+
+// requestBody reads the DATA frames sent by the client on a stream.
+type requestBody struct {
+	st *serverStream
+}
+
+func (b requestBody) Read(p []byte) (n int, err error) {
+	if b.st.dataPipe == nil {
+		return 0, io.EOF
+	}
+	n, err = b.st.dataPipe.read(p)
+	if n > 0 {
+		b.st.session.bodyRead(b.st, n)
+	}
+	return
+}
+
+// WriteTo hands the DATA payloads of the body to w as they arrive, without
+// copying them.  io.Copy uses it.
+func (b requestBody) WriteTo(w io.Writer) (n int64, err error) {
+	if b.st.dataPipe == nil {
+		return 0, nil
+	}
+	for {
+		chunk, err := b.st.dataPipe.next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		b.st.session.bodyRead(b.st, len(chunk))
+		m, err := w.Write(chunk)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close stops the request body.  If the client is still sending it, the
+// stream is reset with CANCEL once the frames already queued for it are
+// out.  SPDY cannot stop an upload without ending the stream, so later
+// writes to the response fail.
+func (b requestBody) Close() error {
+	if b.st.closeBody() {
+		b.st.cancelUpload()
+	}
+	return nil
+}
+
+// ErrBodyTooLarge is returned by reads of a request body that exceeded
+// Server.MaxRequestBodyBytes.
+var ErrBodyTooLarge = errors.New("spdy: request body too large")
+
+// errFlowControl reports request body data beyond the window or the buffer
+// limits.
+var errFlowControl = errors.New("spdy: request body buffer overrun")
+
+// flowControl reports whether request bodies are flow controlled.  SPDY/3
+// always uses flow control.
+func (sess *session) flowControl() bool {
+	return sess.srv.InitialWindowSize != 0 || sess.version >= version3
+}
+
+// initialWindow returns the window each stream starts with, or zero
+// without flow control.
+func (sess *session) initialWindow() int {
+	if sess.srv.InitialWindowSize == 0 && sess.version >= version3 {
+		return defaultWindow3
+	}
+	return int(sess.srv.InitialWindowSize)
+}
+
+// ackSessionData returns n bytes of DATA to the client's SPDY/3.1 session
+// window, in batches of half the window.  The stream windows and
+// Server.MaxSessionBufferBytes already bound what the session buffers, so
+// the bytes are returned as soon as they arrive, whichever stream they are
+// for.
+func (sess *session) ackSessionData(n int) {
+	if sess.version < version3 {
+		return
+	}
+	sess.sessionUnacked += n
+	if sess.sessionUnacked >= defaultWindow3/2 {
+		sess.out.writeControl(queuedFrame{frame: WindowUpdateFrame(0, uint32(sess.sessionUnacked))})
+		sess.sessionUnacked = 0
+	}
+}
+
+// receiveBody passes the payload of a DATA frame to the stream's request
+// body, enforcing the buffer limits and Server.MaxRequestBodyBytes.
+func (sess *session) receiveBody(st *serverStream, frame Frame) error {
+	if st.blocking {
+		return sess.receiveBlocking(st, frame)
+	}
+	n := len(frame.Data)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if st.bodyClosed {
+		// Nobody reads the data, but the end of the body still matters
+		// to closeBody.
+		if frame.Flags&FlagFin != 0 {
+			st.dataPipe.wclose(nil)
+		}
+		return nil
+	}
+	if max := sess.srv.MaxRequestBodyBytes; max > 0 && st.bytesIn.Load() > max {
+		st.dataPipe.wclose(ErrBodyTooLarge)
+		return ErrBodyTooLarge
+	}
+	if sess.flowControl() {
+		// The session's limit is kept by holding back WINDOW_UPDATEs, so
+		// only a client that overruns its window is at fault.
+		if n > st.window {
+			return errFlowControl
+		}
+		st.window -= n
+	} else if sess.bodyBuffered+n > sess.srv.maxSessionBufferBytes() {
+		return errFlowControl
+	}
+	// The pipe's capacity is the stream's buffer limit.
+	if _, err := st.dataPipe.write(frame.Data); err == errPipeFull {
+		return errFlowControl
+	} else if err != nil {
+		return nil
+	}
+	st.buffered += n
+	sess.bodyBuffered += n
+	if frame.Flags&FlagFin != 0 {
+		st.dataPipe.wclose(nil)
+	}
+	return nil
+}
+
+// receiveBlocking passes the payload of a DATA frame to a request body
+// whose pipe blocks, waiting while the stream's buffer is full.  SPDY/3
+// clients that do not announce SETTINGS_INITIAL_WINDOW_SIZE, such as those
+// built on spdystream, ignore the windows, so their uploads are held back
+// by not reading the connection instead.  A handler that neither reads nor
+// closes its body stalls the session until it returns.
+func (sess *session) receiveBlocking(st *serverStream, frame Frame) error {
+	if max := sess.srv.MaxRequestBodyBytes; max > 0 && st.bytesIn.Load() > max {
+		st.dataPipe.wclose(ErrBodyTooLarge)
+		return ErrBodyTooLarge
+	}
+	// An error means the body was closed or the stream reset.
+	st.dataPipe.writeAll(frame.Data)
+	if frame.Flags&FlagFin != 0 {
+		st.dataPipe.wclose(nil)
+	}
+	return nil
+}
+
+// bodyRead records that the handler has read n bytes of st's request body.
+// With flow control the bytes are returned to the client's window.
+func (sess *session) bodyRead(st *serverStream, n int) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if st.bodyClosed || st.blocking {
+		return
+	}
+	st.buffered -= n
+	sess.bodyBuffered -= n
+	if !sess.flowControl() {
+		return
+	}
+	st.unacked += n
+	sess.releaseWindowsLocked()
+	sess.updateWindowLocked(st)
+}
+
+// updateWindowLocked returns the bytes read from st's request body to the
+// client's window, in batches of half the initial window so that
+// WINDOW_UPDATEs stay rare.  While the session buffers
+// Server.MaxSessionBufferBytes or more, the update is held back until
+// releaseWindowsLocked finds room, so clients wait rather than overrun the
+// server.  sess.mu must be held.
+func (sess *session) updateWindowLocked(st *serverStream) {
+	if st.state != stateOpen && st.state != stateHalfClosedLocal {
+		return // the client has finished sending
+	}
+	if st.unacked < sess.initialWindow()/2 {
+		return
+	}
+	if sess.bodyBuffered >= sess.srv.maxSessionBufferBytes() {
+		if !st.windowHeld {
+			st.windowHeld = true
+			sess.windowsHeld = append(sess.windowsHeld, st)
+		}
+		return
+	}
+	st.window += st.unacked
+	sess.out.writeControl(queuedFrame{frame: WindowUpdateFrame(st.id, uint32(st.unacked))})
+	st.unacked = 0
+}
+
+// releaseWindowsLocked sends the WINDOW_UPDATEs held back by
+// updateWindowLocked, oldest first, while the session has room for them.
+// sess.mu must be held.
+func (sess *session) releaseWindowsLocked() {
+	for len(sess.windowsHeld) > 0 && sess.bodyBuffered < sess.srv.maxSessionBufferBytes() {
+		st := sess.windowsHeld[0]
+		sess.windowsHeld[0] = nil
+		sess.windowsHeld = sess.windowsHeld[1:]
+		st.windowHeld = false
+		if sess.streams[st.id] == st && !st.bodyClosed {
+			sess.updateWindowLocked(st)
+		}
+	}
+}
+
+// closeBody stops the request body.  Buffered and later data is discarded.
+// It reports whether the client was still sending the body, and only does
+// so once.
+func (st *serverStream) closeBody() (unfinished bool) {
+	if st.dataPipe == nil {
+		return false
+	}
+	sess := st.session
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if st.bodyClosed {
+		return false
+	}
+	unfinished = st.dataPipe.rclose()
+	st.bodyClosed = true
+	sess.bodyBuffered -= st.buffered
+	st.buffered = 0
+	sess.releaseWindowsLocked()
+	return unfinished
+}
+
+// Header returns the current response headers.
+func (st *serverStream) Header() http.Header {
+	return st.responseHeaders
+}
+
+var errStreamClosed = errors.New("Write on closed serverStream")
+
+// startWrite sends the reply headers if they have not been sent yet and
+// reports whether the stream still accepts data.
+func (st *serverStream) startWrite() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return errStreamClosed
+	}
+	st.writeHeaderLocked(http.StatusOK)
+	return nil
+}
+
+func (st *serverStream) Write(p []byte) (n int, err error) {
+	if err = st.startWrite(); err != nil {
+		return
+	}
+	max := st.session.srv.maxDataFrameSize()
+	for len(p) > 0 {
+		var size int
+		size, err = st.reserveSend(min(len(p), max))
+		if err != nil {
+			return
+		}
+		data := make([]byte, size)
+		copy(data, p)
+		err = st.session.out.writeStream(st.id, queuedFrame{frame: DataFrame(st.id, 0, data)})
+		if err != nil {
+			return
+		}
+		st.bytesOut.Add(int64(size))
+		p = p[size:]
+		n += size
+	}
+	return
+}
+
+// ReadFrom reads r until EOF, filling each DATA frame directly from r rather
+// than copying through an intermediate buffer.  io.Copy uses it, so serving
+// files does not hold the whole response in memory.
+func (st *serverStream) ReadFrom(r io.Reader) (n int64, err error) {
+	if err = st.startWrite(); err != nil {
+		return
+	}
+	max := st.session.srv.maxDataFrameSize()
+	for {
+		data := make([]byte, max)
+		nr, rerr := r.Read(data)
+		for p := data[:nr]; len(p) > 0; {
+			var size int
+			size, err = st.reserveSend(len(p))
+			if err != nil {
+				return
+			}
+			err = st.session.out.writeStream(st.id, queuedFrame{frame: DataFrame(st.id, 0, p[:size])})
+			if err != nil {
+				return
+			}
+			st.bytesOut.Add(int64(size))
+			n += int64(size)
+			p = p[size:]
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// reserveSend waits until the response may send some of n bytes and
+// returns how many.  Only SPDY/3 sessions whose client announced its
+// window wait.  It fails once the stream has been forgotten.
+func (st *serverStream) reserveSend(n int) (int, error) {
+	sess := st.session
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for {
+		if sess.version < version3 || sess.peerWindow == 0 {
+			return n, nil
+		}
+		if sess.streams[st.id] != st {
+			return 0, errStreamClosed
+		}
+		if st.sendWindow > 0 && sess.sendWindow > 0 {
+			n = min(n, st.sendWindow, sess.sendWindow)
+			st.sendWindow -= n
+			sess.sendWindow -= n
+			return n, nil
+		}
+		sess.sendCond.Wait()
+	}
+}
+
+// SetReadDeadline sets a deadline for reading the request body.  Reads
+// blocked past it fail with os.ErrDeadlineExceeded.  A zero t means no
+// deadline.  It makes http.ResponseController.SetReadDeadline work.
+func (st *serverStream) SetReadDeadline(t time.Time) error {
+	if st.dataPipe != nil {
+		st.dataPipe.setReadDeadline(t)
+	}
+	return nil
+}
+
+// hopHeaders are connection-specific headers that SPDY forbids.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+}
+
+func (st *serverStream) WriteHeader(code int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return
+	}
+	st.writeHeaderLocked(code)
+}
+
+func (st *serverStream) writeHeaderLocked(code int) {
+	if st.wroteHeader {
+		return
+	}
+	st.wroteHeader = true
+	h := make(http.Header, len(st.responseHeaders)+2)
+	for k, v := range st.responseHeaders {
+		h[k] = append([]string(nil), v...)
+	}
+	st.writeReply(code, h, 0)
+}
+
+// writeReply queues a SYN_REPLY carrying the given status and headers.
+func (st *serverStream) writeReply(code int, h http.Header, flags FrameFlags) {
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+	h.Set("status", strconv.Itoa(code)+" "+http.StatusText(code))
+	h.Set("version", "HTTP/1.1")
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	if h.Get("Date") == "" {
+		h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	// Stream ID, followed by 16 unused bits in SPDY/2; the header block
+	// is compressed when the frame is written.
+	data := make([]byte, replyHeaderOffset(st.session.version))
+	binary.BigEndian.PutUint32(data, st.id&0x7fffffff)
+	st.session.out.writeControl(queuedFrame{frame: ControlFrame(TypeSynReply, flags, data), header: h})
+}
+
+// Close sends a closing frame, thus preventing the server from sending more
+// data over the stream.  The client may still send data.
+func (st *serverStream) Close() (err error) {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return
+	}
+	st.closed = true
+	st.mu.Unlock()
+	err = st.session.out.writeStream(st.id, queuedFrame{frame: DataFrame(st.id, FlagFin, []byte{})})
+	st.session.out.finishStream(st.id)
+	if err == nil {
+		st.session.streamEvent(st, eventSendFin)
+	}
+	return
+}
+
+// serve runs the handler for the stream's request.
+func (st *serverStream) serve() {
+	req := st.Request()
+	if d := st.session.srv.HandlerTimeout; d > 0 {
+		// The context is canceled only after the stream has been
+		// abandoned, so a handler that returns on cancellation cannot
+		// race the 503.
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		req = req.WithContext(ctx)
+		t := time.AfterFunc(d, func() {
+			st.timeout()
+			cancel()
+		})
+		defer t.Stop()
+	}
+	defer st.recover(req)
+	if max := st.session.srv.MaxRequestBodyBytes; max > 0 && req.ContentLength > max {
+		st.session.log.Warn("spdy: request body too large", "stream", st.id, "content-length", req.ContentLength)
+		st.rejectBody()
+		return
+	}
+	st.session.handler.ServeHTTP(st, req)
+	st.finish()
+}
+
+// timeout abandons a stream whose handler ran past Server.HandlerTimeout.
+func (st *serverStream) timeout() {
+	st.session.log.Warn("spdy: handler timed out", "stream", st.id)
+	st.abandon(http.StatusServiceUnavailable)
+}
+
+// abandon ends a stream whose handler cannot be relied on to finish it.
+// The client gets a reply with the given status code if none was sent yet,
+// otherwise the stream is reset with INTERNAL_ERROR.  Later writes by the
+// handler fail.
+func (st *serverStream) abandon(code int) {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return
+	}
+	st.closed = true
+	event := eventSendFin
+	if !st.wroteHeader {
+		st.wroteHeader = true
+		st.writeReply(code, make(http.Header), FlagFin)
+	} else {
+		st.session.out.writeControl(queuedFrame{frame: RstStreamFrame(st.id, InternalError)})
+		event = eventSendRst
+	}
+	st.mu.Unlock()
+	st.reset()
+	st.session.streamEvent(st, event)
+}
+
+// reset stops all traffic on the stream: pending and later writes by the
+// handler fail, reads of the request body return errStreamReset, and the
+// request's context is canceled.  The caller sends any RST_STREAM.
+func (st *serverStream) reset() {
+	st.mu.Lock()
+	st.closed = true
+	st.wroteHeader = true
+	st.mu.Unlock()
+	st.session.out.resetStream(st.id)
+	if st.dataPipe != nil {
+		st.dataPipe.wclose(errStreamReset)
+	}
+	st.closeBody()
+	st.cancel()
+}
+
+// rejectBody ends a stream whose request body exceeds
+// Server.MaxRequestBodyBytes.  The client gets a 413 if no reply was sent
+// yet, and the stream is reset so that it stops uploading.
+func (st *serverStream) rejectBody() {
+	st.mu.Lock()
+	if !st.wroteHeader && !st.closed {
+		st.wroteHeader = true
+		st.writeReply(http.StatusRequestEntityTooLarge, make(http.Header), FlagFin)
+	}
+	st.closed = true
+	st.mu.Unlock()
+	st.session.out.writeControl(queuedFrame{frame: RstStreamFrame(st.id, Cancel)})
+	st.reset()
+	st.session.streamEvent(st, eventSendRst)
+}
+
+// recover is deferred by serve.  A panicking handler only takes down its own
+// stream; the session and its other streams keep running.
+func (st *serverStream) recover(req *http.Request) {
+	err := recover()
+	if err == nil {
+		return
+	}
+	if err != http.ErrAbortHandler {
+		buf := make([]byte, 64<<10)
+		buf = buf[:runtime.Stack(buf, false)]
+		st.session.log.Error("spdy: panic serving stream", "stream", st.id, "url", req.URL.String(), "panic", err, "stack", string(buf))
+	}
+	st.abandon(http.StatusInternalServerError)
+}
+
+func (st *serverStream) finish() (err error) {
+	st.WriteHeader(http.StatusOK)
+	err = st.Close()
+	if st.closeBody() {
+		// The handler is done with a body the client is still sending.
+		st.cancelUpload()
+	}
+	return
+}
+
+// cancelUpload resets a stream whose client is still sending a request body
+// that nobody will read.  The RST_STREAM follows the frames already queued
+// for the stream, so a response written so far is not cut off.  The stream
+// is kept until the RST_STREAM is written, so that DATA the client sends
+// meanwhile is discarded rather than answered as sent on an unknown stream.
+func (st *serverStream) cancelUpload() {
+	st.mu.Lock()
+	st.closed = true
+	st.wroteHeader = true
+	st.mu.Unlock()
+	st.session.out.writeAfter(st.id, queuedFrame{
+		frame:   RstStreamFrame(st.id, Cancel),
+		written: func() { st.session.streamEvent(st, eventSendRst) },
+	})
+	st.session.out.finishStream(st.id)
+}
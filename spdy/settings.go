@@ -0,0 +1,214 @@
+// spdy/settings.go
+
+package spdy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// A SettingsId identifies a value carried in a SETTINGS frame.
+type SettingsId uint32
+
+// SETTINGS IDs.  SettingsClientCertificateVectorSize was added in SPDY/3.
+const (
+	SettingsUploadBandwidth             SettingsId = 1
+	SettingsDownloadBandwidth           SettingsId = 2
+	SettingsRoundTripTime               SettingsId = 3
+	SettingsMaxConcurrentStreams        SettingsId = 4
+	SettingsCurrentCwnd                 SettingsId = 5
+	SettingsDownloadRetransRate         SettingsId = 6
+	SettingsInitialWindowSize           SettingsId = 7
+	SettingsClientCertificateVectorSize SettingsId = 8
+)
+
+func (id SettingsId) String() string {
+	switch id {
+	case SettingsUploadBandwidth:
+		return "UPLOAD_BANDWIDTH"
+	case SettingsDownloadBandwidth:
+		return "DOWNLOAD_BANDWIDTH"
+	case SettingsRoundTripTime:
+		return "ROUND_TRIP_TIME"
+	case SettingsMaxConcurrentStreams:
+		return "MAX_CONCURRENT_STREAMS"
+	case SettingsCurrentCwnd:
+		return "CURRENT_CWND"
+	case SettingsDownloadRetransRate:
+		return "DOWNLOAD_RETRANS_RATE"
+	case SettingsInitialWindowSize:
+		return "INITIAL_WINDOW_SIZE"
+	case SettingsClientCertificateVectorSize:
+		return "CLIENT_CERTIFICATE_VECTOR_SIZE"
+	}
+	return "Settings(" + strconv.Itoa(int(id)) + ")"
+}
+
+// SettingsFlags are the per-value flags of a SETTINGS entry.
+type SettingsFlags uint8
+
+// SETTINGS entry flags
+const (
+	// FlagSettingsPersistValue asks the recipient to remember the value
+	// and return it in SETTINGS frames of future sessions.
+	FlagSettingsPersistValue SettingsFlags = 0x01
+
+	// FlagSettingsPersisted marks a value that is being returned because
+	// the recipient asked for it to be persisted.
+	FlagSettingsPersisted SettingsFlags = 0x02
+)
+
+// A Setting is one ID/value pair of a SETTINGS frame.
+type Setting struct {
+	Id    SettingsId
+	Flags SettingsFlags
+	Value uint32
+}
+
+// Settings is the list of values carried by a SETTINGS frame.
+type Settings []Setting
+
+// Get returns the value for id and whether it is present.
+func (s Settings) Get(id SettingsId) (value uint32, ok bool) {
+	for _, setting := range s {
+		if setting.Id == id {
+			return setting.Value, true
+		}
+	}
+	return 0, false
+}
+
+// Set replaces the value for id, or appends it if it is not present.
+func (s *Settings) Set(id SettingsId, value uint32) {
+	for i := range *s {
+		if (*s)[i].Id == id {
+			(*s)[i].Value = value
+			return
+		}
+	}
+	*s = append(*s, Setting{Id: id, Value: value})
+}
+
+// Encode returns the payload of a SETTINGS frame holding s in the given
+// protocol version's format.
+//
+// In SPDY/3 each entry is 8 bits of flags, a 24-bit ID and a 32-bit value,
+// all big-endian.  SPDY/2 specified a 24-bit ID followed by the flags, but
+// Chrome wrote the ID in little-endian order and every other implementation
+// followed it; that quirk is reproduced here.
+func (s Settings) Encode(version int) []byte {
+	data := make([]byte, 4+8*len(s))
+	n := uint32(len(s))
+	data[0], data[1], data[2], data[3] = byte(n>>24), byte(n>>16), byte(n>>8), byte(n)
+	for i, setting := range s {
+		b := data[4+8*i:]
+		if version == 2 {
+			b[0] = byte(setting.Id)
+			b[1] = byte(setting.Id >> 8)
+			b[2] = byte(setting.Id >> 16)
+			b[3] = byte(setting.Flags)
+		} else {
+			b[0] = byte(setting.Flags)
+			b[1] = byte(setting.Id >> 16)
+			b[2] = byte(setting.Id >> 8)
+			b[3] = byte(setting.Id)
+		}
+		b[4] = byte(setting.Value >> 24)
+		b[5] = byte(setting.Value >> 16)
+		b[6] = byte(setting.Value >> 8)
+		b[7] = byte(setting.Value)
+	}
+	return data
+}
+
+// ErrBadSettings is returned by DecodeSettings for a malformed payload.
+var ErrBadSettings = errors.New("spdy: malformed SETTINGS frame")
+
+// DecodeSettings parses the payload of a SETTINGS frame in the given
+// protocol version's format.  See Encode for the SPDY/2 byte order.
+func DecodeSettings(version int, data []byte) (Settings, error) {
+	if len(data) < 4 {
+		return nil, ErrBadSettings
+	}
+	n := uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+	data = data[4:]
+	if uint64(len(data)) != 8*uint64(n) {
+		return nil, ErrBadSettings
+	}
+	s := make(Settings, n)
+	for i := range s {
+		b := data[8*i:]
+		if version == 2 {
+			s[i].Id = SettingsId(b[0]) | SettingsId(b[1])<<8 | SettingsId(b[2])<<16
+			s[i].Flags = SettingsFlags(b[3])
+		} else {
+			s[i].Flags = SettingsFlags(b[0])
+			s[i].Id = SettingsId(b[1])<<16 | SettingsId(b[2])<<8 | SettingsId(b[3])
+		}
+		s[i].Value = uint32(b[4])<<24 | uint32(b[5])<<16 | uint32(b[6])<<8 | uint32(b[7])
+	}
+	return s, nil
+}
+
+// SettingsFrame creates a SETTINGS frame holding s.
+func SettingsFrame(flags FrameFlags, s Settings) Frame {
+	return ControlFrame(TypeSettings, flags, s.Encode(Version))
+}
+
+// A SettingsStore keeps the SETTINGS values that peers asked to have
+// persisted with FlagSettingsPersistValue.  Keys are peer origins, as
+// returned by settingsOrigin.
+type SettingsStore interface {
+	// Load returns the values persisted for origin.
+	Load(origin string) Settings
+
+	// Store merges s into the values persisted for origin.
+	Store(origin string, s Settings)
+
+	// Clear forgets every value persisted for origin.
+	Clear(origin string)
+}
+
+// MemorySettingsStore is a SettingsStore that keeps values in memory.  The
+// zero value is ready to use.
+type MemorySettingsStore struct {
+	mu sync.Mutex
+	m  map[string]Settings
+}
+
+func (ms *MemorySettingsStore) Load(origin string) Settings {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return append(Settings(nil), ms.m[origin]...)
+}
+
+func (ms *MemorySettingsStore) Store(origin string, s Settings) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.m == nil {
+		ms.m = make(map[string]Settings)
+	}
+	stored := ms.m[origin]
+	for _, setting := range s {
+		stored.Set(setting.Id, setting.Value)
+	}
+	ms.m[origin] = stored
+}
+
+func (ms *MemorySettingsStore) Clear(origin string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.m, origin)
+}
+
+// settingsOrigin returns the key under which a peer's persisted settings are
+// stored: its host, without the ephemeral port.
+func settingsOrigin(addr net.Addr) string {
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
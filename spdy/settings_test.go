@@ -0,0 +1,149 @@
+// spdy/settings_test.go
+
+package spdy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+var settingsTests = []struct {
+	desc     string
+	version  int
+	data     []byte
+	settings Settings
+}{
+	{
+		"spdy/2 little-endian id",
+		2,
+		[]byte{
+			0x00, 0x00, 0x00, 0x02,
+			0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x64,
+			0x03, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c,
+		},
+		Settings{
+			{Id: SettingsMaxConcurrentStreams, Value: 100},
+			{Id: SettingsRoundTripTime, Flags: FlagSettingsPersistValue, Value: 300},
+		},
+	},
+	{
+		"spdy/3 flags first, big-endian id",
+		3,
+		[]byte{
+			0x00, 0x00, 0x00, 0x02,
+			0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x64,
+			0x02, 0x00, 0x00, 0x07, 0x00, 0x01, 0x00, 0x00,
+		},
+		Settings{
+			{Id: SettingsMaxConcurrentStreams, Value: 100},
+			{Id: SettingsInitialWindowSize, Flags: FlagSettingsPersisted, Value: 65536},
+		},
+	},
+	{
+		"empty",
+		3,
+		[]byte{0x00, 0x00, 0x00, 0x00},
+		Settings{},
+	},
+}
+
+func TestSettingsEncode(t *testing.T) {
+	for _, tt := range settingsTests {
+		if data := tt.settings.Encode(tt.version); !bytes.Equal(data, tt.data) {
+			t.Errorf("%s: Encode = % x, want % x", tt.desc, data, tt.data)
+		}
+	}
+}
+
+func TestSettingsDecode(t *testing.T) {
+	for _, tt := range settingsTests {
+		s, err := DecodeSettings(tt.version, tt.data)
+		if err != nil {
+			t.Errorf("%s: DecodeSettings: %v", tt.desc, err)
+			continue
+		}
+		if len(s) != len(tt.settings) {
+			t.Errorf("%s: DecodeSettings = %v, want %v", tt.desc, s, tt.settings)
+			continue
+		}
+		for i := range s {
+			if s[i] != tt.settings[i] {
+				t.Errorf("%s: setting %d = %+v, want %+v", tt.desc, i, s[i], tt.settings[i])
+			}
+		}
+	}
+}
+
+func TestSettingsDecodeBad(t *testing.T) {
+	bad := [][]byte{
+		nil,
+		{0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x00, 0x01, 0x04, 0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x00, 0x00, 0x04},
+	}
+	for _, data := range bad {
+		if _, err := DecodeSettings(2, data); err != ErrBadSettings {
+			t.Errorf("DecodeSettings(% x) error = %v, want %v", data, err, ErrBadSettings)
+		}
+	}
+}
+
+func TestSettingsPersisted(t *testing.T) {
+	srv := &Server{SettingsStore: new(MemorySettingsStore)}
+
+	c, r := testServerConn(t, srv)
+	readControl(t, r, TypeSettings)
+	SettingsFrame(0, Settings{
+		{Id: SettingsRoundTripTime, Flags: FlagSettingsPersistValue, Value: 250},
+		{Id: SettingsCurrentCwnd, Value: 10},
+	}).WriteTo(c)
+	// The PING reply shows the SETTINGS frame has been handled.
+	ControlFrame(TypePing, 0, []byte{0, 0, 0, 1}).WriteTo(c)
+	readControl(t, r, TypePing)
+	c.Close()
+
+	_, r = testServerConn(t, srv)
+	f := readControl(t, r, TypeSettings)
+	s, err := DecodeSettings(Version, f.Data)
+	if err != nil {
+		t.Fatalf("DecodeSettings: %v", err)
+	}
+	var found bool
+	for _, setting := range s {
+		switch setting.Id {
+		case SettingsRoundTripTime:
+			found = true
+			if setting.Value != 250 || setting.Flags != FlagSettingsPersisted {
+				t.Errorf("replayed %+v, want value 250 flagged persisted", setting)
+			}
+		case SettingsCurrentCwnd:
+			t.Errorf("replayed %v, which was not marked for persistence", setting.Id)
+		}
+	}
+	if !found {
+		t.Errorf("persisted ROUND_TRIP_TIME not replayed in %v", s)
+	}
+}
+
+func TestSettingsClearPersisted(t *testing.T) {
+	store := new(MemorySettingsStore)
+	store.Store("pipe", Settings{{Id: SettingsRoundTripTime, Value: 250}})
+	srv := &Server{SettingsStore: store}
+
+	c, r := testServerConn(t, srv)
+	readControl(t, r, TypeSettings)
+	SettingsFrame(FlagClearPreviouslyPersistedSettings, nil).WriteTo(c)
+	ControlFrame(TypePing, 0, []byte{0, 0, 0, 1}).WriteTo(c)
+	readControl(t, r, TypePing)
+	if s := store.Load(settingsOrigin(c.RemoteAddr())); len(s) != 0 {
+		t.Errorf("persisted settings after clear = %v", s)
+	}
+}
+
+func TestSettingsOrigin(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4321}
+	if got := settingsOrigin(addr); got != "10.0.0.1" {
+		t.Errorf("settingsOrigin(%v) = %q, want %q", addr, got, "10.0.0.1")
+	}
+}
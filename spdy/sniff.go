@@ -0,0 +1,286 @@
+// spdy/sniff.go
+
+package spdy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The protocols a connection on a SPDY listener may turn out to speak.
+const (
+	protoUnknown = iota
+	protoSPDY
+	protoTLS
+	protoHTTP
+)
+
+// maxMethodLen bounds the request method sniff looks for.
+const maxMethodLen = 16
+
+// A sniffedConn replays the bytes that sniff peeked at.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// sniff peeks at the first bytes of c to tell which protocol it speaks.
+// Both directions of SPDY begin with a control frame, whose first byte has
+// the control bit set and whose version is at most 3.  It returns a
+// connection that still yields those bytes, and the bytes peeked.
+func sniff(c net.Conn) (*sniffedConn, int, []byte, error) {
+	sc := &sniffedConn{Conn: c, r: bufio.NewReader(c)}
+	first, err := sc.r.Peek(2)
+	if err != nil {
+		return nil, protoUnknown, first, err
+	}
+	switch {
+	case first[0] == 0x80 && first[1] >= 1 && first[1] <= 3:
+		return sc, protoSPDY, first, nil
+	case first[0] == 22 && first[1] == 3: // TLS handshake record
+		return sc, protoTLS, first, nil
+	}
+	// An HTTP/1.x request line begins with an upper-case method and a
+	// space.
+	for n := 1; n <= maxMethodLen; n++ {
+		b, err := sc.r.Peek(n)
+		if err != nil {
+			return sc, protoUnknown, b, nil
+		}
+		switch c := b[n-1]; {
+		case c == ' ' && n > 1:
+			return sc, protoHTTP, b, nil
+		case c < 'A' || c > 'Z':
+			return sc, protoUnknown, b, nil
+		}
+	}
+	b, _ := sc.r.Peek(maxMethodLen)
+	return sc, protoUnknown, b, nil
+}
+
+// serveConn serves a connection accepted by Serve according to the
+// protocol it begins with.  c is tracked as sniffing until it is handed
+// on or closed.
+func (srv *Server) serveConn(c net.Conn, handler http.Handler) {
+	if tc, ok := c.(*tls.Conn); ok {
+		// The listener does TLS itself.
+		srv.serveTLS(c, tc, handler)
+		return
+	}
+	srv.serveSniffed(c, c, handler, true)
+}
+
+// serveSniffed sniffs c, accepted as orig, and serves it.  A TLS handshake
+// is accepted only if acceptTLS is set.
+func (srv *Server) serveSniffed(orig, c net.Conn, handler http.Handler, acceptTLS bool) {
+	log := srv.logger().With("remote", c.RemoteAddr().String())
+	if d := srv.IdleTimeout; d > 0 {
+		c.SetReadDeadline(time.Now().Add(d))
+	}
+	sc, proto, first, err := sniff(c)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Debug("spdy: connection closed before it spoke", "err", err)
+		srv.dropConn(orig, c)
+		return
+	}
+	switch {
+	case proto == protoSPDY:
+		srv.startSession(orig, sc, handler, Version)
+	case proto == protoHTTP:
+		srv.serveHTTP1(orig, sc, handler)
+	case proto == protoTLS && acceptTLS && srv.TLSConfig != nil:
+		srv.serveTLS(orig, tls.Server(sc, srv.tlsConfig()), handler)
+	case proto == protoTLS:
+		log.Warn("spdy: TLS handshake on a plain SPDY listener; closing",
+			"hint", "the client may have followed an npn-spdy/2 Alternate-Protocol; set Server.TLSConfig to serve TLS here")
+		srv.dropConn(orig, c)
+	default:
+		log.Warn("spdy: connection is not SPDY, TLS or HTTP/1.x; closing", "first", fmt.Sprintf("% x", first))
+		srv.dropConn(orig, c)
+	}
+}
+
+// serveTLS completes the handshake on tc and serves the protocol it
+// negotiated, or, if it negotiated none, the protocol it begins with.
+func (srv *Server) serveTLS(orig net.Conn, tc *tls.Conn, handler http.Handler) {
+	ctx := context.Background()
+	if d := srv.IdleTimeout; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	if err := tc.HandshakeContext(ctx); err != nil {
+		srv.logger().Warn("spdy: TLS handshake failed", "remote", tc.RemoteAddr().String(), "err", err)
+		srv.dropConn(orig, tc)
+		return
+	}
+	switch tc.ConnectionState().NegotiatedProtocol {
+	case NextProtoSPDY2:
+		srv.startSession(orig, tc, handler, Version)
+	case "http/1.1":
+		srv.serveHTTP1(orig, tc, handler)
+	default:
+		srv.serveSniffed(orig, tc, handler, false)
+	}
+}
+
+// tlsConfig returns Server.TLSConfig, offering spdy/2 and http/1.1 if it
+// offers nothing.
+func (srv *Server) tlsConfig() *tls.Config {
+	config := srv.TLSConfig
+	if len(config.NextProtos) == 0 {
+		config = config.Clone()
+		config.NextProtos = []string{NextProtoSPDY2, "http/1.1"}
+	}
+	return config
+}
+
+// startSession serves c, accepted as orig, as a SPDY session of the given
+// protocol version.
+func (srv *Server) startSession(orig, c net.Conn, handler http.Handler, version int) {
+	sess := newSession(srv, c, handler, version)
+	// Tracked as a session before it stops counting as sniffing, so that
+	// MaxConns always sees it.
+	srv.trackSession(sess, true)
+	srv.trackSniffing(orig, false)
+	if srv.ConnState != nil {
+		srv.ConnState(c, StateNew)
+	}
+	sess.serve()
+}
+
+// dropConn closes c, accepted as orig.
+func (srv *Server) dropConn(orig, c net.Conn) {
+	c.Close()
+	srv.trackSniffing(orig, false)
+}
+
+// serveHTTP1 hands c, accepted as orig, to the server's net/http server,
+// which shares its handler.  Such connections do not count toward
+// MaxConns.
+func (srv *Server) serveHTTP1(orig, c net.Conn, handler http.Handler) {
+	srv.mu.Lock()
+	if srv.inShutdown {
+		srv.mu.Unlock()
+		srv.dropConn(orig, c)
+		return
+	}
+	if srv.http1 == nil {
+		srv.http1L = &connListener{addr: c.LocalAddr(), conns: make(chan net.Conn), closed: make(chan struct{})}
+		srv.http1 = &http.Server{
+			Handler:     tlsHandler{srv.UpgradeHandler(handler)},
+			IdleTimeout: srv.IdleTimeout,
+			ErrorLog:    slog.NewLogLogger(srv.logger().Handler(), slog.LevelWarn),
+			ConnContext: tlsConnContext,
+		}
+		go srv.http1.Serve(srv.http1L)
+	}
+	l := srv.http1L
+	srv.mu.Unlock()
+	srv.logger().Debug("spdy: serving HTTP/1.x", "remote", c.RemoteAddr().String())
+	srv.trackSniffing(orig, false)
+	if !l.hand(c) {
+		c.Close()
+	}
+}
+
+// tlsStateKey is the context key under which tlsConnContext stores the TLS
+// state of a sniffed connection.
+type tlsStateKey struct{}
+
+// tlsConnContext records the TLS state of a connection that net/http cannot
+// see is TLS, because sniffing wrapped it.
+func tlsConnContext(ctx context.Context, c net.Conn) context.Context {
+	if sc, ok := c.(*sniffedConn); ok {
+		if tc, ok := sc.Conn.(*tls.Conn); ok {
+			state := tc.ConnectionState()
+			return context.WithValue(ctx, tlsStateKey{}, &state)
+		}
+	}
+	return ctx
+}
+
+// A tlsHandler sets Request.TLS from the state tlsConnContext recorded.
+type tlsHandler struct {
+	h http.Handler
+}
+
+func (h tlsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.TLS == nil {
+		req.TLS, _ = req.Context().Value(tlsStateKey{}).(*tls.ConnectionState)
+	}
+	h.h.ServeHTTP(w, req)
+}
+
+// trackSniffing adds or removes a connection whose protocol is not yet
+// known.  Such connections count toward MaxConns and are closed by Close
+// and Shutdown.  It reports false if the server is shutting down.
+func (srv *Server) trackSniffing(c net.Conn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !add {
+		if _, ok := srv.sniffing[c]; ok {
+			delete(srv.sniffing, c)
+			srv.connFreed().Broadcast()
+		}
+		return true
+	}
+	if srv.inShutdown {
+		return false
+	}
+	if srv.sniffing == nil {
+		srv.sniffing = make(map[net.Conn]struct{})
+	}
+	srv.sniffing[c] = struct{}{}
+	return true
+}
+
+// A connListener passes the connections that turn out to speak HTTP/1.x to
+// an http.Server.
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// hand passes c to the http.Server.  It reports false if the listener is
+// closed.
+func (l *connListener) hand(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
@@ -0,0 +1,182 @@
+// spdy/sniff_test.go
+
+package spdy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSniff(t *testing.T) {
+	for _, tt := range []struct {
+		in    string
+		proto int
+	}{
+		{"\x80\x02\x00\x01", protoSPDY},
+		{"\x80\x03\x00\x04", protoSPDY},
+		{"\x80\x07\x00\x01", protoUnknown},
+		{"\x16\x03\x01\x02\x00", protoTLS},
+		{"GET / HTTP/1.1\r\n", protoHTTP},
+		{"OPTIONS * HTTP/1.1\r\n", protoHTTP},
+		{"get / HTTP/1.1\r\n", protoUnknown},
+		{" GET", protoUnknown},
+		{"SSH-2.0-OpenSSH\r\n", protoUnknown},
+		{"ABCDEFGHIJKLMNOPQRSTUVWXYZ", protoUnknown},
+		{"GET", protoUnknown},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			io.WriteString(client, tt.in)
+			client.Close()
+		}()
+		sc, proto, _, err := sniff(server)
+		if err != nil {
+			t.Errorf("sniff(%q): %v", tt.in, err)
+			continue
+		}
+		if proto != tt.proto {
+			t.Errorf("sniff(%q) = %d, want %d", tt.in, proto, tt.proto)
+		}
+		if all, _ := io.ReadAll(sc); string(all) != tt.in {
+			t.Errorf("sniff(%q) replays %q", tt.in, all)
+		}
+	}
+}
+
+func TestSniffHTTP1(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "hello")
+	})}
+	addr := listen(t, srv, nil)
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Errorf("response protocol = %s, want HTTP/1.x", resp.Proto)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "hello" {
+		t.Errorf("body = %q, want %q", body, "hello")
+	}
+
+	// SPDY still works on the same listener.
+	tr := new(Transport)
+	defer tr.CloseIdleConnections()
+	resp, err = (&http.Client{Transport: tr}).Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "hello" {
+		t.Errorf("body = %q, want %q", body, "hello")
+	}
+}
+
+// dialAndRead writes p to addr and returns whatever comes back before the
+// server closes the connection.
+func dialAndRead(t *testing.T, addr, p string) string {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, p)
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("waiting for the server to close: %v", err)
+	}
+	return string(b)
+}
+
+func TestSniffRejects(t *testing.T) {
+	logs := new(logBuffer)
+	srv := &Server{Logger: testLogger(logs)}
+	addr := listen(t, srv, nil)
+
+	// A TLS record header and a little ClientHello.
+	if got := dialAndRead(t, addr, "\x16\x03\x01\x00\x05\x01\x00\x00\x01\x00"); got != "" {
+		t.Errorf("TLS without TLSConfig got %q", got)
+	}
+	waitFor(t, "the TLS diagnosis", func() bool { return strings.Contains(logs.String(), "Server.TLSConfig") })
+
+	if got := dialAndRead(t, addr, "SSH-2.0-OpenSSH\r\n"); got != "" {
+		t.Errorf("garbage got %q", got)
+	}
+	waitFor(t, "the garbage diagnosis", func() bool { return strings.Contains(logs.String(), "53 53 48 2d") })
+	waitFor(t, "the connections to be forgotten", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.sniffing) == 0
+	})
+}
+
+func TestSniffTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+	clientConfig := ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	srv := &Server{
+		TLSConfig: &tls.Config{Certificates: ts.TLS.Certificates},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.TLS == nil {
+				io.WriteString(w, "plain")
+			} else {
+				io.WriteString(w, "tls")
+			}
+		}),
+	}
+	addr := listen(t, srv, nil)
+	for _, tt := range []struct {
+		name string
+		rt   http.RoundTripper
+		want string
+	}{
+		{"spdy", &Transport{TLSClientConfig: clientConfig}, "tls"},
+		{"http", &http.Transport{TLSClientConfig: clientConfig}, "tls"},
+		{"plain spdy", new(Transport), "plain"},
+	} {
+		scheme := "https://"
+		if strings.HasPrefix(tt.name, "plain") {
+			scheme = "http://"
+		}
+		resp, err := (&http.Client{Transport: tt.rt, Timeout: 5 * time.Second}).Get(scheme + addr + "/")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tt.want {
+			t.Errorf("%s: body = %q, want %q", tt.name, body, tt.want)
+		}
+	}
+}
+
+func TestSniffShutdown(t *testing.T) {
+	srv := new(Server)
+	addr := listen(t, srv, nil)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitFor(t, "the connection to be sniffed", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.sniffing) == 1
+	})
+	srv.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bufio.NewReader(c).ReadByte(); err != io.EOF {
+		t.Errorf("read after Close = %v, want EOF", err)
+	}
+}
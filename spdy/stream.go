@@ -0,0 +1,89 @@
+// spdy/stream.go
+
+package spdy
+
+import "errors"
+
+// streamState is the state of a stream as seen by one endpoint.  "Local" is
+// this endpoint and "remote" is its peer.
+type streamState int
+
+const (
+	stateOpen             streamState = iota
+	stateHalfClosedLocal              // we sent FLAG_FIN; the peer may still send
+	stateHalfClosedRemote             // the peer sent FLAG_FIN; we may still send
+	stateClosed
+)
+
+func (s streamState) String() string {
+	switch s {
+	case stateOpen:
+		return "open"
+	case stateHalfClosedLocal:
+		return "half-closed (local)"
+	case stateHalfClosedRemote:
+		return "half-closed (remote)"
+	case stateClosed:
+		return "closed"
+	}
+	return "invalid"
+}
+
+// A streamEvent is something that happens to an existing stream.
+type streamEvent int
+
+const (
+	eventRecvData streamEvent = iota // DATA without FLAG_FIN arrived
+	eventRecvFin                     // DATA with FLAG_FIN arrived
+	eventSendFin                     // we sent FLAG_FIN
+	eventRecvRst                     // the peer reset the stream
+	eventSendRst                     // we reset the stream
+)
+
+// initialState returns the state of a stream just opened by a SYN_STREAM
+// with the given flags.
+func initialState(flags FrameFlags) streamState {
+	if flags&FlagFin != 0 {
+		return stateHalfClosedRemote
+	}
+	return stateOpen
+}
+
+// transition returns the state a stream in state s moves to on event e.  If
+// e is not allowed in s, it also returns the status of the RST_STREAM that
+// must be sent, and the stream is closed.  SPDY/2 has no
+// STREAM_ALREADY_CLOSED, so data after FLAG_FIN is a PROTOCOL_ERROR.
+func (s streamState) transition(e streamEvent) (next streamState, status RstStreamStatus) {
+	switch e {
+	case eventRecvRst, eventSendRst:
+		return stateClosed, 0
+	case eventRecvData:
+		switch s {
+		case stateOpen, stateHalfClosedLocal:
+			return s, 0
+		}
+		return stateClosed, ProtocolError
+	case eventRecvFin:
+		switch s {
+		case stateOpen:
+			return stateHalfClosedRemote, 0
+		case stateHalfClosedLocal:
+			return stateClosed, 0
+		}
+		return stateClosed, ProtocolError
+	case eventSendFin:
+		switch s {
+		case stateOpen:
+			return stateHalfClosedLocal, 0
+		case stateHalfClosedRemote:
+			return stateClosed, 0
+		}
+		// Sending twice is a local bug, not the peer's fault.
+		return s, 0
+	}
+	return s, 0
+}
+
+// errStreamReset is returned by reads of a request body whose stream was
+// reset.
+var errStreamReset = errors.New("spdy: stream reset")
@@ -0,0 +1,207 @@
+// spdy/stream_test.go
+
+package spdy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var transitionTests = []struct {
+	state  streamState
+	event  streamEvent
+	next   streamState
+	status RstStreamStatus
+}{
+	{stateOpen, eventRecvData, stateOpen, 0},
+	{stateOpen, eventRecvFin, stateHalfClosedRemote, 0},
+	{stateOpen, eventSendFin, stateHalfClosedLocal, 0},
+	{stateOpen, eventRecvRst, stateClosed, 0},
+	{stateOpen, eventSendRst, stateClosed, 0},
+
+	{stateHalfClosedLocal, eventRecvData, stateHalfClosedLocal, 0},
+	{stateHalfClosedLocal, eventRecvFin, stateClosed, 0},
+	{stateHalfClosedLocal, eventSendFin, stateHalfClosedLocal, 0},
+	{stateHalfClosedLocal, eventRecvRst, stateClosed, 0},
+	{stateHalfClosedLocal, eventSendRst, stateClosed, 0},
+
+	{stateHalfClosedRemote, eventRecvData, stateClosed, ProtocolError},
+	{stateHalfClosedRemote, eventRecvFin, stateClosed, ProtocolError},
+	{stateHalfClosedRemote, eventSendFin, stateClosed, 0},
+	{stateHalfClosedRemote, eventRecvRst, stateClosed, 0},
+	{stateHalfClosedRemote, eventSendRst, stateClosed, 0},
+
+	{stateClosed, eventRecvData, stateClosed, ProtocolError},
+	{stateClosed, eventRecvFin, stateClosed, ProtocolError},
+	{stateClosed, eventSendFin, stateClosed, 0},
+	{stateClosed, eventRecvRst, stateClosed, 0},
+	{stateClosed, eventSendRst, stateClosed, 0},
+}
+
+func TestStreamTransition(t *testing.T) {
+	for _, tt := range transitionTests {
+		next, status := tt.state.transition(tt.event)
+		if next != tt.next || status != tt.status {
+			t.Errorf("%v on event %d = (%v, %v), want (%v, %v)", tt.state, tt.event, next, status, tt.next, tt.status)
+		}
+	}
+}
+
+func TestInitialState(t *testing.T) {
+	if s := initialState(0); s != stateOpen {
+		t.Errorf("initialState(0) = %v, want %v", s, stateOpen)
+	}
+	if s := initialState(FlagFin); s != stateHalfClosedRemote {
+		t.Errorf("initialState(FlagFin) = %v, want %v", s, stateHalfClosedRemote)
+	}
+}
+
+// rstStream decodes a RST_STREAM frame.
+func rstStream(f Frame) (id uint32, status RstStreamStatus) {
+	return binary.BigEndian.Uint32(f.Data[0:4]), RstStreamStatus(binary.BigEndian.Uint32(f.Data[4:8]))
+}
+
+func TestStreamErrors(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	tests := []struct {
+		desc   string
+		frames func(hw *HeaderWriter) []Frame
+		id     uint32
+		status RstStreamStatus
+	}{
+		{
+			"zero stream id",
+			func(hw *HeaderWriter) []Frame {
+				return []Frame{synStream(hw, 0, 0, FlagFin, getHeader("http://example.com/"))}
+			},
+			0, ProtocolError,
+		},
+		{
+			"even stream id",
+			func(hw *HeaderWriter) []Frame {
+				return []Frame{synStream(hw, 2, 0, FlagFin, getHeader("http://example.com/"))}
+			},
+			2, ProtocolError,
+		},
+		{
+			// The request asked for STREAM_IN_USE here, but SPDY/2
+			// has no such status, and SPDY/3 only uses it for a
+			// SYN_REPLY on an open stream: a second SYN_STREAM is a
+			// PROTOCOL_ERROR in both.  See also TestStreamInUse.
+			"stream in use",
+			func(hw *HeaderWriter) []Frame {
+				return []Frame{
+					synStream(hw, 1, 0, 0, getHeader("http://example.com/")),
+					synStream(hw, 1, 0, FlagFin, getHeader("http://example.com/")),
+				}
+			},
+			1, ProtocolError,
+		},
+		{
+			"data on unknown stream",
+			func(hw *HeaderWriter) []Frame {
+				return []Frame{DataFrame(9, 0, []byte("x"))}
+			},
+			9, InvalidStream,
+		},
+		{
+			"data after fin",
+			func(hw *HeaderWriter) []Frame {
+				return []Frame{
+					synStream(hw, 1, 0, FlagFin, getHeader("http://example.com/")),
+					DataFrame(1, 0, []byte("x")),
+				}
+			},
+			1, ProtocolError,
+		},
+	}
+	for _, tt := range tests {
+		c, r := testConn(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			<-hang
+		}))
+		for _, f := range tt.frames(NewHeaderWriter(-1)) {
+			f.WriteTo(c)
+		}
+		f := readControl(t, r, TypeRstStream)
+		if id, status := rstStream(f); id != tt.id || status != tt.status {
+			t.Errorf("%s: RST_STREAM = (%d, %v), want (%d, %v)", tt.desc, id, status, tt.id, tt.status)
+		}
+	}
+}
+
+// TestStreamInUse checks that a second SYN_STREAM for an open stream resets
+// the open stream too, and that the session goes on.
+func TestStreamInUse(t *testing.T) {
+	canceled := make(chan struct{})
+	c, r := testConn(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/hang" {
+			<-req.Context().Done()
+			close(canceled)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	hw := NewHeaderWriter(-1)
+	synStream(hw, 1, 0, 0, getHeader("http://example.com/hang")).WriteTo(c)
+	synStream(hw, 1, 0, FlagFin, getHeader("http://example.com/hang")).WriteTo(c)
+	if id, status := readRst(t, r); id != 1 || status != ProtocolError {
+		t.Errorf("RST_STREAM = (%d, %v), want (1, %v)", id, status, ProtocolError)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the open stream was not reset")
+	}
+	synStream(hw, 3, 0, FlagFin, getHeader("http://example.com/")).WriteTo(c)
+	if _, body := readResponse(t, r, NewHeaderReader(), 3); string(body) != "ok" {
+		t.Errorf("body after the reset = %q, want %q", body, "ok")
+	}
+}
+
+// TestDecreasingStreamID checks that a SYN_STREAM whose ID is lower than an
+// earlier one ends the session with GOAWAY, which carries PROTOCOL_ERROR
+// from SPDY/3 on.
+func TestDecreasingStreamID(t *testing.T) {
+	for _, version := range []int{2, 3} {
+		srv := &Server{
+			Logger: testLogger(new(logBuffer)),
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				<-req.Context().Done()
+			}),
+		}
+		client, server := net.Pipe()
+		defer client.Close()
+		go newSession(srv, server, srv.Handler, version).serve()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(client)
+
+		hw := newHeaderWriter(-1, version)
+		withVersion(synStream(hw, 5, 0, 0, getHeader("http://example.com/")), version).WriteTo(client)
+		withVersion(synStream(hw, 3, 0, FlagFin, getHeader("http://example.com/")), version).WriteTo(client)
+		f := readControl(t, r, TypeGoaway)
+		if id := binary.BigEndian.Uint32(f.Data[0:4]); id != 5 {
+			t.Errorf("SPDY/%d: GOAWAY last good stream = %d, want 5", version, id)
+		}
+		if version >= 3 && (len(f.Data) != 8 || binary.BigEndian.Uint32(f.Data[4:8]) != goawayProtocolError) {
+			t.Errorf("SPDY/%d: GOAWAY = %x, want status PROTOCOL_ERROR", version, f.Data)
+		}
+		expectClosed(t, client, r, time.Second)
+	}
+}
+
+func TestClientReset(t *testing.T) {
+	canceled := make(chan struct{})
+	c, _ := testConn(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		close(canceled)
+	}))
+	synStream(NewHeaderWriter(-1), 1, 0, 0, getHeader("http://example.com/")).WriteTo(c)
+	RstStreamFrame(1, Cancel).WriteTo(c)
+	<-canceled
+}
@@ -0,0 +1,378 @@
+// spdy/transport.go
+
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NextProtoSPDY2 is the ALPN protocol name of SPDY/2.
+const NextProtoSPDY2 = "spdy/2"
+
+// NextProtoSPDY31 is the protocol name of SPDY/3.1, which this package
+// only speaks on connections upgraded from HTTP/1.1.
+const NextProtoSPDY31 = "spdy/3.1"
+
+// DefaultDialTimeout is the limit on dialing a session used when
+// Transport.DialTimeout is zero.
+const DefaultDialTimeout = 30 * time.Second
+
+// A Transport is an http.RoundTripper that speaks SPDY.  Concurrent
+// requests to an origin are multiplexed as streams on one session, up to the
+// server's SETTINGS_MAX_CONCURRENT_STREAMS; only when every session to the
+// origin is full is another dialed:
+//
+//	client := &http.Client{Transport: &spdy.Transport{}}
+//
+// A new session carries a single stream until the server's SETTINGS
+// arrive; other requests for the origin wait for them rather than dialing.
+//
+// "http" URLs are served by plain SPDY over TCP, as Server speaks it.
+// "https" URLs use TLS and require the server to select spdy/2 with ALPN;
+// crypto/tls does not implement the older NPN extension.
+type Transport struct {
+	// DialContext dials TCP connections.  If nil, a net.Dialer is used.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// DialTimeout limits how long dialing a session may take, including
+	// the TLS handshake or HTTP/1.1 upgrade.  Requests waiting for the
+	// dial share it, so it does not follow any one request's deadline.
+	// If zero, DefaultDialTimeout is used.
+	DialTimeout time.Duration
+
+	// DialTLSContext, if non-nil, dials connections for "https" URLs in
+	// place of DialContext and the TLS handshake.  The connection it
+	// returns is used as is, so it must be ready to carry SPDY frames.
+	DialTLSContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSClientConfig configures TLS for "https" URLs.  NextProtos is
+	// replaced by spdy/2.  If nil, the default configuration is used.
+	TLSClientConfig *tls.Config
+
+	// MaxDataFrameSize is the largest DATA frame payload sent for request
+	// bodies.  If zero, DefaultMaxDataFrameSize is used.
+	MaxDataFrameSize int
+
+	// MaxStreamBufferBytes limits the response body data buffered for a
+	// stream, including a pushed one, that the application has not read
+	// yet.  A server that sends past it has the stream reset with CANCEL,
+	// and reads of the body fail.  If zero, DefaultMaxStreamBufferBytes is
+	// used.
+	MaxStreamBufferBytes int
+
+	// AcceptPush, if non-nil, is called for each stream the server pushes,
+	// with the pushed resource's URL and the request it was pushed with.
+	// Accepted pushes are cached, and a later GET for the same URL is
+	// answered with the pushed response instead of a new stream.  Pushes
+	// for another origin, or that AcceptPush declines, are reset.
+	// AcceptPush is called from the session's read loop and must not block.
+	AcceptPush func(u *url.URL, req *http.Request) bool
+
+	// UpgradeHTTP makes sessions for "http" URLs start as an HTTP/1.1
+	// request with Upgrade: spdy/3.1, for servers that are reached through
+	// HTTP/1.1 intermediaries or answer HTTP/1.1 on the port.  A server
+	// that does not answer 101 Switching Protocols fails the request with
+	// ErrNoSPDY.
+	UpgradeHTTP bool
+
+	// IdleTimeout is how long a session may go without open streams
+	// before the Transport closes it.  Zero means no timeout.
+	IdleTimeout time.Duration
+
+	mu    sync.Mutex
+	pools map[poolKey]*originPool
+}
+
+// A dialCall is a dial in progress.  Requests for the same origin wait for
+// it rather than dialing their own connections.
+type dialCall struct {
+	done chan struct{} // closed when sess and err are set
+	sess *clientSession
+	err  error
+}
+
+// ErrNoSPDY is returned when a server does not negotiate SPDY, either in
+// the TLS handshake or in answer to an HTTP/1.1 Upgrade.
+var ErrNoSPDY = errors.New("spdy: server did not negotiate spdy/2")
+
+// errSessionGone reports a request that was refused, or not processed,
+// because its session went away.  Such requests are safe to retry on a new
+// session.
+var errSessionGone = errors.New("spdy: session went away before the request was processed")
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.roundTrip(req, "")
+}
+
+// roundTrip is RoundTrip with the name a TLS server's certificate must be
+// valid for, if it is not the host in req.URL.
+func (t *Transport) roundTrip(req *http.Request, serverName string) (*http.Response, error) {
+	if req.URL == nil {
+		closeBody(req)
+		return nil, errors.New("spdy: nil Request.URL")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		closeBody(req)
+		return nil, errors.New("spdy: unsupported protocol scheme " + req.URL.Scheme)
+	}
+	if req.URL.Host == "" {
+		closeBody(req)
+		return nil, errors.New("spdy: no Host in request URL")
+	}
+	if resp := t.pushed(req, serverName); resp != nil {
+		return resp, nil
+	}
+	for attempt := 0; ; attempt++ {
+		sess, err := t.session(req.Context(), origin(req.URL), serverName)
+		if err != nil {
+			closeBody(req)
+			return nil, err
+		}
+		resp, err := sess.roundTrip(req)
+		if err != errSessionGone || attempt > 0 {
+			return resp, err
+		}
+		// The server never saw the request; try once more on a new
+		// session if the body can be replayed.
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, err
+			}
+			r2 := req.Clone(req.Context())
+			if r2.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+			req = r2
+		}
+	}
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// origin returns the key under which sessions for u's server are kept:
+// scheme, host and port.
+func origin(u *url.URL) string {
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	return u.Scheme + "://" + host
+}
+
+// session returns a session to origin with a stream reserved for a request,
+// dialing a new session if every one is full.
+func (t *Transport) session(ctx context.Context, origin, serverName string) (*clientSession, error) {
+	for {
+		t.mu.Lock()
+		pool := t.pool(origin, serverName)
+		var ready <-chan struct{}
+		for _, sess := range pool.sessions {
+			if sess.reserveStream() {
+				t.mu.Unlock()
+				pool.requests.Add(1)
+				return sess, nil
+			}
+			if ready == nil {
+				ready = sess.pending()
+			}
+		}
+		if ready != nil {
+			// The server's SETTINGS may allow more streams on a
+			// session it has not answered yet.
+			t.mu.Unlock()
+			select {
+			case <-ready:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		call := pool.dial
+		if call == nil {
+			call = &dialCall{done: make(chan struct{})}
+			pool.dial = call
+			// The dial outlives a canceled request, since other
+			// requests may be waiting for it.
+			go t.dialFor(context.WithoutCancel(ctx), pool, call)
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.err != nil {
+			return nil, call.err
+		}
+		if !call.sess.usable() {
+			// Lost as soon as it was made; don't dial again.
+			return nil, errSessionGone
+		}
+		// The new session may have filled up already; look again.
+	}
+}
+
+// dialFor dials pool's origin for call and adds the session to the pool.
+func (t *Transport) dialFor(ctx context.Context, pool *originPool, call *dialCall) {
+	ctx, cancel := context.WithTimeout(ctx, t.dialTimeout())
+	defer cancel()
+	call.sess, call.err = t.dial(ctx, pool)
+	if call.err != nil {
+		call.err = &dialError{call.err}
+	}
+	t.mu.Lock()
+	pool.dial = nil
+	if call.err != nil {
+		pool.dialErrors.Add(1)
+	} else {
+		pool.dials.Add(1)
+		// A session that already failed has been forgotten, so it must
+		// not be added.
+		if call.sess.usable() {
+			pool.sessions = append(pool.sessions, call.sess)
+		}
+	}
+	t.mu.Unlock()
+	close(call.done)
+}
+
+// dial connects to pool's origin and starts a session on the connection.
+func (t *Transport) dial(ctx context.Context, pool *originPool) (*clientSession, error) {
+	scheme, addr, _ := strings.Cut(pool.origin, "://")
+	if scheme == "https" && t.DialTLSContext != nil {
+		c, err := t.DialTLSContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return newClientSession(t, pool, c, Version), nil
+	}
+	dial := t.DialContext
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	c, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	version := Version
+	switch {
+	case scheme == "https":
+		c, err = t.handshake(ctx, c, addr, pool.serverName)
+	case t.UpgradeHTTP:
+		c, version, err = t.upgrade(ctx, c, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newClientSession(t, pool, c, version), nil
+}
+
+// A dialError is a failure to reach an origin: dialing it, the TLS
+// handshake or the HTTP/1.1 upgrade.  AltTransport only gives up on
+// alternates that fail this way.
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string { return e.err.Error() }
+func (e *dialError) Unwrap() error { return e.err }
+
+// handshake runs a TLS handshake on c that offers only spdy/2.  The server's
+// certificate must be valid for serverName, or, if it is empty, for the
+// configured ServerName or the host in addr.
+func (t *Transport) handshake(ctx context.Context, c net.Conn, addr, serverName string) (net.Conn, error) {
+	config := new(tls.Config)
+	if t.TLSClientConfig != nil {
+		config = t.TLSClientConfig.Clone()
+	}
+	config.NextProtos = []string{NextProtoSPDY2}
+	switch {
+	case serverName != "":
+		config.ServerName = serverName
+	case config.ServerName == "":
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(c, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if tc.ConnectionState().NegotiatedProtocol != NextProtoSPDY2 {
+		tc.Close()
+		return nil, ErrNoSPDY
+	}
+	return tc, nil
+}
+
+// upgrade switches c to SPDY with an HTTP/1.1 Upgrade request and returns
+// the SPDY version the server chose.
+func (t *Transport) upgrade(ctx context.Context, c net.Conn, addr string) (net.Conn, int, error) {
+	uc, version, err := upgrade(ctx, c, addr)
+	if err != nil {
+		c.Close()
+		return nil, 0, err
+	}
+	return uc, version, nil
+}
+
+// forget drops sess from the sessions available for new requests and
+// reports whether it was still available.
+func (t *Transport) forget(sess *clientSession) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.removeLocked(sess)
+}
+
+// CloseIdleConnections closes every session that has no open streams.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	var idle []*clientSession
+	for _, pool := range t.pools {
+		for _, sess := range append([]*clientSession(nil), pool.sessions...) {
+			if sess.idle() {
+				idle = append(idle, sess)
+				t.removeLocked(sess)
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, sess := range idle {
+		sess.close(nil)
+	}
+}
+
+func (t *Transport) dialTimeout() time.Duration {
+	if t.DialTimeout <= 0 {
+		return DefaultDialTimeout
+	}
+	return t.DialTimeout
+}
+
+func (t *Transport) maxStreamBufferBytes() int {
+	if t.MaxStreamBufferBytes <= 0 {
+		return DefaultMaxStreamBufferBytes
+	}
+	return t.MaxStreamBufferBytes
+}
+
+func (t *Transport) maxDataFrameSize() int {
+	return clampDataFrameSize(t.MaxDataFrameSize)
+}
@@ -0,0 +1,579 @@
+// spdy/transport_test.go
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTransport starts a Server with h and returns a client for it and the
+// server's base URL.
+func testTransport(t *testing.T, srv *Server) (*http.Client, string) {
+	addr := listen(t, srv, nil)
+	tr := new(Transport)
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}, "http://" + addr
+}
+
+func TestTransportGet(t *testing.T) {
+	client, base := testTransport(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Path", req.URL.Path)
+		w.Header().Set("X-Host", req.Host)
+		fmt.Fprintf(w, "%s %s %s", req.Method, req.URL.RequestURI(), req.Header.Get("X-Test"))
+	})})
+	req, _ := http.NewRequest("GET", base+"/hello?x=1", nil)
+	req.Header.Set("X-Test", "yes")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	if resp.StatusCode != 200 || resp.Status != "200 OK" || resp.ProtoMajor != 1 || resp.ProtoMinor != 1 {
+		t.Errorf("status = %d %q %s, want 200 OK HTTP/1.1", resp.StatusCode, resp.Status, resp.Proto)
+	}
+	if got, want := string(body), "GET /hello?x=1 yes"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("X-Path"); got != "/hello" {
+		t.Errorf("X-Path = %q, want /hello", got)
+	}
+	if got := resp.Header.Get("X-Host"); got != strings.TrimPrefix(base, "http://") {
+		t.Errorf("X-Host = %q, want %q", got, strings.TrimPrefix(base, "http://"))
+	}
+	if resp.Header.Get("Status") != "" || resp.Header.Get("Version") != "" {
+		t.Errorf("SPDY pseudo-headers leaked into Header: %v", resp.Header)
+	}
+}
+
+func TestTransportStreamsBodies(t *testing.T) {
+	// Flow control keeps the upload within the server's buffers while the
+	// handler is busy echoing.
+	client, base := testTransport(t, &Server{InitialWindowSize: 16 << 10, Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(w, req.Body)
+	})})
+	// An upload of unknown length, larger than many DATA frames.
+	want := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	pr, pw := io.Pipe()
+	go func() {
+		for b := want; len(b) > 0; b = b[min(len(b), 1000):] {
+			pw.Write(b[:min(len(b), 1000)])
+		}
+		pw.Close()
+	}()
+	resp, err := client.Post(base+"/echo", "application/octet-stream", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("echo = %d bytes, %v; want %d bytes", len(got), err, len(want))
+	}
+}
+
+func TestTransportMultiplexes(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, req.URL.Path)
+	})}
+	client, base := testTransport(t, srv)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/%d", i)
+			resp, err := client.Get(base + path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if body, _ := io.ReadAll(resp.Body); string(body) != path {
+				t.Errorf("GET %s: body %q", path, body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := srv.numSessions(); n != 1 {
+		t.Errorf("server has %d sessions, want 1", n)
+	}
+}
+
+func TestTransportRespectsFlowControl(t *testing.T) {
+	client, base := testTransport(t, &Server{
+		InitialWindowSize: 1000,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			n, err := io.Copy(io.Discard, req.Body)
+			fmt.Fprint(w, n, err)
+		}),
+	})
+	// Prime the session so the server's SETTINGS have arrived.
+	if resp, err := client.Get(base); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	resp, err := client.Post(base, "text/plain", bytes.NewReader(make([]byte, 50000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "50000 <nil>" {
+		t.Errorf("server read %q, want 50000 bytes", body)
+	}
+}
+
+func TestTransportUploadsShareSessionBuffer(t *testing.T) {
+	// Twenty windows of 16 KiB are more than the session may buffer, but
+	// clients that stay within them are held back, not reset.
+	client, base := testTransport(t, &Server{
+		InitialWindowSize:     16 << 10,
+		MaxSessionBufferBytes: 32 << 10,
+		Logger:                testLogger(new(logBuffer)),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(20 * time.Millisecond) // let the buffers fill
+			n, err := io.Copy(io.Discard, req.Body)
+			fmt.Fprint(w, n, err)
+		}),
+	})
+	// Prime the session so the server's SETTINGS have arrived.
+	if resp, err := client.Get(base); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Post(base, "text/plain", bytes.NewReader(make([]byte, 64<<10)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if body, _ := io.ReadAll(resp.Body); string(body) != "65536 <nil>" {
+				t.Errorf("server read %q, want 65536 bytes", body)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTransportServerReset(t *testing.T) {
+	client, base := testTransport(t, &Server{
+		MaxRequestBodyBytes: 10,
+		Logger:              testLogger(new(logBuffer)),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			io.Copy(io.Discard, req.Body)
+		}),
+	})
+	resp, err := client.Post(base, "text/plain", strings.NewReader("much more than ten bytes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", resp.StatusCode)
+	}
+}
+
+func TestTransportRetriesAfterGoaway(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	client, base := testTransport(t, srv)
+	get := func() {
+		t.Helper()
+		resp, err := client.Get(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	get()
+	// The idle session goes away; the next request uses a new one.
+	srv.GoAwaySession(srv.Sessions()[0].ID)
+	waitFor(t, "first session to close", func() bool { return srv.numSessions() == 0 })
+	get()
+	if infos := srv.Sessions(); len(infos) != 1 || infos[0].ID != 2 {
+		t.Errorf("sessions after GOAWAY = %+v, want only session 2", infos)
+	}
+}
+
+func TestTransportContextCancel(t *testing.T) {
+	canceled := make(chan struct{})
+	client, base := testTransport(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		close(canceled)
+	})})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", base, nil)
+	_, err := client.Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Do = %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("handler context not canceled by the client's RST_STREAM")
+	}
+}
+
+func TestTransportDialTimeout(t *testing.T) {
+	// The dial outlives the request's context, so only DialTimeout ends
+	// a dial that never completes.
+	tr := &Transport{
+		DialTimeout: 50 * time.Millisecond,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		_, err := tr.RoundTrip(req)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("RoundTrip = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial did not time out")
+	}
+}
+
+func TestTransportTLS(t *testing.T) {
+	// Borrow httptest's certificate and the client configuration that
+	// trusts it.
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+	config := &tls.Config{Certificates: ts.TLS.Certificates, NextProtos: []string{NextProtoSPDY2}}
+	clientConfig := ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "secure")
+	})}
+	addr := listen(t, srv, func(l net.Listener) net.Listener { return tls.NewListener(l, config) })
+	tr := &Transport{TLSClientConfig: clientConfig}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get("https://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "secure" {
+		t.Errorf("body = %q, want %q", body, "secure")
+	}
+
+	// A server that does not negotiate spdy/2 is refused.
+	config.NextProtos = nil
+	addr = listen(t, &Server{}, func(l net.Listener) net.Listener { return tls.NewListener(l, config) })
+	if _, err := (&http.Client{Transport: tr}).Get("https://" + addr); !errors.Is(err, ErrNoSPDY) {
+		t.Errorf("Get from a server without spdy/2 = %v, want %v", err, ErrNoSPDY)
+	}
+}
+
+func TestTransportDialTLSContext(t *testing.T) {
+	addr := listen(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.URL.String())
+	})}, nil)
+	var dialed string
+	tr := &Transport{DialTLSContext: func(ctx context.Context, network, a string) (net.Conn, error) {
+		// Stand in for a TLS dialer with a plain connection.
+		dialed = a
+		return new(net.Dialer).DialContext(ctx, network, addr)
+	}}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get("https://example.com/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "https://example.com/x" || dialed != "example.com:443" {
+		t.Errorf("GET = %q dialing %q, want https://example.com/x dialing example.com:443", body, dialed)
+	}
+}
+
+// originStats returns tr's stats for its only origin.
+func originStats(t *testing.T, tr *Transport) OriginStats {
+	t.Helper()
+	stats := tr.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("Stats() = %+v, want one origin", stats)
+	}
+	return stats[0]
+}
+
+func TestTransportStreamLimit(t *testing.T) {
+	arrived := make(chan bool)
+	release := make(chan bool)
+	srv := &Server{MaxConcurrentStreams: 2, Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			arrived <- true
+			<-release
+		}
+		io.WriteString(w, "ok")
+	})}
+	client, base := testTransport(t, srv)
+	tr := client.Transport.(*Transport)
+	get := func(path string) {
+		resp, err := client.Get(base + path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	// Learn the server's limit first.
+	get("/")
+	waitFor(t, "first stream to close", func() bool { return originStats(t, tr).Streams == 0 })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get("/wait")
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-arrived
+	}
+	if s := originStats(t, tr); s.Sessions != 2 || s.Streams != 4 || s.Dials != 2 {
+		t.Errorf("with 4 streams and a limit of 2: %+v, want 2 sessions and 2 dials", s)
+	}
+	close(release)
+	wg.Wait()
+	if n := srv.numSessions(); n != 2 {
+		t.Errorf("server has %d sessions, want 2", n)
+	}
+	if s := originStats(t, tr); s.Requests != 5 || s.Dials != 2 {
+		t.Errorf("stats = %+v, want 5 requests and 2 dials", s)
+	}
+}
+
+func TestTransportStreamLimitBeforeSettings(t *testing.T) {
+	overlapped := make(chan bool, 1)
+	addr := rawServer(t, func(c net.Conn, r *bufio.Reader) {
+		hw := NewHeaderWriter(-1)
+		reply := func(id uint32) {
+			data := binary.BigEndian.AppendUint32(nil, id)
+			data = append(data, 0, 0)
+			data = append(data, hw.Encode(http.Header{"Status": {"200 OK"}, "Version": {"HTTP/1.1"}})...)
+			ControlFrame(TypeSynReply, FlagFin, data).WriteTo(c)
+		}
+		first := readSynStream(r)
+		// No other stream may open before the SETTINGS, which allow one.
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		overlapped <- readSynStream(r) != 0
+		c.SetReadDeadline(time.Time{})
+		SettingsFrame(0, Settings{{Id: SettingsMaxConcurrentStreams, Value: 1}}).WriteTo(c)
+		reply(first)
+		reply(readSynStream(r))
+		for {
+			if _, err := ReadFrame(r); err != nil {
+				return
+			}
+		}
+	})
+	tr := new(Transport)
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get("http://" + addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if <-overlapped {
+		t.Error("a second stream opened before the server's SETTINGS")
+	}
+	if s := originStats(t, tr); s.Dials != 1 || s.Requests != 2 {
+		t.Errorf("stats = %+v, want 1 dial for 2 requests", s)
+	}
+}
+
+func TestTransportDropsSessionOnGoaway(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	client, base := testTransport(t, srv)
+	tr := client.Transport.(*Transport)
+	resp, err := client.Get(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	srv.GoAwaySession(srv.Sessions()[0].ID)
+	waitFor(t, "session to leave the pool", func() bool {
+		s := originStats(t, tr)
+		return s.Sessions == 0 && s.GoAways == 1
+	})
+}
+
+func TestTransportIdleTimeout(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	addr := listen(t, srv, nil)
+	tr := &Transport{IdleTimeout: 20 * time.Millisecond}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		waitFor(t, "idle session to close", func() bool {
+			s := originStats(t, tr)
+			return s.Sessions == 0 && s.IdleClosed == int64(i+1)
+		})
+		waitFor(t, "server to see the close", func() bool { return srv.numSessions() == 0 })
+	}
+	if s := originStats(t, tr); s.Dials != 2 || s.Requests != 2 {
+		t.Errorf("stats = %+v, want 2 dials for 2 requests", s)
+	}
+}
+
+// rawServer runs serve on the first connection to a fake SPDY server and
+// returns the server's address.
+func rawServer(t *testing.T, serve func(c net.Conn, r *bufio.Reader)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		serve(c, bufio.NewReader(c))
+	}()
+	return l.Addr().String()
+}
+
+// readSynStream reads frames until a SYN_STREAM arrives and returns its
+// stream ID, or zero if the connection fails first.
+func readSynStream(r io.Reader) uint32 {
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			return 0
+		}
+		if f.Type() == TypeSynStream {
+			return binary.BigEndian.Uint32(f.Data[0:4])
+		}
+	}
+}
+
+func TestTransportMalformedHeaderBlock(t *testing.T) {
+	for _, typ := range []ControlFrameType{TypeSynReply, TypeSynStream} {
+		closed := make(chan struct{})
+		addr := rawServer(t, func(c net.Conn, r *bufio.Reader) {
+			defer close(closed)
+			id := readSynStream(r)
+			hw := NewHeaderWriter(-1)
+			h := http.Header{"Status": {"200 OK"}, "Version": {"HTTP/1.1"}, "Url": {"http://example.com/pushed"}}
+			f := pushFrame(hw, 2, id, h)
+			if typ == TypeSynReply {
+				data := binary.BigEndian.AppendUint32(nil, id)
+				data = append(data, 0, 0)
+				f = ControlFrame(TypeSynReply, 0, append(data, hw.Encode(h)...))
+			}
+			f.Data = f.Data[:len(f.Data)-8]
+			f.WriteTo(c)
+			// The client gives up the session.
+			for {
+				if _, err := ReadFrame(r); err != nil {
+					return
+				}
+			}
+		})
+		tr := new(Transport)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://"+addr+"/", nil)
+		_, err := tr.RoundTrip(req)
+		if err == nil || errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("truncated %v: RoundTrip = %v, want a header block error", typ, err)
+		}
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Errorf("truncated %v: session not closed", typ)
+		}
+		cancel()
+	}
+}
+
+func TestTransportResponseBufferLimit(t *testing.T) {
+	rsts := make(chan Frame, 1)
+	addr := rawServer(t, func(c net.Conn, r *bufio.Reader) {
+		id := readSynStream(r)
+		data := binary.BigEndian.AppendUint32(nil, id)
+		data = append(data, 0, 0)
+		data = append(data, NewHeaderWriter(-1).Encode(http.Header{"Status": {"200 OK"}, "Version": {"HTTP/1.1"}})...)
+		ControlFrame(TypeSynReply, 0, data).WriteTo(c)
+		for i := 0; i < 4; i++ {
+			DataFrame(id, 0, make([]byte, 512)).WriteTo(c)
+		}
+		for {
+			f, err := ReadFrame(r)
+			if err != nil {
+				return
+			}
+			if f.Type() == TypeRstStream {
+				rsts <- f
+				return
+			}
+		}
+	})
+	tr := &Transport{MaxStreamBufferBytes: 1024}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr, Timeout: 5 * time.Second}).Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// The response is not read while the server overruns the buffer.
+	expectRst(t, rsts, 1, Cancel)
+	if _, err := io.ReadAll(resp.Body); err != errResponseBuffer {
+		t.Errorf("reading body = %v, want %v", err, errResponseBuffer)
+	}
+}
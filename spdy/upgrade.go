@@ -0,0 +1,146 @@
+// spdy/upgrade.go
+
+package spdy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// IsUpgrade reports whether req asks to upgrade its connection to a SPDY
+// version this package speaks: spdy/3.1 or spdy/2.
+func IsUpgrade(req *http.Request) bool {
+	return req.ProtoAtLeast(1, 1) && headerHasToken(req.Header, "Connection", "upgrade") &&
+		upgradeVersion(req.Header) != 0
+}
+
+// upgradeVersion returns the SPDY version that the Upgrade header in h
+// asks for, preferring SPDY/3.1, or zero if it asks for neither.
+func upgradeVersion(h http.Header) int {
+	switch {
+	case headerHasToken(h, "Upgrade", NextProtoSPDY31):
+		return version3
+	case headerHasToken(h, "Upgrade", NextProtoSPDY2):
+		return Version
+	}
+	return 0
+}
+
+// upgradeToken returns the Upgrade token of a SPDY version.
+func upgradeToken(version int) string {
+	if version >= version3 {
+		return NextProtoSPDY31
+	}
+	return NextProtoSPDY2
+}
+
+// headerHasToken reports whether the comma-separated values of header key
+// in h include token, ignoring case.
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade answers an HTTP/1.1 request for which IsUpgrade is true with 101
+// Switching Protocols and serves the hijacked connection as a SPDY session
+// of srv, speaking SPDY/3.1 if the request offers it and SPDY/2 otherwise.
+// The upgrading request only sets up the session; the client sends its
+// requests as streams once it has the 101.  Upgrade returns once
+// the session is started; if it returns an error, it has written an HTTP
+// error response.
+func (srv *Server) Upgrade(w http.ResponseWriter, req *http.Request) error {
+	if !IsUpgrade(req) {
+		http.Error(w, "spdy: expected Upgrade: "+NextProtoSPDY31, http.StatusBadRequest)
+		return errors.New("spdy: request does not ask for Upgrade: " + NextProtoSPDY31)
+	}
+	version := upgradeVersion(req.Header)
+	if srv.shuttingDown() {
+		http.Error(w, "spdy: server is shutting down", http.StatusServiceUnavailable)
+		return ErrServerClosed
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "spdy: connection cannot be upgraded", http.StatusInternalServerError)
+		return errors.New("spdy: ResponseWriter does not support Hijack")
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "spdy: connection cannot be upgraded", http.StatusInternalServerError)
+		return err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", upgradeToken(version))
+	if err := rw.Flush(); err != nil {
+		c.Close()
+		return err
+	}
+	srv.logger().Debug("spdy: upgraded HTTP/1.1 connection", "remote", c.RemoteAddr().String(), "version", version)
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	// Frames the client sent early may already be buffered.
+	go srv.startSession(c, &sniffedConn{Conn: c, r: rw.Reader}, handler, version)
+	return nil
+}
+
+// UpgradeHandler returns a handler that upgrades the requests for which
+// IsUpgrade is true to SPDY sessions of srv and passes every other request
+// to h.  HTTP/1.x connections that Serve hands to net/http are upgraded
+// this way.
+func (srv *Server) UpgradeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if IsUpgrade(req) {
+			srv.Upgrade(w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// upgrade asks the server at the other end of c to switch to SPDY/3.1 with
+// an HTTP/1.1 Upgrade request for host, and returns the connection to carry
+// the session and the SPDY version the server switched to.
+func upgrade(ctx context.Context, c net.Conn, host string) (net.Conn, int, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/"},
+		Host:   host,
+		Header: http.Header{
+			"Connection": {"Upgrade"},
+			"Upgrade":    {NextProtoSPDY31},
+		},
+	}
+	if err := req.Write(c); err != nil {
+		return nil, 0, err
+	}
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	version := upgradeVersion(resp.Header)
+	if resp.StatusCode != http.StatusSwitchingProtocols || version == 0 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("%w: upgrade answered with %s", ErrNoSPDY, resp.Status)
+	}
+	return &sniffedConn{Conn: c, r: r}, version, nil
+}
@@ -0,0 +1,217 @@
+// spdy/upgrade_test.go
+
+package spdy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsUpgrade(t *testing.T) {
+	for _, tt := range []struct {
+		connection, upgrade string
+		want                bool
+	}{
+		{"Upgrade", "spdy/2", true},
+		{"keep-alive, upgrade", "websocket, SPDY/2", true},
+		{"Upgrade", "spdy/3.1", true},
+		{"Upgrade", "SPDY/3.1", true},
+		{"Upgrade", "spdy/3", false},
+		{"keep-alive", "spdy/2", false},
+		{"Upgrade", "", false},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Connection", tt.connection)
+		req.Header.Set("Upgrade", tt.upgrade)
+		if got := IsUpgrade(req); got != tt.want {
+			t.Errorf("IsUpgrade(Connection: %s, Upgrade: %s) = %v, want %v", tt.connection, tt.upgrade, got, tt.want)
+		}
+	}
+}
+
+func TestUpgradeHandler(t *testing.T) {
+	srv := &Server{Handler: protoHandler}
+	ts := httptest.NewServer(srv.UpgradeHandler(protoHandler))
+	defer ts.Close()
+	defer srv.Close()
+
+	tr := &Transport{UpgradeHTTP: true}
+	defer tr.CloseIdleConnections()
+	for i, tt := range []struct {
+		rt   http.RoundTripper
+		want string
+	}{
+		{http.DefaultTransport, "http body"},
+		{tr, "spdy body"},
+		{tr, "spdy body"},
+	} {
+		if got := altGet(t, tt.rt, "POST", ts.URL+"/", " body"); got != tt.want {
+			t.Errorf("request %d = %q, want %q", i, got, tt.want)
+		}
+	}
+	if stats := tr.Stats(); len(stats) != 1 || stats[0].Dials != 1 || stats[0].Requests != 2 {
+		t.Errorf("stats = %+v, want two requests on one upgraded session", stats)
+	}
+	waitFor(t, "the upgraded session", func() bool { return srv.numSessions() == 1 })
+	if v := srv.Sessions()[0].Version; v != 3 {
+		t.Errorf("upgraded session speaks SPDY/%d, want SPDY/3", v)
+	}
+
+	// A server that does not upgrade fails the dial.
+	plain := httptest.NewServer(protoHandler)
+	defer plain.Close()
+	_, err := (&http.Client{Transport: tr}).Get(plain.URL)
+	if !errors.Is(err, ErrNoSPDY) {
+		t.Errorf("Get from a server that does not upgrade = %v, want %v", err, ErrNoSPDY)
+	}
+}
+
+func TestServeUpgrade(t *testing.T) {
+	// A plain listener upgrades the HTTP/1.1 connections that ask.
+	srv := &Server{Handler: protoHandler}
+	addr := listen(t, srv, nil)
+	tr := &Transport{UpgradeHTTP: true}
+	defer tr.CloseIdleConnections()
+	if got := altGet(t, tr, "GET", "http://"+addr+"/", ""); got != "spdy" {
+		t.Errorf("upgraded request went over %q", got)
+	}
+
+	// A client that only offers spdy/2 still gets it.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: spdy/2\r\n\r\n")
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "spdy/2" {
+		t.Fatalf("Upgrade: spdy/2 got %s with Upgrade: %q", resp.Status, resp.Header.Get("Upgrade"))
+	}
+	if f := readControl(t, r, TypeSettings); f.Header[1] != 2 {
+		t.Errorf("SETTINGS has version %d, want 2", f.Header[1])
+	}
+}
+
+// TestUpgradeSPDY31 speaks SPDY/3.1 to a session upgraded the way container
+// runtimes ask for it.
+func TestUpgradeSPDY31(t *testing.T) {
+	srv := &Server{Handler: protoHandler}
+	addr := listen(t, srv, nil)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "POST / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\nContent-Length: 0\r\n\r\n")
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != NextProtoSPDY31 {
+		t.Fatalf("Upgrade: SPDY/3.1 got %s with Upgrade: %q", resp.Status, resp.Header.Get("Upgrade"))
+	}
+
+	f := readControl(t, r, TypeSettings)
+	if f.Header[1] != 3 {
+		t.Errorf("SETTINGS has version %d, want 3", f.Header[1])
+	}
+	settings, err := DecodeSettings(3, f.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := settings.Get(SettingsInitialWindowSize); v != 64<<10 {
+		t.Errorf("SETTINGS_INITIAL_WINDOW_SIZE = %d, want %d", v, 64<<10)
+	}
+
+	// Like spdystream, the client announces no window and ignores the
+	// server's: the body overruns the stream window in frames larger than
+	// the stream buffer.  The server holds the client back by reading no
+	// further until the handler catches up, and returns the data to the
+	// session window as it arrives.
+	hw := newHeaderWriter(-1, 3)
+	body := strings.Repeat("x", 200000)
+	withVersion(post(hw, 1, "http://example.com/", len(body)), 3).WriteTo(c)
+	go func() {
+		DataFrame(1, 0, []byte(body[:100000])).WriteTo(c)
+		DataFrame(1, FlagFin, []byte(body[100000:])).WriteTo(c)
+	}()
+	if f := readControl(t, r, TypeWindowUpdate); f.Header[1] != 3 || binary.BigEndian.Uint32(f.Data[0:4]) != 0 {
+		t.Errorf("first WINDOW_UPDATE is version %d for stream %d, want a SPDY/3 update of the session window", f.Header[1], binary.BigEndian.Uint32(f.Data[0:4]))
+	}
+
+	f = readControl(t, r, TypeSynReply)
+	if f.Header[1] != 3 || binary.BigEndian.Uint32(f.Data[0:4]) != 1 {
+		t.Fatalf("SYN_REPLY is version %d for stream %d", f.Header[1], binary.BigEndian.Uint32(f.Data[0:4]))
+	}
+	h, err := newHeaderReader(3).Decode(f.Data[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Get("Status"); got != "200 OK" {
+		t.Errorf("status = %q, want %q", got, "200 OK")
+	}
+	var got []byte
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.IsControl() {
+			continue
+		}
+		got = append(got, f.Data...)
+		if f.Flags&FlagFin != 0 {
+			break
+		}
+	}
+	if string(got) != "spdy"+body {
+		t.Errorf("body is %d bytes, want %d", len(got), len("spdy"+body))
+	}
+}
+
+// TestUpgradeSPDY31FlowControl sends bodies larger than the SPDY/3.1
+// windows both ways through a Transport.
+func TestUpgradeSPDY31FlowControl(t *testing.T) {
+	srv := &Server{Handler: protoHandler}
+	ts := httptest.NewServer(srv.UpgradeHandler(protoHandler))
+	defer ts.Close()
+	defer srv.Close()
+	tr := &Transport{UpgradeHTTP: true}
+	defer tr.CloseIdleConnections()
+
+	body := strings.Repeat("0123456789", 50<<10)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := (&http.Client{Transport: tr, Timeout: 5 * time.Second}).Post(ts.URL, "text/plain", strings.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			got, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || string(got) != "spdy"+body {
+				t.Errorf("echoed %d bytes, %v; want %d bytes", len(got), err, len("spdy"+body))
+			}
+		}()
+	}
+	wg.Wait()
+}